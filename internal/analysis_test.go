@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeBias(t *testing.T) {
+	rng := rand.New(rand.NewSource(15))
+	randomNonce := func(bits uint) *big.Int {
+		k := new(big.Int).Rand(rng, new(big.Int).Lsh(big.NewInt(1), bits))
+		return k.Add(k, big.NewInt(1))
+	}
+	honest, _ := btcec.NewPrivateKey(btcec.S256())
+	reuser, _ := btcec.NewPrivateKey(btcec.S256())
+	lowEntropy, _ := btcec.NewPrivateKey(btcec.S256())
+	oneKey, _ := btcec.NewPrivateKey(btcec.S256())
+	lonely, _ := btcec.NewPrivateKey(btcec.S256())
+
+	bucket := sighash.NewSHPairBucket(nil)
+	for i := 0; i < 32; i++ {
+		msg := fmt.Sprintf("message %d", i)
+		bucket.Pairs = append(bucket.Pairs, ecdsaPair(honest, msg, randomNonce(255)))
+
+		reused := randomNonce(255)
+		if i%4 == 0 {
+			reused = testNonce
+		}
+		bucket.Pairs = append(bucket.Pairs, ecdsaPair(reuser, msg, reused))
+
+		// A broken signer whose s values are short
+		pair := ecdsaPair(lowEntropy, msg, randomNonce(255))
+		pair.S = randomNonce(64)
+		bucket.Pairs = append(bucket.Pairs, pair)
+	}
+	bucket.Pairs = append(bucket.Pairs,
+		ecdsaPair(oneKey, "first", big.NewInt(1)),
+		ecdsaPair(oneKey, "second", randomNonce(255)),
+		ecdsaPair(lonely, "only", randomNonce(255)),
+	)
+
+	report := bucket.AnalyzeBias(2)
+	assert.Equal(t, 5, report.KeyCount, "wrong number of keys")
+	assert.Equal(t, 99, report.SigCount, "wrong number of signatures")
+	if !assert.Equal(t, 4, len(report.Keys), "wrong number of analyzed keys") {
+		return
+	}
+
+	byKey := make(map[string]*sighash.KeyBiasReport)
+	for _, key := range report.Keys {
+		byKey[key.PublicKey] = key
+	}
+	pubHex := func(priv *btcec.PrivateKey) string {
+		return hex.EncodeToString(priv.PubKey().SerializeUncompressed())
+	}
+	assert.Equal(t, 1, byKey[pubHex(oneKey)].KnownBadR, "missed the known bad nonce")
+	assert.Equal(t, 7, byKey[pubHex(reuser)].DuplicateR, "wrong duplicate R count")
+	assert.InDelta(t, 7.0/32, byKey[pubHex(reuser)].DuplicateRRate, 1e-9, "wrong duplicate R rate")
+	assert.Equal(t, 0, byKey[pubHex(honest)].DuplicateR+byKey[pubHex(honest)].SharedR)
+	assert.Equal(t, 32, byKey[pubHex(lowEntropy)].LeadingZeros["s"][7], "wrong leading zeros histogram")
+
+	// The honest signer ranks last
+	assert.Equal(t, pubHex(honest), report.Keys[3].PublicKey, "honest signer looks suspicious")
+	for _, key := range report.Keys[:3] {
+		assert.True(t, key.Score > report.Keys[3].Score+10, "suspicious signer looks honest")
+	}
+
+	encoded, err := json.Marshal(report)
+	if assert.NoError(t, err) {
+		decoded := sighash.BiasReport{}
+		assert.NoError(t, json.Unmarshal(encoded, &decoded))
+		assert.Equal(t, report.Keys[0].Score, decoded.Keys[0].Score)
+	}
+}
+
+func TestAnalyzeBiasCanonicalS(t *testing.T) {
+	rng := rand.New(rand.NewSource(20))
+	n := btcec.S256().N
+	for _, sigs := range []int{10, 50, 200} {
+		for trial := 0; trial < 3; trial++ {
+			d := new(big.Int).Rand(rng, n)
+			priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), d.Add(d, big.NewInt(1)).Bytes())
+			bucket := sighash.NewSHPairBucket(nil)
+			for i := 0; i < sigs; i++ {
+				k := new(big.Int).Rand(rng, n)
+				pair := ecdsaPair(priv, fmt.Sprintf("message %d", i), k.Add(k, big.NewInt(1)))
+				pair.Canonicalize()
+				bucket.Pairs = append(bucket.Pairs, pair)
+			}
+
+			// Low S signers look as honest as any other, however many
+			// signatures they made
+			report := bucket.AnalyzeBias(2)
+			if assert.Equal(t, 1, len(report.Keys)) {
+				assert.True(t, report.Keys[0].Score < 10,
+					"honest signer with %d low S signatures scored %f", sigs, report.Keys[0].Score)
+			}
+		}
+	}
+}
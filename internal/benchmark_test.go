@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/canselcik/nonced/internal/sighash"
+)
+
+// benchmarkPairs returns pairs by keys signing count messages each, every
+// tenth key reusing its first nonce once.
+func benchmarkPairs(keys, count int) []*sighash.SHPair {
+	pairs := make([]*sighash.SHPair, 0, keys*count)
+	for i := 0; i < keys; i++ {
+		priv, _ := btcec.NewPrivateKey(btcec.S256())
+		for j := 0; j < count; j++ {
+			k := big.NewInt(int64(i*count + j + 1))
+			if i%10 == 0 && j == 1 {
+				k = big.NewInt(int64(i*count + 1))
+			}
+			pairs = append(pairs, ecdsaPair(priv, fmt.Sprintf("message %d/%d", i, j), k))
+		}
+	}
+	return pairs
+}
+
+func BenchmarkRecoverPrivateKey(b *testing.B) {
+	priv := testPrivKey()
+	lhs := ecdsaPair(priv, "first", testNonce)
+	rhs := ecdsaPair(priv, "second", testNonce)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := lhs.RecoverPrivateKey(rhs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddTx(b *testing.B) {
+	ds := new(MockedDataSource)
+	keys := make([]*btcec.PrivateKey, 50)
+	pkScripts := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i], _ = btcec.NewPrivateKey(btcec.S256())
+		pkScripts[i] = p2wpkhScript(b, keys[i].PubKey())
+	}
+	fundingTx := newFundingTx(ds, pkScripts...)
+	spendTx := newSpendingTx(fundingTx)
+	sigHashes := txscript.NewTxSigHashes(spendTx)
+	for i, priv := range keys {
+		z, err := txscript.CalcWitnessSigHash(pkScripts[i], sigHashes, txscript.SigHashAll, spendTx, i, 100000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		spendTx.TxIn[i].Witness = wire.TxWitness{
+			encodeSig(signWithNonce(priv, z, big.NewInt(int64(i+1))), txscript.SigHashAll),
+			priv.PubKey().SerializeCompressed(),
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bucket := sighash.NewSHPairBucket(ds)
+		if extracted, _ := bucket.AddTx(spendTx); extracted != len(keys) {
+			b.Fatalf("extracted %d SHPairs", extracted)
+		}
+	}
+}
+
+func BenchmarkSolve(b *testing.B) {
+	pairs := benchmarkPairs(200, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bucket := sighash.NewSHPairBucket(nil)
+		bucket.Pairs = append(bucket.Pairs, pairs...)
+		if keys, _ := bucket.Solve(); len(keys) != 20 {
+			b.Fatalf("recovered %d keys", len(keys))
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineNonStandardScripts(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	other, _ := btcec.NewPrivateKey(btcec.S256())
+	pubKey := priv.PubKey().SerializeCompressed()
+
+	// Only <pubkey> OP_CHECKSIG past the separator is signed
+	signedScript := p2pkScript(t, pubKey)
+	bareScript, err := txscript.NewScriptBuilder().AddData([]byte{0x2a}).AddOp(txscript.OP_DROP).
+		AddOp(txscript.OP_CODESEPARATOR).AddData(pubKey).AddOp(txscript.OP_CHECKSIG).Script()
+	assert.NoError(t, err)
+
+	// The untaken branch checks a signature of another key
+	witnessScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_IF).AddData(pubKey).AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ELSE).AddData(other.PubKey().SerializeCompressed()).AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ENDIF).Script()
+	assert.NoError(t, err)
+
+	fundingTx := newFundingTx(ds, bareScript, p2wshScript(t, witnessScript))
+	spendTx := newSpendingTx(fundingTx)
+	z, err := txscript.CalcSignatureHash(signedScript, txscript.SigHashAll, spendTx, 0)
+	assert.NoError(t, err)
+	spendTx.TxIn[0].SignatureScript = pushScript(t,
+		encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll))
+
+	z, err = txscript.CalcWitnessSigHash(witnessScript, txscript.NewTxSigHashes(spendTx),
+		txscript.SigHashAll, spendTx, 1, 100000)
+	assert.NoError(t, err)
+	spendTx.TxIn[1].Witness = wire.TxWitness{
+		encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll), {0x01}, witnessScript,
+	}
+
+	// Neither matches a template
+	bucket := sighash.NewSHPairBucket(ds)
+	_, errMap := bucket.AddTx(spendTx)
+	assert.Equal(t, sighash.WarnTemplateSkip, errMap[0], "nonstandard script matched a template")
+
+	bucket = sighash.NewSHPairBucket(ds)
+	bucket.Mode = sighash.ModeEngine
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 2, extracted, "wrong number of SHPair extractions")
+	assertRecovered(t, bucket, priv)
+
+	// A signature that doesn't verify yields nothing
+	spendTx.TxIn[0].SignatureScript = pushScript(t,
+		encodeSig(signWithNonce(other, z, testNonce), txscript.SigHashAll))
+	bucket = sighash.NewSHPairBucket(ds)
+	bucket.Mode = sighash.ModeEngine
+	_, errMap = bucket.AddTx(spendTx)
+	assert.Equal(t, sighash.WarnScriptExecSkip, errMap[0], "failing script not rejected")
+	ds.AssertExpectations(t)
+}
+
+func TestEngineStandardScripts(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	cosigner, _ := btcec.NewPrivateKey(btcec.S256())
+
+	// The engine agrees with the templates on nested witness and multisig spends
+	nestedP2WPKH := p2wpkhScript(t, priv.PubKey())
+	redeemScript := multiSigScript(t, 2, priv.PubKey(), cosigner.PubKey())
+	fundingTx := newFundingTx(ds, p2shScript(t, nestedP2WPKH), p2shScript(t, redeemScript))
+	spendTx := newSpendingTx(fundingTx)
+	spendTx.TxIn[0].SignatureScript = pushScript(t, nestedP2WPKH)
+
+	z, err := txscript.CalcWitnessSigHash(nestedP2WPKH, txscript.NewTxSigHashes(spendTx),
+		txscript.SigHashAll, spendTx, 0, 100000)
+	assert.NoError(t, err)
+	spendTx.TxIn[0].Witness = wire.TxWitness{
+		encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll),
+		priv.PubKey().SerializeCompressed(),
+	}
+
+	z, err = txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, spendTx, 1)
+	assert.NoError(t, err)
+	cosignerSig, err := cosigner.Sign(z)
+	assert.NoError(t, err)
+	spendTx.TxIn[1].SignatureScript, err = txscript.NewScriptBuilder().AddOp(txscript.OP_0).
+		AddData(encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll)).
+		AddData(encodeSig(cosignerSig, txscript.SigHashAll)).
+		AddData(redeemScript).Script()
+	assert.NoError(t, err)
+
+	bucket := sighash.NewSHPairBucket(ds)
+	bucket.Mode = sighash.ModeEngine
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 3, extracted, "wrong number of SHPair extractions")
+	assertRecovered(t, bucket, priv)
+	ds.AssertExpectations(t)
+}
+
+func TestEngineTaproot(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	cosigner, _ := btcec.NewPrivateKey(btcec.S256())
+	internalKey, _ := btcec.NewPrivateKey(btcec.S256())
+
+	// <cosigner> CHECKSIG <priv> CHECKSIGADD 2 NUMEQUAL, which the engine
+	// cannot run, is left to the templates
+	leafScript, err := txscript.NewScriptBuilder().
+		AddData(xOnly(cosigner.PubKey())).AddOp(txscript.OP_CHECKSIG).
+		AddData(xOnly(priv.PubKey())).AddOp(0xba).
+		AddInt64(2).AddOp(txscript.OP_NUMEQUAL).Script()
+	assert.NoError(t, err)
+	outputKey, controlBlock, leafHash := tapscriptOutput(internalKey, leafScript)
+
+	fundingTx := newFundingTx(ds, p2trScript(outputKey), p2trScript(outputKey))
+	spendTx := newSpendingTx(fundingTx)
+	sigHashes := sighash.NewTaprootSigHashes(spendTx, fundingTx.TxOut)
+	for i := 0; i < 2; i++ {
+		z, err := sighash.CalcTapscriptSigHash(sigHashes, sighash.SigHashDefault, spendTx, i, nil, leafHash, 0xffffffff)
+		assert.NoError(t, err)
+		spendTx.TxIn[i].Witness = wire.TxWitness{
+			signSchnorrWithNonce(priv, z, testNonce, sighash.SigHashDefault),
+			signSchnorrWithNonce(cosigner, z, big.NewInt(int64(1000+i)), sighash.SigHashDefault),
+			leafScript,
+			controlBlock,
+		}
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	bucket.Mode = sighash.ModeEngine
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 4, extracted, "wrong number of SHPair extractions")
+	assert.Equal(t, 2, bucket.TemplateCounts[sighash.TemplateP2TR], "wrong template counts")
+
+	solutions, _ := bucket.Solve()
+	if assert.Equal(t, 1, len(solutions), "wrong number of PrivateKey solutions") {
+		assert.Equal(t, hex.EncodeToString(xOnly(priv.PubKey())),
+			hex.EncodeToString(xOnly(solutions[0].Key.PubKey())), "derived incorrect privateKey")
+	}
+	ds.AssertExpectations(t)
+}
@@ -0,0 +1,738 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testPrivHex = "c477f9f65c22cce20657faa5b2d1d8122336f851a508a1ed04e479c34985bf96"
+	testNonce   = big.NewInt(0x6b6e6f776e)
+)
+
+func testPrivKey() *btcec.PrivateKey {
+	raw, _ := hex.DecodeString(testPrivHex)
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), raw)
+	return priv
+}
+
+// signWithNonce produces an ECDSA signature over hash using the given nonce,
+// which is exactly what a broken signer reusing k would have done.
+func signWithNonce(priv *btcec.PrivateKey, hash []byte, k *big.Int) *btcec.Signature {
+	n := btcec.S256().N
+	rx, _ := btcec.S256().ScalarBaseMult(k.Bytes())
+	r := new(big.Int).Mod(rx, n)
+	s := new(big.Int).Mul(r, priv.D)
+	s.Add(s, new(big.Int).SetBytes(hash))
+	s.Mul(s, new(big.Int).ModInverse(k, n))
+	s.Mod(s, n)
+	return &btcec.Signature{R: r, S: s}
+}
+
+func encodeSig(sig *btcec.Signature, hashType txscript.SigHashType) []byte {
+	return append(sig.Serialize(), byte(hashType))
+}
+
+// newFundingTx creates a txn paying to each of the given pkScripts, and
+// registers it with the mocked DataProvider.
+func newFundingTx(ds *MockedDataSource, pkScripts ...[]byte) *wire.MsgTx {
+	fundingTx := wire.NewMsgTx(wire.TxVersion)
+	fundingTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0xffffffff}, []byte{0x51}, nil))
+	for _, pkScript := range pkScripts {
+		fundingTx.AddTxOut(wire.NewTxOut(100000, pkScript))
+	}
+	fundingHash := fundingTx.TxHash()
+	ds.On("GetTransaction", &fundingHash).Return(btcutil.NewTx(fundingTx), nil)
+	return fundingTx
+}
+
+// newSpendingTx spends every output of fundingTx, leaving the inputs unsigned.
+func newSpendingTx(fundingTx *wire.MsgTx) *wire.MsgTx {
+	fundingHash := fundingTx.TxHash()
+	spendTx := wire.NewMsgTx(wire.TxVersion)
+	for i := range fundingTx.TxOut {
+		spendTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&fundingHash, uint32(i)), nil, nil))
+	}
+	spendTx.AddTxOut(wire.NewTxOut(50000, []byte{txscript.OP_TRUE}))
+	return spendTx
+}
+
+func p2wpkhScript(t testing.TB, pub *btcec.PublicKey) []byte {
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(
+		btcutil.Hash160(pub.SerializeCompressed()), &chaincfg.MainNetParams)
+	assert.NoError(t, err)
+	pkScript, err := txscript.PayToAddrScript(addr)
+	assert.NoError(t, err)
+	return pkScript
+}
+
+func p2pkhScript(t *testing.T, pub *btcec.PublicKey) []byte {
+	addr, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(pub.SerializeUncompressed()), &chaincfg.MainNetParams)
+	assert.NoError(t, err)
+	pkScript, err := txscript.PayToAddrScript(addr)
+	assert.NoError(t, err)
+	return pkScript
+}
+
+func assertRecovered(t *testing.T, bucket *sighash.SHPairBucket, priv *btcec.PrivateKey) {
+	solutions, _ := bucket.Solve()
+	if assert.Equal(t, 1, len(solutions), "wrong number of PrivateKey solutions") {
+		rec := solutions[0]
+		assert.Equal(t, hex.EncodeToString(priv.Serialize()),
+			hex.EncodeToString(rec.Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, sighash.RecoveryNonceReuse, rec.Method, "wrong recovery method")
+		assert.True(t, rec.Verified, "source signatures failed to verify")
+		assert.True(t, rec.Candidate == 0 || rec.Candidate == 1, "no sign candidate recorded")
+		if assert.Equal(t, 2, len(rec.Pairs), "wrong number of source pairs") && assert.NotNil(t, rec.K) {
+			rx, _ := btcec.S256().ScalarBaseMult(rec.K.Bytes())
+			assert.Equal(t, 0, rx.Mod(rx, btcec.S256().N).Cmp(rec.Pairs[0].R), "derived incorrect nonce")
+		}
+	}
+}
+
+func TestP2WPKHNonceReuse(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	pkScript := p2wpkhScript(t, priv.PubKey())
+
+	// A legacy P2PKH input is mixed in to make sure it's still handled
+	fundingTx := newFundingTx(ds, pkScript, pkScript, p2pkhScript(t, priv.PubKey()))
+	spendTx := newSpendingTx(fundingTx)
+	sigHashes := txscript.NewTxSigHashes(spendTx)
+	for i := 0; i < 2; i++ {
+		z, err := txscript.CalcWitnessSigHash(pkScript, sigHashes, txscript.SigHashAll, spendTx, i, 100000)
+		assert.NoError(t, err)
+		sig := signWithNonce(priv, z, testNonce)
+		spendTx.TxIn[i].Witness = wire.TxWitness{
+			encodeSig(sig, txscript.SigHashAll), priv.PubKey().SerializeCompressed(),
+		}
+	}
+	legacySig, err := txscript.SignatureScript(spendTx, 2,
+		fundingTx.TxOut[2].PkScript, txscript.SigHashAll, priv, false)
+	assert.NoError(t, err)
+	spendTx.TxIn[2].SignatureScript = legacySig
+
+	// Mined at height 200000, as told by the coinbase
+	block := wire.NewMsgBlock(&wire.BlockHeader{Version: 2})
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0xffffffff}, pushScript(t, []byte{0x40, 0x0d, 0x03}), nil))
+	assert.NoError(t, block.AddTransaction(coinbase))
+	assert.NoError(t, block.AddTransaction(spendTx))
+	locations := sighash.BlockTxLocations(block)
+	assert.Equal(t, int32(200000), locations[1].BlockHeight, "wrong coinbase height")
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddMinedTx(spendTx, locations[1])
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 3, extracted, "wrong number of SHPair extractions")
+	for i, pair := range bucket.Pairs {
+		assert.Equal(t, spendTx.TxHash(), pair.TxID, "wrong txid recorded")
+		assert.Equal(t, i, pair.InputIndex, "wrong input index recorded")
+		assert.Equal(t, block.BlockHash(), pair.Location.BlockHash, "wrong block recorded")
+		assert.Equal(t, 1, pair.Location.TxIndex, "wrong tx position recorded")
+	}
+	assert.Equal(t, sighash.TemplateP2WPKH, bucket.Pairs[0].Template)
+	assert.Equal(t, sighash.TemplateP2PKH, bucket.Pairs[2].Template)
+
+	assertRecovered(t, bucket, priv)
+	ds.AssertExpectations(t)
+}
+
+func p2shScript(t *testing.T, redeemScript []byte) []byte {
+	addr, err := btcutil.NewAddressScriptHash(redeemScript, &chaincfg.MainNetParams)
+	assert.NoError(t, err)
+	pkScript, err := txscript.PayToAddrScript(addr)
+	assert.NoError(t, err)
+	return pkScript
+}
+
+func p2wshScript(t *testing.T, witnessScript []byte) []byte {
+	scriptHash := sha256.Sum256(witnessScript)
+	addr, err := btcutil.NewAddressWitnessScriptHash(scriptHash[:], &chaincfg.MainNetParams)
+	assert.NoError(t, err)
+	pkScript, err := txscript.PayToAddrScript(addr)
+	assert.NoError(t, err)
+	return pkScript
+}
+
+func multiSigScript(t *testing.T, nRequired int, keys ...*btcec.PublicKey) []byte {
+	addrs := make([]*btcutil.AddressPubKey, 0, len(keys))
+	for _, key := range keys {
+		addr, err := btcutil.NewAddressPubKey(key.SerializeCompressed(), &chaincfg.MainNetParams)
+		assert.NoError(t, err)
+		addrs = append(addrs, addr)
+	}
+	script, err := txscript.MultiSigScript(addrs, nRequired)
+	assert.NoError(t, err)
+	return script
+}
+
+func pushScript(t *testing.T, pushes ...[]byte) []byte {
+	builder := txscript.NewScriptBuilder()
+	for _, push := range pushes {
+		builder.AddData(push)
+	}
+	script, err := builder.Script()
+	assert.NoError(t, err)
+	return script
+}
+
+func TestNestedWitnessNonceReuse(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	cosigner, _ := btcec.NewPrivateKey(btcec.S256())
+
+	nestedP2WPKH := p2wpkhScript(t, priv.PubKey())
+	witnessScript := multiSigScript(t, 2, priv.PubKey(), cosigner.PubKey())
+	nestedP2WSH := p2wshScript(t, witnessScript)
+	fundingTx := newFundingTx(ds, p2shScript(t, nestedP2WPKH), p2shScript(t, nestedP2WSH))
+	spendTx := newSpendingTx(fundingTx)
+	spendTx.TxIn[0].SignatureScript = pushScript(t, nestedP2WPKH)
+	spendTx.TxIn[1].SignatureScript = pushScript(t, nestedP2WSH)
+
+	sigHashes := txscript.NewTxSigHashes(spendTx)
+	z, err := txscript.CalcWitnessSigHash(nestedP2WPKH, sigHashes, txscript.SigHashAll, spendTx, 0, 100000)
+	assert.NoError(t, err)
+	spendTx.TxIn[0].Witness = wire.TxWitness{
+		encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll),
+		priv.PubKey().SerializeCompressed(),
+	}
+
+	z, err = txscript.CalcWitnessSigHash(witnessScript, sigHashes, txscript.SigHashAll, spendTx, 1, 100000)
+	assert.NoError(t, err)
+	cosignerSig, err := cosigner.Sign(z)
+	assert.NoError(t, err)
+	spendTx.TxIn[1].Witness = wire.TxWitness{
+		nil,
+		encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll),
+		encodeSig(cosignerSig, txscript.SigHashAll),
+		witnessScript,
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 3, extracted, "wrong number of SHPair extractions")
+	assert.Equal(t, hex.EncodeToString(cosigner.PubKey().SerializeUncompressed()),
+		hex.EncodeToString(bucket.Pairs[2].PublicKey), "signature matched to the wrong key")
+
+	assertRecovered(t, bucket, priv)
+	ds.AssertExpectations(t)
+}
+
+func TestMultiSigNonceReuse(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	cosigner, _ := btcec.NewPrivateKey(btcec.S256())
+	idle, _ := btcec.NewPrivateKey(btcec.S256())
+
+	// 2-of-3 where the middle key doesn't sign, once bare and once in P2SH
+	redeemScript := multiSigScript(t, 2, priv.PubKey(), idle.PubKey(), cosigner.PubKey())
+	fundingTx := newFundingTx(ds, redeemScript, p2shScript(t, redeemScript))
+	spendTx := newSpendingTx(fundingTx)
+	for i := 0; i < 2; i++ {
+		z, err := txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, spendTx, i)
+		assert.NoError(t, err)
+		cosignerSig, err := cosigner.Sign(z)
+		assert.NoError(t, err)
+
+		builder := txscript.NewScriptBuilder().AddOp(txscript.OP_0).
+			AddData(encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll)).
+			AddData(encodeSig(cosignerSig, txscript.SigHashAll))
+		if i == 1 {
+			builder.AddData(redeemScript)
+		}
+		spendTx.TxIn[i].SignatureScript, err = builder.Script()
+		assert.NoError(t, err)
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 4, extracted, "wrong number of SHPair extractions")
+
+	assertRecovered(t, bucket, priv)
+	ds.AssertExpectations(t)
+}
+
+func TestSigHashTypes(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	legacyScript, witnessScript := p2pkhScript(t, priv.PubKey()), p2wpkhScript(t, priv.PubKey())
+
+	fundingTx := newFundingTx(ds, legacyScript, legacyScript, witnessScript, witnessScript)
+	spendTx := newSpendingTx(fundingTx)
+	sigHashes := txscript.NewTxSigHashes(spendTx)
+	hashTypes := []txscript.SigHashType{
+		txscript.SigHashSingle | txscript.SigHashAnyOneCanPay,
+		txscript.SigHashNone,
+		txscript.SigHashSingle,
+		txscript.SigHashAll | txscript.SigHashAnyOneCanPay,
+	}
+	for i, hashType := range hashTypes {
+		if i < 2 {
+			z, err := txscript.CalcSignatureHash(legacyScript, hashType, spendTx, i)
+			assert.NoError(t, err)
+			spendTx.TxIn[i].SignatureScript = pushScript(t,
+				encodeSig(signWithNonce(priv, z, testNonce), hashType),
+				priv.PubKey().SerializeUncompressed())
+		} else {
+			z, err := txscript.CalcWitnessSigHash(witnessScript, sigHashes, hashType, spendTx, i, 100000)
+			assert.NoError(t, err)
+			spendTx.TxIn[i].Witness = wire.TxWitness{
+				encodeSig(signWithNonce(priv, z, testNonce), hashType),
+				priv.PubKey().SerializeCompressed(),
+			}
+		}
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 4, extracted, "wrong number of SHPair extractions")
+	for i, pair := range bucket.Pairs {
+		assert.Equal(t, hashTypes[i], pair.HashType, "wrong hashtype recorded")
+	}
+
+	// Every combination of the pairs yields the same key
+	solutions, _ := bucket.Solve()
+	assert.NotEmpty(t, solutions, "wrong number of PrivateKey solutions")
+	for _, solution := range solutions {
+		assert.Equal(t, testPrivHex, hex.EncodeToString(solution.Key.Serialize()), "derived incorrect privateKey")
+	}
+	ds.AssertExpectations(t)
+}
+
+func TestClassifyScript(t *testing.T) {
+	priv := testPrivKey()
+	redeemScript := multiSigScript(t, 1, priv.PubKey())
+	templates := map[sighash.ScriptTemplate][]byte{
+		sighash.TemplateP2PKH:       p2pkhScript(t, priv.PubKey()),
+		sighash.TemplateP2SH:        p2shScript(t, redeemScript),
+		sighash.TemplateMultiSig:    redeemScript,
+		sighash.TemplateP2WPKH:      p2wpkhScript(t, priv.PubKey()),
+		sighash.TemplateP2WSH:       p2wshScript(t, redeemScript),
+		sighash.TemplateP2TR:        p2trScript(xOnly(priv.PubKey())),
+		sighash.TemplateNonStandard: {txscript.OP_TRUE},
+	}
+	for template, script := range templates {
+		assert.Equal(t, template, sighash.ClassifyScript(script), "misclassified %s", template)
+	}
+}
+
+func TestScriptSigPushEncodings(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	pkScript := p2pkhScript(t, priv.PubKey())
+
+	fundingTx := newFundingTx(ds, pkScript, pkScript)
+	spendTx := newSpendingTx(fundingTx)
+	for i := 0; i < 2; i++ {
+		z, err := txscript.CalcSignatureHash(pkScript, txscript.SigHashAll, spendTx, i)
+		assert.NoError(t, err)
+		sig := encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll)
+		key := priv.PubKey().SerializeUncompressed()
+
+		// Non-minimal OP_PUSHDATA1/OP_PUSHDATA2 pushes, with a junk push in
+		// front on the second input, used to throw off fixed offsets
+		scriptSig := []byte{txscript.OP_PUSHDATA1, byte(len(sig))}
+		if i == 1 {
+			scriptSig = []byte{txscript.OP_DATA_2, 0xde, 0xad, txscript.OP_PUSHDATA1, byte(len(sig))}
+		}
+		scriptSig = append(scriptSig, sig...)
+		scriptSig = append(scriptSig, txscript.OP_PUSHDATA2, byte(len(key)), 0x00)
+		spendTx.TxIn[i].SignatureScript = append(scriptSig, key...)
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 2, extracted, "wrong number of SHPair extractions")
+	assert.Equal(t, 2, bucket.TemplateCounts[sighash.TemplateP2PKH], "wrong template count")
+	for _, pair := range bucket.Pairs {
+		assert.Equal(t, sighash.TemplateP2PKH, pair.Template, "wrong template recorded")
+	}
+
+	// A truncated push is rejected rather than misread
+	spendTx.TxIn[0].SignatureScript = []byte{txscript.OP_PUSHDATA1, 0x48, 0x30}
+	_, errMap = sighash.NewSHPairBucket(ds).AddTx(spendTx)
+	assert.Equal(t, sighash.WarnScriptParseSkip, errMap[0], "truncated scriptSig not rejected")
+
+	assertRecovered(t, bucket, priv)
+	ds.AssertExpectations(t)
+}
+
+func p2pkScript(t *testing.T, pubKey []byte) []byte {
+	script, err := txscript.NewScriptBuilder().AddData(pubKey).AddOp(txscript.OP_CHECKSIG).Script()
+	assert.NoError(t, err)
+	return script
+}
+
+func TestP2PKNonceReuse(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+
+	// Early coinbase outputs pay to the uncompressed key directly, the P2SH
+	// wrapped variant is keyed by the compressed one
+	bareScript := p2pkScript(t, priv.PubKey().SerializeUncompressed())
+	redeemScript := p2pkScript(t, priv.PubKey().SerializeCompressed())
+	fundingTx := newFundingTx(ds, bareScript, p2shScript(t, redeemScript))
+	spendTx := newSpendingTx(fundingTx)
+	for i, script := range [][]byte{bareScript, redeemScript} {
+		z, err := txscript.CalcSignatureHash(script, txscript.SigHashAll, spendTx, i)
+		assert.NoError(t, err)
+		pushes := [][]byte{encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll)}
+		if i == 1 {
+			pushes = append(pushes, redeemScript)
+		}
+		spendTx.TxIn[i].SignatureScript = pushScript(t, pushes...)
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 2, extracted, "wrong number of SHPair extractions")
+	assert.Equal(t, sighash.TemplateP2PK, bucket.Pairs[0].Template, "wrong template recorded")
+
+	assertRecovered(t, bucket, priv)
+	ds.AssertExpectations(t)
+}
+
+func TestConcurrentAddTx(t *testing.T) {
+	ds := new(MockedDataSource)
+	keys := make([]*btcec.PrivateKey, 4)
+	txs := make([]*wire.MsgTx, 0)
+	for i := range keys {
+		keys[i], _ = btcec.NewPrivateKey(btcec.S256())
+		pkScript := p2wpkhScript(t, keys[i].PubKey())
+		fundingTx := newFundingTx(ds, pkScript, pkScript, pkScript)
+		fundingHash := fundingTx.TxHash()
+
+		// The last key never reuses its nonce
+		nonces := []*big.Int{testNonce, testNonce, big.NewInt(int64(i + 2))}
+		if i == len(keys)-1 {
+			nonces[0], nonces[1] = big.NewInt(0x72616e646f6d), big.NewInt(0x6f74686572)
+		}
+		for out, nonce := range nonces {
+			spendTx := wire.NewMsgTx(wire.TxVersion)
+			spendTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&fundingHash, uint32(out)), nil, nil))
+			spendTx.AddTxOut(wire.NewTxOut(50000, []byte{txscript.OP_TRUE}))
+			z, err := txscript.CalcWitnessSigHash(pkScript, txscript.NewTxSigHashes(spendTx),
+				txscript.SigHashAll, spendTx, 0, 100000)
+			assert.NoError(t, err)
+			spendTx.TxIn[0].Witness = wire.TxWitness{
+				encodeSig(signWithNonce(keys[i], z, nonce), txscript.SigHashAll),
+				keys[i].PubKey().SerializeCompressed(),
+			}
+			txs = append(txs, spendTx)
+		}
+	}
+
+	var lock sync.Mutex
+	reported := make(map[string]int)
+	bucket := sighash.NewSHPairBucket(ds)
+	bucket.OnRecovery = func(rec *sighash.Recovery) {
+		lock.Lock()
+		defer lock.Unlock()
+		reported[hex.EncodeToString(rec.Key.Serialize())]++
+	}
+
+	var wg sync.WaitGroup
+	for _, tx := range txs {
+		wg.Add(1)
+		go func(tx *wire.MsgTx) {
+			defer wg.Done()
+			_, errMap := bucket.AddTx(tx)
+			assert.Empty(t, errMap, "unexpected extraction errors")
+		}(tx)
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(txs), len(bucket.Pairs), "wrong number of SHPair extractions")
+	assert.True(t, bucket.HasTx(txs[0].TxHash()), "txn missing from the bucket")
+	assert.Equal(t, 1, len(bucket.PairsForTx(txs[0].TxHash())), "wrong number of SHPair for txn")
+	assert.Equal(t, len(txs), bucket.TemplateCounts[sighash.TemplateP2WPKH], "wrong template counts")
+	if assert.Equal(t, len(keys)-1, len(reported), "wrong number of reported recoveries") {
+		for _, priv := range keys[:len(keys)-1] {
+			assert.Equal(t, 1, reported[hex.EncodeToString(priv.Serialize())], "key not reported exactly once")
+		}
+	}
+
+	solutions, _ := bucket.Solve()
+	assert.Equal(t, len(keys)-1, len(solutions), "wrong number of PrivateKey solutions")
+	for _, rec := range solutions {
+		assert.Equal(t, sighash.RecoveryNonceReuse, rec.Method, "wrong recovery method")
+		assert.True(t, rec.Verified, "source signatures failed to verify")
+	}
+	ds.AssertExpectations(t)
+}
+
+func TestRecoverFromCollisions(t *testing.T) {
+	priv := testPrivKey()
+	first := ecdsaPair(priv, "first", testNonce)
+	duplicate := *first
+
+	// The same signature seen twice is dropped, and the second signature's
+	// negated S value does not keep the key from being recovered
+	second := ecdsaPair(priv, "second", testNonce)
+	second.S.Sub(btcec.S256().N, second.S)
+
+	bucket := sighash.NewSHPairBucket(nil)
+	bucket.Pairs = append(bucket.Pairs, first, &duplicate)
+	keys, _ := bucket.Solve()
+	assert.Empty(t, keys, "recovered a key from a duplicate signature")
+	assert.Equal(t, 1, len(bucket.Pairs), "duplicate signature was kept")
+	assert.Equal(t, 1, bucket.Duplicates, "wrong duplicate count")
+	assert.Empty(t, bucket.UnexploitableReuse, "duplicate of the same input reported as reuse")
+
+	bucket.Pairs = append(bucket.Pairs, second)
+	keys, _ = bucket.Solve()
+	if assert.Equal(t, 1, len(keys), "wrong number of PrivateKey solutions") {
+		assert.Equal(t, testPrivHex, hex.EncodeToString(keys[0].Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, 1, keys[0].Candidate, "wrong sign candidate")
+		assert.True(t, keys[0].Verified, "source signatures failed to verify")
+	}
+}
+
+func TestStrictBucket(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	pkScript := p2wpkhScript(t, priv.PubKey())
+	fundingTx := newFundingTx(ds, pkScript, pkScript)
+	spendTx := newSpendingTx(fundingTx)
+
+	// The second input is signed over the wrong sighash
+	sigHashes := txscript.NewTxSigHashes(spendTx)
+	for i := range spendTx.TxIn {
+		z, err := txscript.CalcWitnessSigHash(pkScript, sigHashes, txscript.SigHashAll, spendTx, i, 100000)
+		assert.NoError(t, err)
+		if i == 1 {
+			z = chainhash.DoubleHashB(z)
+		}
+		spendTx.TxIn[i].Witness = wire.TxWitness{
+			encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll),
+			priv.PubKey().SerializeCompressed(),
+		}
+	}
+
+	lenient := sighash.NewSHPairBucket(ds)
+	extracted, errMap := lenient.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 2, extracted, "wrong number of SHPair extractions")
+	assert.Empty(t, lenient.VerifyCounts, "verified outside of strict mode")
+
+	strict := sighash.NewSHPairBucket(ds)
+	strict.Strict = true
+	extracted, errMap = strict.AddTx(spendTx)
+	assert.Equal(t, 1, extracted, "wrong number of SHPair extractions")
+	if assert.Equal(t, 1, len(errMap), "wrong number of extraction errors") {
+		warn, ok := errMap[1].(*sighash.WarnVerifySkip)
+		if assert.True(t, ok, "expected a verification warning") {
+			assert.Equal(t, sighash.VerifyMismatch, warn.Result, "wrong rejection reason")
+		}
+	}
+	assert.Equal(t, 1, strict.VerifyCounts[sighash.VerifyOK], "wrong verified count")
+	assert.Equal(t, 1, strict.VerifyCounts[sighash.VerifyMismatch], "wrong mismatch count")
+	ds.AssertExpectations(t)
+}
+
+func TestDuplicateSignatures(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	pkScript := p2wpkhScript(t, priv.PubKey())
+	fundingTx := newFundingTx(ds, pkScript)
+	spendTx := newSpendingTx(fundingTx)
+	z, err := txscript.CalcWitnessSigHash(pkScript, txscript.NewTxSigHashes(spendTx),
+		txscript.SigHashAll, spendTx, 0, 100000)
+	assert.NoError(t, err)
+
+	// The same txn seen in the mempool, then in a block, then malleated
+	sig := signWithNonce(priv, z, testNonce)
+	malleated := *spendTx.Copy()
+	for _, s := range []*big.Int{sig.S, new(big.Int).Sub(btcec.S256().N, sig.S)} {
+		tx := spendTx
+		if s != sig.S {
+			tx = &malleated
+		}
+		tx.TxIn[0].Witness = wire.TxWitness{
+			encodeSig(&btcec.Signature{R: sig.R, S: s}, txscript.SigHashAll),
+			priv.PubKey().SerializeCompressed(),
+		}
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	for _, tx := range []*wire.MsgTx{spendTx, spendTx, &malleated} {
+		_, errMap := bucket.AddTx(tx)
+		assert.Empty(t, errMap, "unexpected extraction errors")
+	}
+	assert.Equal(t, 1, len(bucket.Pairs), "duplicate signatures were kept")
+	assert.Equal(t, 2, bucket.Duplicates, "wrong duplicate count")
+	assert.True(t, bucket.Pairs[0].S.Cmp(new(big.Int).Rsh(btcec.S256().N, 1)) <= 0, "S was not canonicalized")
+
+	// Signing the same message again from another input reuses the nonce,
+	// but reveals nothing
+	nonce := big.NewInt(0x616761696e)
+	again := ecdsaPair(priv, "message", nonce)
+	again.TxID = chainhash.HashH([]byte("other"))
+	bucket.Pairs = append(bucket.Pairs, ecdsaPair(priv, "message", nonce), again)
+	keys, _ := bucket.Solve()
+	assert.Empty(t, keys, "recovered a key from the same message")
+	if assert.Equal(t, 1, len(bucket.UnexploitableReuse), "wrong number of unexploitable reuses") {
+		assert.Equal(t, again, bucket.UnexploitableReuse[0].Dropped)
+	}
+	_, err = bucket.UnexploitableReuse[0].Kept.RecoverPrivateKey(again)
+	assert.Equal(t, sighash.WarnSameMessage, err, "expected the same message warning")
+	ds.AssertExpectations(t)
+}
+
+func TestBucketWindow(t *testing.T) {
+	priv := testPrivKey()
+	first := ecdsaPair(priv, "first", testNonce)
+	others := make([]*sighash.SHPair, 3)
+	for i := range others {
+		others[i] = ecdsaPair(priv, fmt.Sprintf("other %d", i), big.NewInt(int64(i+1)))
+	}
+	second := ecdsaPair(priv, "second", testNonce)
+
+	// The reused nonce is only caught while the first signature is in the
+	// window, new signatures being checked before the window is trimmed
+	for _, size := range []int{3, 4} {
+		bucket := sighash.NewSHPairBucket(nil)
+		bucket.Window = sighash.Window{MaxPairs: size}
+		for _, pair := range append(append([]*sighash.SHPair{first}, others...), second) {
+			bucket.Pairs = append(bucket.Pairs, pair)
+			bucket.Evict()
+		}
+		keys, _ := bucket.Solve()
+		if size == 3 {
+			assert.Empty(t, keys, "recovered a key from an evicted signature")
+		} else {
+			assert.Equal(t, 1, len(keys), "wrong number of PrivateKey solutions")
+		}
+		assert.Equal(t, 5-size, bucket.Evicted, "wrong eviction count")
+		assert.Equal(t, size, bucket.Len(), "wrong number of SHPair in the window")
+	}
+
+	now := time.Unix(1600000000, 0)
+	bucket := sighash.NewSHPairBucket(nil)
+	bucket.Window = sighash.Window{MaxAge: 20 * time.Millisecond, Now: func() time.Time { return now }}
+	bucket.Pairs = append(bucket.Pairs, first)
+	assert.Equal(t, 0, bucket.Evict(), "evicted a recent signature")
+	now = now.Add(30 * time.Millisecond)
+	bucket.Pairs = append(bucket.Pairs, second)
+	assert.Equal(t, 1, bucket.Evict(), "kept an old signature")
+	keys, _ := bucket.Solve()
+	assert.Empty(t, keys, "recovered a key from an evicted signature")
+
+	// Duplicates and recoveries go along with the pairs they reference, and
+	// the key is looked for again once they are gone
+	bucket = sighash.NewSHPairBucket(nil)
+	bucket.Window = sighash.Window{MaxPairs: 3}
+	dup := *first
+	dup.InputIndex = 1
+	for _, pair := range []*sighash.SHPair{first, &dup, second} {
+		bucket.Pairs = append(bucket.Pairs, pair)
+		bucket.Evict()
+	}
+	assert.Equal(t, 1, len(bucket.UnexploitableReuse), "missed the duplicate")
+	keys, _ = bucket.Solve()
+	assert.Equal(t, 1, len(keys), "wrong number of PrivateKey solutions")
+	for _, pair := range others[:2] {
+		bucket.Pairs = append(bucket.Pairs, pair)
+		bucket.Evict()
+	}
+	assert.Empty(t, bucket.UnexploitableReuse, "kept the duplicate of an evicted signature")
+	keys, _ = bucket.Solve()
+	assert.Equal(t, 1, len(keys), "dropped a key while one of its signatures is left")
+	bucket.Pairs = append(bucket.Pairs, others[2])
+	bucket.Evict()
+	keys, _ = bucket.Solve()
+	assert.Empty(t, keys, "kept the key recovered from evicted signatures")
+	for _, msg := range []string{"third", "fourth"} {
+		bucket.Pairs = append(bucket.Pairs, ecdsaPair(priv, msg, testNonce))
+		bucket.Evict()
+	}
+	keys, _ = bucket.Solve()
+	assert.Equal(t, 1, len(keys), "did not recover the key again")
+}
+
+func TestNoncePropagation(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	second, _ := btcec.NewPrivateKey(btcec.S256())
+	third, _ := btcec.NewPrivateKey(btcec.S256())
+	fourth, _ := btcec.NewPrivateKey(btcec.S256())
+	otherNonce := big.NewInt(0x6f74686572)
+
+	// priv reuses testNonce, which second also used once. second in turn
+	// shares otherNonce with third, which never reused a nonce on its own,
+	// and with fourth in a Taproot key path spend.
+	signers := []struct {
+		key   *btcec.PrivateKey
+		nonce *big.Int
+	}{
+		{priv, testNonce}, {priv, testNonce}, {second, testNonce},
+		{second, otherNonce}, {third, otherNonce},
+	}
+	pkScripts := make([][]byte, len(signers))
+	for i, signer := range signers {
+		pkScripts[i] = p2wpkhScript(t, signer.key.PubKey())
+	}
+	fundingTx := newFundingTx(ds, append(pkScripts, p2trScript(xOnly(fourth.PubKey())))...)
+	spendTx := newSpendingTx(fundingTx)
+	tapSigHashes := sighash.NewTaprootSigHashes(spendTx, fundingTx.TxOut)
+	z, err := sighash.CalcTaprootSigHash(tapSigHashes, sighash.SigHashDefault, spendTx, len(signers), nil)
+	assert.NoError(t, err)
+	spendTx.TxIn[len(signers)].Witness = wire.TxWitness{
+		signSchnorrWithNonce(fourth, z, otherNonce, sighash.SigHashDefault),
+	}
+
+	sigHashes := txscript.NewTxSigHashes(spendTx)
+	for i, signer := range signers {
+		z, err := txscript.CalcWitnessSigHash(pkScripts[i], sigHashes, txscript.SigHashAll, spendTx, i, 100000)
+		assert.NoError(t, err)
+		spendTx.TxIn[i].Witness = wire.TxWitness{
+			encodeSig(signWithNonce(signer.key, z, signer.nonce), txscript.SigHashAll),
+			signer.key.PubKey().SerializeCompressed(),
+		}
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	_, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+
+	keys, nonces := bucket.Solve()
+	if assert.Equal(t, 4, len(keys), "wrong number of PrivateKey solutions") {
+		for i, expected := range []*btcec.PrivateKey{priv, second, third, fourth} {
+			assert.Equal(t, hex.EncodeToString(xOnly(expected.PubKey())),
+				hex.EncodeToString(xOnly(keys[i].Key.PubKey())), "derived incorrect privateKey")
+			assert.True(t, keys[i].Verified, "source signatures failed to verify")
+		}
+		assert.Equal(t, sighash.RecoveryNonceReuse, keys[0].Method, "wrong recovery method")
+		assert.Equal(t, sighash.RecoveryPropagation, keys[1].Method, "wrong recovery method")
+	}
+	if assert.Equal(t, 2, len(nonces), "wrong number of nonce solutions") {
+		n := btcec.S256().N
+		for i, expected := range []*big.Int{testNonce, otherNonce} {
+			k := nonces[i].K
+			assert.True(t, k.Cmp(expected) == 0 || new(big.Int).Sub(n, k).Cmp(expected) == 0,
+				"derived incorrect nonce")
+		}
+	}
+	ds.AssertExpectations(t)
+}
@@ -100,19 +100,20 @@ func TestNewAPI(t *testing.T) {
 			assert.Equal(t, "c0e2d0a89a348de88fda08211c70d1d7e52ccef2eb9459911bf977d587784c6e",
 				hex.EncodeToString(entry.Z), "failed to extract z on input 0")
 		case 1:
-			assert.Equal(t, "9a5f1c75e461d7ceb1cf3cab9013eb2dc85b6d0da8c3c6e27e3a5a5b3faa5bab",
+			// Canonicalized from the high S 9a5f1c75...3faa5bab in the txn
+			assert.Equal(t, "65a0e38a1b9e28314e30c3546fec14d0f2536fd90684d95941980431908be596",
 				hex.EncodeToString(entry.S.Bytes()), "failed to extract r on input 1")
 			assert.Equal(t, "17b0f41c8c337ac1e18c98759e83a8cccbc368dd9d89e5f03cb633c265fd0ddc",
 				hex.EncodeToString(entry.Z), "failed to extract z on input 1")
 		}
 	}
 
-	solutionSet := solveBucket.Solve()
+	solutionSet, _ := solveBucket.Solve()
 	assert.Equal(t, 1, len(solutionSet),
 		"wrong number of PrivateKey solutions in a nonce reuse scenario")
 	assert.NotNil(t, solutionSet[0], "derived privateKey is nil despite no errors")
 	assert.Equal(t, "c477f9f65c22cce20657faa5b2d1d8122336f851a508a1ed04e479c34985bf96",
-		hex.EncodeToString(solutionSet[0].Serialize()), "derived incorrect privateKey")
+		hex.EncodeToString(solutionSet[0].Key.Serialize()), "derived incorrect privateKey")
 
 	ds.AssertExpectations(t)
 }
@@ -131,7 +132,7 @@ func TestNotBreakable(t *testing.T) {
 	extractedCount, _ := solveBucket.AddRawTx(tx)
 	assert.Equal(t, 3, extractedCount, "wrong number of SHPair extractions")
 
-	solutions := solveBucket.Solve()
+	solutions, _ := solveBucket.Solve()
 	assert.Equal(t, 0, len(solutions), "wrong number of SHPair solutions")
 }
 
@@ -149,7 +150,7 @@ func TestIssueTxn1(t *testing.T) {
 	extractedCount, _ := solveBucket.AddRawTx(tx)
 	assert.Equal(t, 0, extractedCount, "wrong number of SHPair extractions")
 
-	solutions := solveBucket.Solve()
+	solutions, _ := solveBucket.Solve()
 	assert.Equal(t, 0, len(solutions), "wrong number of SHPair solutions")
 }
 
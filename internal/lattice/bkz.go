@@ -0,0 +1,188 @@
+package lattice
+
+import (
+	"math"
+	"math/big"
+)
+
+// BKZ reduces the rows of basis in place with the block Korkine-Zolotarev
+// algorithm. Each tour finds the shortest vector of every projected block of
+// blockSize vectors by enumeration, and inserts it when it improves on the
+// first vector of the block. Tours are repeated until one changes nothing or
+// maxTours is reached. A blockSize of 2 or less amounts to LLL.
+func BKZ(basis [][]*big.Int, blockSize int, delta *big.Rat, maxTours int) error {
+	gs, err := reduce(basis, delta)
+	if err != nil || blockSize <= 2 {
+		return err
+	}
+	n := len(basis)
+	deltaF, _ := delta.Float64()
+
+	for tour := 0; tour < maxTours; tour++ {
+		changed := false
+		for k := 0; k < n-1; k++ {
+			end := k + blockSize
+			if end > n {
+				end = n
+			}
+
+			mu, b := blockGramSchmidt(gs, k, end)
+			coeffs := enumerate(mu, b, deltaF*b[0])
+			if coeffs == nil || !insert(basis, k, coeffs) {
+				continue
+			}
+			if gs, err = reduce(basis, delta); err != nil {
+				return err
+			}
+			changed = true
+		}
+		if !changed {
+			break
+		}
+	}
+	return nil
+}
+
+// blockGramSchmidt returns the Gram-Schmidt data of the block [lo, hi), with
+// the squared norms scaled by the one of the first vector of the block.
+func blockGramSchmidt(gs *gramSchmidt, lo, hi int) ([][]float64, []float64) {
+	size := hi - lo
+	mu := make([][]float64, size)
+	b := make([]float64, size)
+	for i := 0; i < size; i++ {
+		b[i] = gs.b[lo+i] / gs.b[lo]
+		mu[i] = append([]float64(nil), gs.mu[lo+i][lo:lo+i]...)
+	}
+	return mu, b
+}
+
+// enumerate finds the integer combination of the block minimising the
+// squared norm of its projection, if any is below radius, with Schnorr-Euchner
+// zig-zag enumeration.
+func enumerate(mu [][]float64, b []float64, radius float64) []int64 {
+	size := len(b)
+	x := make([]int64, size)
+	var best []int64
+
+	var search func(i int, partial float64)
+	search = func(i int, partial float64) {
+		center := 0.0
+		for j := i + 1; j < size; j++ {
+			center -= float64(x[j]) * mu[j][i]
+		}
+		rounded := math.Round(center)
+
+		// The distance to the center grows with the offset on either side
+		// of the nearest integer, so each side stops at the first candidate
+		// outside the radius
+		up, down := true, true
+		for offset := 0.0; up || down; offset++ {
+			for _, candidate := range []float64{rounded + offset, rounded - offset} {
+				isUp := candidate >= rounded
+				if (isUp && !up) || (!isUp && !down) {
+					continue
+				}
+				diff := candidate - center
+				length := partial + diff*diff*b[i]
+				if length >= radius {
+					if isUp {
+						up = false
+					} else {
+						down = false
+					}
+					continue
+				}
+
+				x[i] = int64(candidate)
+				if i > 0 {
+					search(i-1, length)
+				} else if !isZero(x) {
+					radius = length
+					best = append(best[:0], x...)
+				}
+				if offset == 0 {
+					break
+				}
+			}
+			if offset == 0 {
+				// The nearest integer is on both sides
+				if !up {
+					down = false
+				}
+			}
+		}
+		x[i] = 0
+	}
+	search(size-1, 0)
+	return best
+}
+
+// insert makes sum(coeffs[i] * basis[lo+i]) the basis vector at lo, keeping
+// the rest of the block a basis of the same lattice. The combination is
+// turned into a single vector by Euclid steps on pairs of coefficients,
+// each of which is a unimodular transformation of the block.
+func insert(basis [][]*big.Int, lo int, coeffs []int64) bool {
+	x := append([]int64(nil), coeffs...)
+	tmp := new(big.Int)
+	for {
+		// The nonzero coefficient of smallest magnitude
+		pivot := -1
+		for i, c := range x {
+			if c != 0 && (pivot < 0 || abs64(c) < abs64(x[pivot])) {
+				pivot = i
+			}
+		}
+		if pivot < 0 {
+			return false
+		}
+
+		done := true
+		for i, c := range x {
+			if i == pivot || c == 0 {
+				continue
+			}
+			// c*b_i + x_p*b_p = (c - q*x_p)*b_i + x_p*(b_p + q*b_i)
+			q := c / x[pivot]
+			x[i] -= q * x[pivot]
+			for j := range basis[lo+pivot] {
+				basis[lo+pivot][j].Add(basis[lo+pivot][j], tmp.Mul(big.NewInt(q), basis[lo+i][j]))
+			}
+			if x[i] != 0 {
+				done = false
+			}
+		}
+		if !done {
+			continue
+		}
+
+		// A shortest vector is primitive, so its last coefficient is +-1
+		if abs64(x[pivot]) != 1 {
+			return false
+		}
+		if x[pivot] < 0 {
+			for _, v := range basis[lo+pivot] {
+				v.Neg(v)
+			}
+		}
+		inserted := basis[lo+pivot]
+		copy(basis[lo+1:lo+pivot+1], basis[lo:lo+pivot])
+		basis[lo] = inserted
+		return true
+	}
+}
+
+func isZero(x []int64) bool {
+	for _, c := range x {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func abs64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
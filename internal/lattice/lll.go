@@ -0,0 +1,182 @@
+// Package lattice implements lattice basis reduction for integral bases.
+package lattice
+
+import (
+	"errors"
+	"math"
+	"math/big"
+)
+
+var (
+	ErrDependent = errors.New("lattice basis vectors are linearly dependent")
+	ErrDelta     = errors.New("LLL delta needs to be in (1/4, 1)")
+)
+
+// DefaultDelta is the customary Lovasz constant.
+var DefaultDelta = big.NewRat(99, 100)
+
+// gramSchmidt holds the exact Gram matrix of a basis along with its
+// Gram-Schmidt orthogonalization in floating point, b[i] being the squared
+// norm of the i-th orthogonalized vector and mu[i][j] the coefficient of basis
+// vector i along the j-th orthogonalized vector. Symmetric entries of gram are
+// the same value, so that updating a row updates the column as well.
+type gramSchmidt struct {
+	gram [][]*big.Int
+	mu   [][]float64
+	b    []float64
+}
+
+func newGramSchmidt(basis [][]*big.Int) *gramSchmidt {
+	n := len(basis)
+	gs := &gramSchmidt{
+		gram: make([][]*big.Int, n),
+		mu:   make([][]float64, n),
+		b:    make([]float64, n),
+	}
+	for i := range basis {
+		gs.gram[i] = make([]*big.Int, n)
+		gs.mu[i] = make([]float64, i)
+		for j := 0; j <= i; j++ {
+			gs.gram[i][j] = dot(basis[i], basis[j])
+			gs.gram[j][i] = gs.gram[i][j]
+		}
+	}
+	return gs
+}
+
+// update recomputes row k from the Gram matrix, the rows before it being
+// current.
+func (gs *gramSchmidt) update(k int) {
+	// r[j] = <b_k, b_j> - sum(mu[j][i] * r[i]) for i < j, mu[k][j] = r[j] / b[j]
+	r := make([]float64, k+1)
+	for j := 0; j <= k; j++ {
+		r[j] = toFloat(gs.gram[k][j])
+		for i := 0; i < j; i++ {
+			r[j] -= gs.mu[j][i] * r[i]
+		}
+		if j < k {
+			gs.mu[k][j] = r[j] / gs.b[j]
+		}
+	}
+	gs.b[k] = r[k]
+}
+
+// subtract applies b_k -= q*b_j to the Gram matrix.
+func (gs *gramSchmidt) subtract(k, j int, q *big.Int) {
+	// <b_k - q*b_j, b_k - q*b_j> = <b_k, b_k> - 2q<b_k, b_j> + q^2<b_j, b_j>
+	tmp := new(big.Int).Mul(q, gs.gram[k][j])
+	gs.gram[k][k].Sub(gs.gram[k][k], tmp.Lsh(tmp, 1))
+	tmp.Mul(q, q)
+	gs.gram[k][k].Add(gs.gram[k][k], tmp.Mul(tmp, gs.gram[j][j]))
+	for i := range gs.gram {
+		if i != k {
+			gs.gram[k][i].Sub(gs.gram[k][i], tmp.Mul(q, gs.gram[j][i]))
+		}
+	}
+}
+
+// swap exchanges vectors k-1 and k in the Gram matrix.
+func (gs *gramSchmidt) swap(k int) {
+	gs.gram[k], gs.gram[k-1] = gs.gram[k-1], gs.gram[k]
+	for _, row := range gs.gram {
+		row[k], row[k-1] = row[k-1], row[k]
+	}
+}
+
+// LLL reduces the rows of basis in place. The basis and its Gram matrix are
+// kept in exact integers while the Gram-Schmidt data is kept in floating
+// point, as in the Schnorr-Euchner variant of LLL.
+func LLL(basis [][]*big.Int, delta *big.Rat) error {
+	_, err := reduce(basis, delta)
+	return err
+}
+
+func reduce(basis [][]*big.Int, delta *big.Rat) (*gramSchmidt, error) {
+	if delta.Cmp(big.NewRat(1, 4)) <= 0 || delta.Cmp(big.NewRat(1, 1)) >= 0 {
+		return nil, ErrDelta
+	}
+	deltaF, _ := delta.Float64()
+	n := len(basis)
+	gs := newGramSchmidt(basis)
+	if n == 0 {
+		return gs, nil
+	}
+
+	if gs.gram[0][0].Sign() == 0 {
+		return nil, ErrDependent
+	}
+	gs.update(0)
+	for k := 1; k < n; {
+		gs.update(k)
+		gs.sizeReduce(basis, k)
+
+		// Dependent vectors are size reduced down to zero, while a rounding
+		// error on b[k] only ends up in a swap
+		if gs.gram[k][k].Sign() == 0 {
+			return nil, ErrDependent
+		}
+
+		// Lovasz condition, b[k] >= (delta - mu[k][k-1]^2) * b[k-1]
+		mu := gs.mu[k][k-1]
+		if gs.b[k] < (deltaF-mu*mu)*gs.b[k-1] {
+			basis[k], basis[k-1] = basis[k-1], basis[k]
+			gs.swap(k)
+			if k > 1 {
+				k--
+			} else {
+				gs.update(0)
+			}
+			continue
+		}
+		k++
+	}
+	return gs, nil
+}
+
+// sizeReduce makes |mu[k][j]| <= 1/2 for all j < k, subtracting multiples of
+// the preceding vectors from vector k. It is repeated while it changes
+// anything, as a coefficient too large for the precision is only partially
+// reduced at a time.
+func (gs *gramSchmidt) sizeReduce(basis [][]*big.Int, k int) {
+	for changed := true; changed; {
+		changed = false
+		for j := k - 1; j >= 0; j-- {
+			if math.Abs(gs.mu[k][j]) <= 0.51 {
+				continue
+			}
+			rounded := math.Round(gs.mu[k][j])
+			q, _ := big.NewFloat(rounded).Int(nil)
+			tmp := new(big.Int)
+			for i := range basis[k] {
+				basis[k][i].Sub(basis[k][i], tmp.Mul(q, basis[j][i]))
+			}
+			gs.subtract(k, j, q)
+			gs.mu[k][j] -= rounded
+			for i := 0; i < j; i++ {
+				gs.mu[k][i] -= rounded * gs.mu[j][i]
+			}
+			changed = true
+		}
+		if changed {
+			gs.update(k)
+		}
+	}
+}
+
+func toFloat(x *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(x).Float64()
+	return f
+}
+
+func dot(a, b []*big.Int) *big.Int {
+	sum, tmp := new(big.Int), new(big.Int)
+	for i := range a {
+		sum.Add(sum, tmp.Mul(a[i], b[i]))
+	}
+	return sum
+}
+
+// Norm2 returns the squared euclidean norm of a vector.
+func Norm2(v []*big.Int) *big.Int {
+	return dot(v, v)
+}
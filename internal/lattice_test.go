@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"encoding/hex"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/canselcik/nonced/internal/lattice"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLLL(t *testing.T) {
+	// A textbook basis whose reduction is known
+	rows := [][]int64{{1, 1, 1}, {-1, 0, 2}, {3, 5, 6}}
+	basis := make([][]*big.Int, len(rows))
+	for i, row := range rows {
+		for _, v := range row {
+			basis[i] = append(basis[i], big.NewInt(v))
+		}
+	}
+	assert.NoError(t, lattice.LLL(basis, big.NewRat(3, 4)))
+	for i, expected := range [][]int64{{0, 1, 0}, {1, 0, 1}, {-1, 0, 2}} {
+		for j, v := range expected {
+			assert.Equal(t, v, basis[i][j].Int64(), "wrong reduced basis")
+		}
+	}
+
+	dependent := [][]*big.Int{
+		{big.NewInt(1), big.NewInt(2)}, {big.NewInt(2), big.NewInt(4)},
+	}
+	assert.Equal(t, lattice.ErrDependent, lattice.LLL(dependent, lattice.DefaultDelta))
+}
+
+func TestHiddenNumberProblem(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	priv := testPrivKey()
+
+	models := []sighash.BiasModel{
+		{Kind: sighash.BiasMSBZero, Bits: 32},
+		{Kind: sighash.BiasLSBKnown, Bits: 32},
+		{Kind: sighash.BiasKnownPrefix, Bits: 32},
+	}
+	for _, model := range models {
+		pairs, known, err := sighash.SyntheticBiasedPairs(priv, 12, model, rng)
+		assert.NoError(t, err)
+
+		bucket := sighash.NewSHPairBucket(nil)
+		bucket.Pairs = append(bucket.Pairs, pairs...)
+		recovered, err := sighash.SolveHNP(bucket.PairsForKey(priv.PubKey().SerializeCompressed()),
+			known, sighash.HNPOptions{})
+		if assert.NoError(t, err, "failed to solve for %s bias", model.Kind) {
+			assert.Equal(t, testPrivHex, hex.EncodeToString(recovered.Serialize()), "derived incorrect privateKey")
+		}
+
+		// Too few signatures to leak the key
+		known.Known = known.Known[:6]
+		_, err = sighash.SolveHNP(pairs[:6], known, sighash.HNPOptions{})
+		assert.Equal(t, sighash.ErrNoResult, err, "solved an underdetermined lattice")
+	}
+}
+
+func TestSyntheticHNP(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	model := sighash.BiasModel{Kind: sighash.BiasMSBZero, Bits: 48}
+	results, err := sighash.RunSyntheticHNP(model, []int{4, 8}, 2,
+		sighash.HNPOptions{BlockSize: 4, MaxTours: 2}, rng)
+	if assert.NoError(t, err) && assert.Equal(t, 2, len(results)) {
+		assert.Equal(t, 0, results[0].Successes, "recovered below the threshold")
+		assert.Equal(t, 2, results[1].Successes, "failed above the threshold")
+	}
+
+	// Models knowing none or all of the bits are rejected
+	priv := testPrivKey()
+	for _, bits := range []int{-1, 0, 256, 300} {
+		model.Bits = bits
+		_, _, err = sighash.SyntheticBiasedPairs(priv, 4, model, rng)
+		assert.Equal(t, sighash.ErrBiasModel, err, "accepted %d known bits", bits)
+		_, err = sighash.RunSyntheticHNP(model, []int{4}, 1, sighash.HNPOptions{}, rng)
+		assert.Equal(t, sighash.ErrBiasModel, err, "accepted %d known bits", bits)
+	}
+}
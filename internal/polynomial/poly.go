@@ -0,0 +1,219 @@
+// Package polynomial implements univariate polynomial arithmetic over a prime
+// field, along with finding the roots of polynomials in it.
+package polynomial
+
+import (
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrZeroPolynomial = errors.New("polynomial is identically zero")
+	ErrDivisionByZero = errors.New("polynomial division by zero")
+)
+
+// Poly holds the coefficients of a polynomial, constant term first. The
+// coefficients are reduced and there are no trailing zeros once normalized.
+type Poly []*big.Int
+
+// Field is the integers modulo the prime P.
+type Field struct {
+	P *big.Int
+}
+
+// Degree is the degree of the polynomial, -1 for the zero polynomial.
+func (f Poly) Degree() int {
+	for i := len(f) - 1; i >= 0; i-- {
+		if f[i].Sign() != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsZero tells whether f is the zero polynomial.
+func (f Poly) IsZero() bool {
+	return f.Degree() < 0
+}
+
+// New makes a polynomial out of coefficients, constant term first.
+func (field Field) New(coeffs ...*big.Int) Poly {
+	f := make(Poly, len(coeffs))
+	for i, c := range coeffs {
+		f[i] = new(big.Int).Mod(c, field.P)
+	}
+	return f.trim()
+}
+
+func (f Poly) trim() Poly {
+	return f[:f.Degree()+1]
+}
+
+func (field Field) zero(length int) Poly {
+	f := make(Poly, length)
+	for i := range f {
+		f[i] = new(big.Int)
+	}
+	return f
+}
+
+func (field Field) Add(f, g Poly) Poly {
+	if len(f) < len(g) {
+		f, g = g, f
+	}
+	sum := field.zero(len(f))
+	for i := range f {
+		sum[i].Set(f[i])
+		if i < len(g) {
+			sum[i].Add(sum[i], g[i]).Mod(sum[i], field.P)
+		}
+	}
+	return sum.trim()
+}
+
+func (field Field) Sub(f, g Poly) Poly {
+	return field.Add(f, field.Scale(g, big.NewInt(-1)))
+}
+
+// Scale multiplies f by the constant c.
+func (field Field) Scale(f Poly, c *big.Int) Poly {
+	scaled := field.zero(len(f))
+	for i := range f {
+		scaled[i].Mul(f[i], c).Mod(scaled[i], field.P)
+	}
+	return scaled.trim()
+}
+
+func (field Field) Mul(f, g Poly) Poly {
+	if f.IsZero() || g.IsZero() {
+		return Poly{}
+	}
+	product := field.zero(len(f) + len(g) - 1)
+	tmp := new(big.Int)
+	for i := range f {
+		for j := range g {
+			product[i+j].Add(product[i+j], tmp.Mul(f[i], g[j]))
+		}
+	}
+	for _, c := range product {
+		c.Mod(c, field.P)
+	}
+	return product.trim()
+}
+
+// DivMod returns the quotient and remainder of the division of f by g.
+func (field Field) DivMod(f, g Poly) (Poly, Poly, error) {
+	g = g.trim()
+	if g.IsZero() {
+		return nil, nil, ErrDivisionByZero
+	}
+	rem := field.Add(f, nil)
+	if len(rem) < len(g) {
+		return Poly{}, rem, nil
+	}
+	quo := field.zero(len(rem) - len(g) + 1)
+	leadInv := new(big.Int).ModInverse(g[len(g)-1], field.P)
+	tmp := new(big.Int)
+	for i := len(rem) - 1; i >= len(g)-1; i-- {
+		if rem[i].Sign() == 0 {
+			continue
+		}
+		q := new(big.Int).Mul(rem[i], leadInv)
+		q.Mod(q, field.P)
+		shift := i - (len(g) - 1)
+		quo[shift] = q
+		for j := range g {
+			rem[shift+j].Sub(rem[shift+j], tmp.Mul(q, g[j])).Mod(rem[shift+j], field.P)
+		}
+	}
+	return quo.trim(), rem.trim(), nil
+}
+
+// Monic scales f to a leading coefficient of one.
+func (field Field) Monic(f Poly) Poly {
+	f = f.trim()
+	if f.IsZero() {
+		return f
+	}
+	return field.Scale(f, new(big.Int).ModInverse(f[len(f)-1], field.P))
+}
+
+// GCD returns the monic greatest common divisor of f and g.
+func (field Field) GCD(f, g Poly) Poly {
+	f, g = f.trim(), g.trim()
+	for !g.IsZero() {
+		_, rem, _ := field.DivMod(f, g)
+		f, g = g, rem
+	}
+	return field.Monic(f)
+}
+
+// PowMod returns f^e modulo m.
+func (field Field) PowMod(f Poly, e *big.Int, m Poly) (Poly, error) {
+	_, base, err := field.DivMod(f, m)
+	if err != nil {
+		return nil, err
+	}
+	result := field.New(big.NewInt(1))
+	for i := e.BitLen() - 1; i >= 0; i-- {
+		_, result, _ = field.DivMod(field.Mul(result, result), m)
+		if e.Bit(i) == 1 {
+			_, result, _ = field.DivMod(field.Mul(result, base), m)
+		}
+	}
+	return result, nil
+}
+
+// Eval evaluates f at x.
+func (field Field) Eval(f Poly, x *big.Int) *big.Int {
+	result := new(big.Int)
+	for i := len(f) - 1; i >= 0; i-- {
+		result.Mul(result, x).Add(result, f[i]).Mod(result, field.P)
+	}
+	return result
+}
+
+// Roots returns the distinct roots of f in the field. The product of the
+// linear factors of f is gcd(f, x^P - x), which is then split by
+// Cantor-Zassenhaus: for any a, half of the roots r have r + a as a quadratic
+// residue, and so as roots of (x + a)^((P-1)/2) - 1.
+func (field Field) Roots(f Poly) ([]*big.Int, error) {
+	f = f.trim()
+	if f.IsZero() {
+		return nil, ErrZeroPolynomial
+	}
+	x := field.New(new(big.Int), big.NewInt(1))
+	xP, err := field.PowMod(x, field.P, f)
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]*big.Int, 0)
+	field.split(field.GCD(f, field.Sub(xP, x)), big.NewInt(0), &roots)
+	return roots, nil
+}
+
+func (field Field) split(g Poly, a *big.Int, roots *[]*big.Int) {
+	switch g.Degree() {
+	case -1, 0:
+		return
+	case 1:
+		// g is monic, x + g0
+		root := new(big.Int).Neg(g[0])
+		*roots = append(*roots, root.Mod(root, field.P))
+		return
+	}
+
+	half := new(big.Int).Rsh(field.P, 1)
+	one := field.New(big.NewInt(1))
+	for {
+		a.Add(a, big.NewInt(1))
+		h, _ := field.PowMod(field.New(a, big.NewInt(1)), half, g)
+		factor := field.GCD(g, field.Sub(h, one))
+		if degree := factor.Degree(); degree > 0 && degree < g.Degree() {
+			rest, _, _ := field.DivMod(g, factor)
+			field.split(factor, a, roots)
+			field.split(field.Monic(rest), a, roots)
+			return
+		}
+	}
+}
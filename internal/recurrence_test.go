@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/canselcik/nonced/internal/polynomial"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolynomialRoots(t *testing.T) {
+	field := polynomial.Field{P: btcec.S256().N}
+
+	// (x - 3)(x - 5)(x + 7)(x^2 - a), the last factor having no roots for
+	// an a that is not a square modulo the order
+	f := field.New(big.NewInt(1))
+	for _, root := range []int64{3, 5, -7} {
+		f = field.Mul(f, field.New(big.NewInt(-root), big.NewInt(1)))
+	}
+	a := big.NewInt(2)
+	for big.Jacobi(a, field.P) != -1 {
+		a.Add(a, big.NewInt(1))
+	}
+	f = field.Mul(f, field.New(new(big.Int).Neg(a), big.NewInt(0), big.NewInt(1)))
+
+	roots, err := field.Roots(f)
+	if assert.NoError(t, err) && assert.Equal(t, 3, len(roots), "wrong number of roots") {
+		for _, root := range roots {
+			assert.Equal(t, 0, field.Eval(f, root).Sign(), "not a root")
+		}
+	}
+	_, err = field.Roots(polynomial.Poly{})
+	assert.Equal(t, polynomial.ErrZeroPolynomial, err)
+}
+
+// recurrencePairs signs count messages with nonces following k_(i+1) =
+// f(k_i), low-S normalizing every other signature.
+func recurrencePairs(priv *btcec.PrivateKey, count int, f polynomial.Poly) []*sighash.SHPair {
+	n := btcec.S256().N
+	field := polynomial.Field{P: n}
+	pairs := make([]*sighash.SHPair, count)
+	k := new(big.Int).Set(testNonce)
+	for i := range pairs {
+		pairs[i] = ecdsaPair(priv, fmt.Sprintf("message %d", i), k)
+		if i%2 == 1 {
+			pairs[i].S.Sub(n, pairs[i].S)
+		}
+		k = field.Eval(f, k)
+	}
+	return pairs
+}
+
+func TestNonceRecurrence(t *testing.T) {
+	lcgKey := testPrivKey()
+	quadKey, _ := btcec.NewPrivateKey(btcec.S256())
+	unrelated, _ := btcec.NewPrivateKey(btcec.S256())
+	field := polynomial.Field{P: btcec.S256().N}
+
+	lcg := field.New(big.NewInt(0x5deece66d), big.NewInt(0xb))
+	quad := field.New(new(big.Int).SetBytes(mustDecodeHex(t, "1f2e3d4c5b6a7988")),
+		big.NewInt(31337), big.NewInt(0x10001))
+
+	bucket := sighash.NewSHPairBucket(nil)
+	bucket.Pairs = append(bucket.Pairs, recurrencePairs(lcgKey, 4, lcg)...)
+
+	// An unrelated signature ahead of the sequence, to be skipped over
+	bucket.Pairs = append(bucket.Pairs, ecdsaPair(quadKey, "unrelated", big.NewInt(0x1234)))
+	bucket.Pairs = append(bucket.Pairs, recurrencePairs(quadKey, 5, quad)...)
+
+	for i := int64(0); i < 5; i++ {
+		bucket.Pairs = append(bucket.Pairs, ecdsaPair(unrelated, "random", big.NewInt(0x1234+i*i*i)))
+	}
+
+	results := bucket.SolveNonceRecurrences(sighash.NonceRecurrenceSearch{MaxDegree: 2})
+	if assert.Equal(t, 2, len(results), "wrong number of recurrence results") {
+		assert.Equal(t, testPrivHex, hex.EncodeToString(results[0].Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, 1, results[0].Degree, "wrong recurrence degree")
+
+		assert.Equal(t, hex.EncodeToString(quadKey.Serialize()),
+			hex.EncodeToString(results[1].Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, 2, results[1].Degree, "wrong recurrence degree")
+	}
+
+	_, err := sighash.SolveNonceRecurrence(recurrencePairs(quadKey, 4, quad), 2)
+	assert.Equal(t, sighash.ErrRecurrenceTooFewSigs, err)
+}
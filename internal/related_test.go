@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+// ecdsaPair signs a made up message with the given nonce.
+func ecdsaPair(priv *btcec.PrivateKey, msg string, k *big.Int) *sighash.SHPair {
+	z := sha256.Sum256([]byte(msg))
+	sig := signWithNonce(priv, z[:], k)
+	return &sighash.SHPair{
+		R:         sig.R,
+		S:         sig.S,
+		Z:         z[:],
+		PublicKey: priv.PubKey().SerializeUncompressed(),
+	}
+}
+
+// affineNonce returns a*k + b mod n.
+func affineNonce(k *big.Int, a, b int64) *big.Int {
+	next := new(big.Int).Mul(k, big.NewInt(a))
+	next.Add(next, big.NewInt(b))
+	return next.Mod(next, btcec.S256().N)
+}
+
+func TestRelatedNonces(t *testing.T) {
+	priv := testPrivKey()
+	counter, _ := btcec.NewPrivateKey(btcec.S256())
+	unrelated, _ := btcec.NewPrivateKey(btcec.S256())
+	bigStep := new(big.Int).SetBytes(mustDecodeHex(t, "5f3a1b77c0de0001"))
+
+	bucket := sighash.NewSHPairBucket(nil)
+	bucket.Pairs = append(bucket.Pairs,
+		// k2 = -2*k1 + 17, within the search bounds
+		ecdsaPair(priv, "first", testNonce),
+		ecdsaPair(priv, "second", affineNonce(testNonce, -2, 17)),
+
+		// A counter with a large increment, only found from three signatures
+		ecdsaPair(counter, "first", testNonce),
+		ecdsaPair(counter, "second", new(big.Int).Add(testNonce, bigStep)),
+		ecdsaPair(counter, "third", new(big.Int).Add(testNonce, new(big.Int).Lsh(bigStep, 1))),
+
+		ecdsaPair(unrelated, "first", big.NewInt(0x1234)),
+		ecdsaPair(unrelated, "second", big.NewInt(0x98765432)),
+	)
+
+	results := bucket.SolveRelatedNonces(sighash.RelatedNonceSearch{MaxA: 2, MaxB: 32})
+	if assert.Equal(t, 2, len(results), "wrong number of related nonce results") {
+		assert.Equal(t, testPrivHex, hex.EncodeToString(results[0].Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, int64(-2), results[0].Relation.A.Int64(), "derived incorrect relation")
+		assert.Equal(t, int64(17), results[0].Relation.B.Int64(), "derived incorrect relation")
+
+		assert.Equal(t, hex.EncodeToString(counter.Serialize()),
+			hex.EncodeToString(results[1].Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, 3, len(results[1].Pairs), "wrong number of related pairs")
+	}
+
+	// A hypothesised relation outside of any search bounds
+	a, b := int64(0x10001), int64(0x7fffffff)
+	lhs, rhs := ecdsaPair(priv, "first", testNonce), ecdsaPair(priv, "second", affineNonce(testNonce, a, b))
+	recovered, err := lhs.RecoverWithNonceRelation(rhs,
+		sighash.NonceRelation{A: big.NewInt(a), B: big.NewInt(b)})
+	if assert.NoError(t, err) {
+		assert.Equal(t, testPrivHex, hex.EncodeToString(recovered.Serialize()), "derived incorrect privateKey")
+	}
+	_, err = lhs.RecoverWithNonceRelation(rhs, sighash.NonceRelation{A: big.NewInt(a), B: big.NewInt(b + 1)})
+	assert.Equal(t, sighash.ErrNoResult, err, "wrong relation yielded a key")
+
+	// Schnorr signatures are solved through their challenges
+	msg1, msg2 := sha256.Sum256([]byte("first")), sha256.Sum256([]byte("second"))
+	sig1 := signSchnorrWithNonce(priv, msg1[:], testNonce, sighash.SigHashDefault)
+	sig2 := signSchnorrWithNonce(priv, msg2[:], affineNonce(testNonce, 1, 5), sighash.SigHashDefault)
+	schnorrPair := func(sig, msg []byte) *sighash.SHPair {
+		return &sighash.SHPair{
+			R:         new(big.Int).SetBytes(sig[:32]),
+			S:         new(big.Int).SetBytes(sig[32:]),
+			Z:         msg,
+			PublicKey: xOnly(priv.PubKey()),
+			Type:      sighash.SigTypeSchnorr,
+		}
+	}
+	bucket = sighash.NewSHPairBucket(nil)
+	bucket.Pairs = append(bucket.Pairs, schnorrPair(sig1, msg1[:]), schnorrPair(sig2, msg2[:]))
+	results = bucket.SolveRelatedNonces(sighash.RelatedNonceSearch{MaxA: 1, MaxB: 8})
+	if assert.Equal(t, 1, len(results), "wrong number of related nonce results") {
+		assert.Equal(t, hex.EncodeToString(xOnly(priv.PubKey())),
+			hex.EncodeToString(xOnly(results[0].Key.PubKey())), "derived incorrect privateKey")
+	}
+}
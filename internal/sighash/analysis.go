@@ -0,0 +1,238 @@
+package sighash
+
+import (
+	"encoding/hex"
+	"math"
+	"math/big"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// BiasTest is the outcome of a statistical test of the signatures of a key,
+// a small PValue meaning the signatures are unlikely to be unbiased.
+type BiasTest struct {
+	Name      string  `json:"name"`
+	Statistic float64 `json:"statistic"`
+	PValue    float64 `json:"pValue"`
+}
+
+// KeyBiasReport summarizes how biased the signatures of a key look. The
+// leading zero histograms are of r, s and of the linear form k = u + v*d of
+// the nonce, u being z/s and v being r/s for ECDSA, s and -e for Schnorr.
+type KeyBiasReport struct {
+	PublicKey string `json:"pubkey"`
+	SigCount  int    `json:"sigCount"`
+
+	// DuplicateR counts the signatures reusing an R value of an earlier
+	// signature by the same key, DuplicateRRate is their share
+	DuplicateR     int     `json:"duplicateR"`
+	DuplicateRRate float64 `json:"duplicateRRate"`
+
+	// SharedR counts the signatures whose R value is also used by a
+	// different key, KnownBadR those whose nonce is a known bad one
+	SharedR   int `json:"sharedR"`
+	KnownBadR int `json:"knownBadR"`
+
+	LeadingZeros map[string][]int `json:"leadingZeros"`
+	Tests        []BiasTest       `json:"tests"`
+
+	// Score ranks keys by suspicion, the higher the more suspicious
+	Score float64 `json:"score"`
+}
+
+// BiasReport ranks the keys of a bucket by how suspicious their signatures
+// look, most suspicious first.
+type BiasReport struct {
+	SigCount int              `json:"sigCount"`
+	KeyCount int              `json:"keyCount"`
+	Keys     []*KeyBiasReport `json:"keys"`
+}
+
+// leadingZeroBuckets is the size of the leading zero histograms, the last
+// bucket holding everything above.
+const leadingZeroBuckets = 8
+
+// Weights of the direct evidence of bad nonces in the suspicion score, next
+// to the -log10 of the p-value of every test.
+const (
+	duplicateRWeight = 20
+	sharedRWeight    = 10
+	knownBadRWeight  = 50
+	maxTestScore     = 30
+)
+
+func leadingZeros(x *big.Int) int {
+	return 256 - x.BitLen()
+}
+
+// leadingZeroTest tests whether values have more leading zero bits than
+// uniform 256-bit values would. Those have a number of leading zeros that is
+// geometric with mean 1 and variance 2, so the sum over m values is
+// approximately normal with mean m and variance 2m.
+func leadingZeroTest(name string, zeros []int) BiasTest {
+	sum := 0
+	for _, z := range zeros {
+		sum += z
+	}
+	m := float64(len(zeros))
+	stat := (float64(sum) - m) / math.Sqrt(2*m)
+	return BiasTest{
+		Name:      name,
+		Statistic: stat,
+		PValue:    0.5 * math.Erfc(stat/math.Sqrt2),
+	}
+}
+
+// foldS returns min(s, n - s), which is uniform over [0, n/2) for honest
+// signers whether or not they normalise S to its low form.
+func foldS(s *big.Int) *big.Int {
+	n := btcec.S256().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) <= 0 {
+		return s
+	}
+	return new(big.Int).Sub(n, new(big.Int).Mod(s, n))
+}
+
+// nibbleTest is a chi-square test of the frequency of the nibbles of values
+// against a uniform distribution, for low entropy values. The first skip
+// nibbles are left out, for values whose top bits are not uniform. The
+// p-value uses the Wilson-Hilferty normal approximation of the chi-square
+// distribution.
+func nibbleTest(name string, values []*big.Int, skip int) BiasTest {
+	var counts [16]float64
+	total := 0.0
+	for _, v := range values {
+		for i, b := range padTo32(v.Bytes()) {
+			if 2*i >= skip {
+				counts[b>>4]++
+				total++
+			}
+			if 2*i+1 >= skip {
+				counts[b&0xf]++
+				total++
+			}
+		}
+	}
+	expected := total / 16
+	chi2 := 0.0
+	for _, c := range counts {
+		chi2 += (c - expected) * (c - expected) / expected
+	}
+
+	dof := 15.0
+	z := (math.Cbrt(chi2/dof) - (1 - 2/(9*dof))) / math.Sqrt(2/(9*dof))
+	return BiasTest{
+		Name:      name,
+		Statistic: chi2,
+		PValue:    0.5 * math.Erfc(z/math.Sqrt2),
+	}
+}
+
+// analyzeKey computes the report of a single key. rKeys counts the distinct
+// keys using every R value in the bucket.
+func analyzeKey(pairs []*SHPair, rKeys map[string]int) *KeyBiasReport {
+	n := btcec.S256().N
+	known := KnownBadNonces()
+	report := &KeyBiasReport{
+		PublicKey:    hex.EncodeToString(pairs[0].PublicKey),
+		SigCount:     len(pairs),
+		LeadingZeros: make(map[string][]int),
+	}
+
+	values := map[string][]*big.Int{}
+	seenR := make(map[string]bool)
+	for _, pair := range pairs {
+		id := string(new(big.Int).Mod(pair.R, n).Bytes())
+		if seenR[id] {
+			report.DuplicateR++
+		}
+		seenR[id] = true
+		if rKeys[id] > 1 {
+			report.SharedR++
+		}
+		if known[id] != nil {
+			report.KnownBadR++
+		}
+
+		values["r"] = append(values["r"], pair.R)
+		values["s"] = append(values["s"], foldS(pair.S))
+		if u, v, err := pair.linearNonce(); err == nil {
+			values["u"] = append(values["u"], u)
+			values["v"] = append(values["v"], v)
+		}
+	}
+	report.DuplicateRRate = float64(report.DuplicateR) / float64(len(pairs))
+
+	for _, name := range []string{"r", "s", "u", "v"} {
+		if len(values[name]) == 0 {
+			continue
+		}
+		histogram := make([]int, leadingZeroBuckets)
+		zeros := make([]int, len(values[name]))
+		for i, v := range values[name] {
+			zeros[i] = leadingZeros(v)
+			if name == "s" {
+				// Folded S is below n/2, one bit short of the others
+				zeros[i]--
+			}
+			bucket := zeros[i]
+			if bucket >= leadingZeroBuckets {
+				bucket = leadingZeroBuckets - 1
+			}
+			histogram[bucket]++
+		}
+		report.LeadingZeros[name] = histogram
+		report.Tests = append(report.Tests, leadingZeroTest("leadingZeros/"+name, zeros))
+	}
+	report.Tests = append(report.Tests,
+		nibbleTest("nibbles/r", values["r"], 0),
+		nibbleTest("nibbles/s", values["s"], 1),
+	)
+
+	for _, test := range report.Tests {
+		score := float64(maxTestScore)
+		if test.PValue > 0 {
+			score = math.Min(-math.Log10(test.PValue), maxTestScore)
+		}
+		report.Score += score
+	}
+	report.Score += float64(report.DuplicateR*duplicateRWeight +
+		report.SharedR*sharedRWeight + report.KnownBadR*knownBadRWeight)
+	return report
+}
+
+// AnalyzeBias runs statistical tests on the signatures of every key in the
+// bucket with at least minSigs of them, ranking the keys by how biased their
+// nonces look. Nothing is recovered, the report is meant to tell which keys
+// are worth the more expensive attacks.
+func (bucket *SHPairBucket) AnalyzeBias(minSigs int) *BiasReport {
+	n := btcec.S256().N
+	groups := bucket.pairsByKey()
+
+	rKeys := make(map[string]int)
+	for _, pairs := range groups {
+		seen := make(map[string]bool)
+		for _, pair := range pairs {
+			id := string(new(big.Int).Mod(pair.R, n).Bytes())
+			if !seen[id] {
+				seen[id] = true
+				rKeys[id]++
+			}
+		}
+	}
+
+	report := &BiasReport{Keys: make([]*KeyBiasReport, 0)}
+	for _, pairs := range groups {
+		report.SigCount += len(pairs)
+		report.KeyCount++
+		if len(pairs) < minSigs {
+			continue
+		}
+		report.Keys = append(report.Keys, analyzeKey(pairs, rKeys))
+	}
+	sort.SliceStable(report.Keys, func(i, j int) bool {
+		return report.Keys[i].Score > report.Keys[j].Score
+	})
+	return report
+}
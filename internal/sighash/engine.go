@@ -0,0 +1,323 @@
+package sighash
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// ExtractionMode selects how the signatures of an input are located.
+type ExtractionMode int
+
+const (
+	// ModeTemplate matches the prevOut script against the standard templates.
+	ModeTemplate ExtractionMode = iota
+
+	// ModeEngine runs the input through the script engine and records every
+	// signature check it evaluates, which covers nonstandard scripts too.
+	// The engine predates Taproot and cannot run tapscript, OP_CHECKSIGADD
+	// included, so P2TR inputs are still matched against the templates.
+	ModeEngine
+)
+
+// usesEngine tells whether inputs spending the template are run through the
+// engine in this mode.
+func (mode ExtractionMode) usesEngine(template ScriptTemplate) bool {
+	return mode == ModeEngine && template != TemplateP2TR
+}
+
+// engineFlags are the consensus rules the engine is run with. Policy flags
+// are left out since mined txns only need to be consensus valid.
+const engineFlags = txscript.ScriptBip16 | txscript.ScriptVerifyWitness
+
+// Conditional states, mirroring the ones of the engine.
+const (
+	condFalse = iota
+	condTrue
+	condSkip
+)
+
+// engineTrace follows a txscript.Engine as it steps through an input. The
+// engine doesn't expose what it hashes and verifies, so the trace tracks the
+// executed branches and code separators itself and recomputes Z for each
+// signature check from the same subscript the engine uses.
+type engineTrace struct {
+	tc     *txContext
+	i      int
+	amount int64
+
+	// scripts holds the raw scripts at the indices the engine executes them
+	// at, witnessIdx being the one executed with BIP143 rules, if any
+	scripts    [][]byte
+	parsed     [][]scriptOp
+	witnessIdx int
+
+	scriptIdx   int
+	condStack   []int
+	lastCodeSep int
+
+	pairs []*SHPair
+}
+
+func newEngineTrace(tc *txContext, i int, pkScript []byte, amount int64) (*engineTrace, error) {
+	input := tc.msgTx.TxIn[i]
+	trace := &engineTrace{
+		tc:         tc,
+		i:          i,
+		amount:     amount,
+		scripts:    [][]byte{input.SignatureScript, pkScript},
+		witnessIdx: -1,
+		scriptIdx:  -1,
+	}
+
+	program := pkScript
+	if ClassifyScript(pkScript) == TemplateP2SH {
+		pushes, err := scriptPushes(input.SignatureScript)
+		if err != nil || len(pushes) == 0 {
+			return nil, WarnRedeemScriptSkip
+		}
+		program = pushes[len(pushes)-1]
+		trace.scripts = append(trace.scripts, program)
+	}
+	if len(input.Witness) != 0 {
+		switch ClassifyScript(program) {
+		case TemplateP2WPKH:
+			script, err := txscript.NewScriptBuilder().AddOp(txscript.OP_DUP).
+				AddOp(txscript.OP_HASH160).AddData(program[2:]).
+				AddOp(txscript.OP_EQUALVERIFY).AddOp(txscript.OP_CHECKSIG).Script()
+			if err != nil {
+				return nil, err
+			}
+			trace.scripts = append(trace.scripts, script)
+			trace.witnessIdx = len(trace.scripts) - 1
+		case TemplateP2WSH:
+			trace.scripts = append(trace.scripts, input.Witness[len(input.Witness)-1])
+			trace.witnessIdx = len(trace.scripts) - 1
+		}
+	}
+
+	trace.parsed = make([][]scriptOp, len(trace.scripts))
+	for idx, script := range trace.scripts {
+		ops, err := parseScript(script)
+		if err != nil {
+			return nil, WarnScriptParseSkip
+		}
+		trace.parsed[idx] = ops
+	}
+	return trace, nil
+}
+
+// extractWithEngine executes the input and returns a pair for every
+// signature the engine checked that verifies against the key it was checked
+// against. Nothing is returned for inputs the engine rejects.
+func extractWithEngine(tc *txContext, i int, pkScript []byte, amount int64) ([]*SHPair, error) {
+	trace, err := newEngineTrace(tc, i, pkScript, amount)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := txscript.NewEngine(pkScript, tc.msgTx, i, engineFlags,
+		nil, tc.witnessSigHashes(), amount)
+	if err != nil {
+		return nil, WarnScriptExecSkip
+	}
+
+	for done := false; !done; {
+		pc, err := vm.DisasmPC()
+		if err != nil {
+			return nil, WarnScriptExecSkip
+		}
+		var scriptIdx, scriptOff int
+		if _, err := fmt.Sscanf(pc, "%02x:%04x", &scriptIdx, &scriptOff); err != nil {
+			return nil, WarnScriptExecSkip
+		}
+		if err := trace.before(vm, scriptIdx, scriptOff); err != nil {
+			return nil, err
+		}
+
+		done, err = vm.Step()
+		if err != nil {
+			return nil, WarnScriptExecSkip
+		}
+	}
+	if err := vm.CheckErrorCondition(true); err != nil {
+		return nil, WarnScriptExecSkip
+	}
+
+	if len(trace.pairs) == 0 {
+		return nil, WarnNoSigMatchSkip
+	}
+	return trace.pairs, nil
+}
+
+// before is called with the opcode the engine is about to execute.
+func (trace *engineTrace) before(vm *txscript.Engine, scriptIdx, scriptOff int) error {
+	if scriptIdx >= len(trace.parsed) || scriptOff >= len(trace.parsed[scriptIdx]) {
+		return WarnScriptExecSkip
+	}
+	if scriptIdx != trace.scriptIdx {
+		trace.scriptIdx = scriptIdx
+		trace.condStack = trace.condStack[:0]
+		trace.lastCodeSep = 0
+	}
+	op := trace.parsed[scriptIdx][scriptOff]
+
+	switch op.opcode {
+	case txscript.OP_IF, txscript.OP_NOTIF:
+		cond := condSkip
+		if trace.executing() {
+			stack := vm.GetStack()
+			if len(stack) == 0 {
+				return WarnScriptExecSkip
+			}
+			cond = condFalse
+			if stackBool(stack[len(stack)-1]) == (op.opcode == txscript.OP_IF) {
+				cond = condTrue
+			}
+		}
+		trace.condStack = append(trace.condStack, cond)
+		return nil
+	case txscript.OP_ELSE:
+		if l := len(trace.condStack); l > 0 && trace.condStack[l-1] != condSkip {
+			trace.condStack[l-1] ^= condTrue
+		}
+		return nil
+	case txscript.OP_ENDIF:
+		if l := len(trace.condStack); l > 0 {
+			trace.condStack = trace.condStack[:l-1]
+		}
+		return nil
+	}
+	if !trace.executing() {
+		return nil
+	}
+
+	switch op.opcode {
+	case txscript.OP_CODESEPARATOR:
+		trace.lastCodeSep = scriptOff + 1
+	case txscript.OP_CHECKSIG, txscript.OP_CHECKSIGVERIFY:
+		stack := vm.GetStack()
+		if len(stack) < 2 {
+			return nil
+		}
+		trace.capture([][]byte{stack[len(stack)-2]}, [][]byte{stack[len(stack)-1]})
+	case txscript.OP_CHECKMULTISIG, txscript.OP_CHECKMULTISIGVERIFY:
+		sigs, keys, ok := multiSigOperands(vm.GetStack())
+		if ok {
+			trace.capture(sigs, keys)
+		}
+	}
+	return nil
+}
+
+func (trace *engineTrace) executing() bool {
+	for _, cond := range trace.condStack {
+		if cond != condTrue {
+			return false
+		}
+	}
+	return true
+}
+
+// capture records the signatures that verify against any of the keys.
+func (trace *engineTrace) capture(sigPushes, keyPushes [][]byte) {
+	keys := parsePubKeys(keyPushes)
+	if len(keys) == 0 {
+		return
+	}
+	subScript := trace.subScript(sigPushes)
+
+	sigs := make([]*sigPush, 0, len(sigPushes))
+	for _, push := range sigPushes {
+		if sig, err := parseSigPush(push); err == nil {
+			sigs = append(sigs, sig)
+		}
+	}
+	calcZ := func(hashType txscript.SigHashType) ([]byte, error) {
+		if trace.scriptIdx == trace.witnessIdx {
+			return txscript.CalcWitnessSigHash(subScript, trace.tc.witnessSigHashes(),
+				hashType, trace.tc.msgTx, trace.i, trace.amount)
+		}
+		return txscript.CalcSignatureHash(subScript, hashType, trace.tc.msgTx, trace.i)
+	}
+	pairs, err := matchSignatures(sigs, keys, calcZ)
+	if err != nil {
+		return
+	}
+	trace.pairs = append(trace.pairs, pairs...)
+}
+
+// subScript serializes the current script from the last executed code
+// separator. Outside of witness scripts, the signatures being checked are
+// removed from it as well, like FindAndDelete does.
+func (trace *engineTrace) subScript(sigPushes [][]byte) []byte {
+	sigScripts := make([][]byte, 0, len(sigPushes))
+	if trace.scriptIdx != trace.witnessIdx {
+		for _, push := range sigPushes {
+			if script, err := txscript.NewScriptBuilder().AddData(push).Script(); err == nil {
+				sigScripts = append(sigScripts, script)
+			}
+		}
+	}
+
+	var subScript bytes.Buffer
+	for _, op := range trace.parsed[trace.scriptIdx][trace.lastCodeSep:] {
+		deleted := false
+		for _, sigScript := range sigScripts {
+			if bytes.Equal(op.raw, sigScript) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			subScript.Write(op.raw)
+		}
+	}
+	return subScript.Bytes()
+}
+
+// multiSigOperands picks the signatures and keys CHECKMULTISIG consumes off
+// the top of the stack: <sigs...> <m> <keys...> <n>.
+func multiSigOperands(stack [][]byte) (sigs, keys [][]byte, ok bool) {
+	top := len(stack) - 1
+	if top < 0 {
+		return nil, nil, false
+	}
+	n, ok := stackInt(stack[top])
+	if !ok || n < 0 || top-n-1 < 0 {
+		return nil, nil, false
+	}
+	keys = stack[top-n : top]
+	m, ok := stackInt(stack[top-n-1])
+	if !ok || m < 0 || top-n-1-m < 0 {
+		return nil, nil, false
+	}
+	sigs = stack[top-n-1-m : top-n-1]
+	return sigs, keys, true
+}
+
+// stackInt decodes a little endian sign-magnitude stack item of up to 4 bytes.
+func stackInt(item []byte) (int, bool) {
+	if len(item) > 4 {
+		return 0, false
+	}
+	result := 0
+	for i, b := range item {
+		result |= int(b) << uint(8*i)
+	}
+	if len(item) > 0 && item[len(item)-1]&0x80 != 0 {
+		result &^= 0x80 << uint(8*(len(item)-1))
+		result = -result
+	}
+	return result, true
+}
+
+// stackBool interprets a stack item as a boolean, where negative zero is false.
+func stackBool(item []byte) bool {
+	for i, b := range item {
+		if b != 0 {
+			return i != len(item)-1 || b != 0x80
+		}
+	}
+	return false
+}
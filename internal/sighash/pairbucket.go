@@ -3,7 +3,11 @@ package sighash
 import (
 	"bytes"
 	"errors"
+	"sync"
+	"time"
+
 	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
@@ -12,14 +16,76 @@ import (
 )
 
 type SHPairBucket struct {
-	Pairs        []*SHPair
+	Pairs []*SHPair
+
+	// Mode selects how signatures are located in the inputs, ModeTemplate
+	// unless set otherwise
+	Mode ExtractionMode
+
+	// TemplateCounts tracks the template of the prevOut script of every
+	// input that has been routed to an extractor
+	TemplateCounts map[ScriptTemplate]int
+
+	// Strict makes the bucket verify every signature as it is extracted,
+	// rejecting those that do not verify. VerifyCounts then tracks the
+	// outcome of every verification.
+	Strict       bool
+	VerifyCounts map[VerifyResult]int
+
+	// Duplicates counts the pairs dropped for having the same key, R and Z
+	// as one already in the bucket, such as a transaction seen in the
+	// mempool and then in a block. Those from a different input reused their
+	// nonce on the same message, which reveals nothing, and are listed in
+	// UnexploitableReuse until the pair they duplicated is evicted.
+	Duplicates         int
+	UnexploitableReuse []*DuplicateSig
+
+	// Window bounds the pairs kept by a long-lived bucket, the oldest being
+	// evicted as new ones are added. Evicted counts them.
+	Window  Window
+	Evicted int
+
+	// OnRecovery, if set, is called with every key recovered from nonce
+	// reuse as soon as the pair completing the reuse is added. It is called
+	// outside of the bucket's lock, from the goroutine adding the pair.
+	OnRecovery func(*Recovery)
+
 	infoProvider provider.DataProvider
+
+	// mu guards the pairs, the counts and the index below, pairs appended
+	// to Pairs directly are indexed the next time the bucket is used
+	mu         sync.Mutex
+	indexed    int
+	addedAt    []time.Time
+	collisions map[collisionKey][]*SHPair
+	byTx       map[chainhash.Hash][]*SHPair
+	recovered  map[string]bool
+	reuse      []*Recovery
+}
+
+// DuplicateSig is a pair dropped by the bucket along with the one it
+// duplicated.
+type DuplicateSig struct {
+	Kept    *SHPair
+	Dropped *SHPair
+}
+
+// collisionKey indexes pairs by R value and by the key that signed them, the
+// pairs sharing one being the only candidates for nonce reuse.
+type collisionKey struct {
+	r   string
+	key string
 }
 
 func NewSHPairBucket(infoProvider provider.DataProvider) *SHPairBucket {
 	return &SHPairBucket{
-		Pairs:        make([]*SHPair, 0),
-		infoProvider: infoProvider,
+		Pairs:          make([]*SHPair, 0),
+		TemplateCounts: make(map[ScriptTemplate]int),
+		VerifyCounts:   make(map[VerifyResult]int),
+		infoProvider:   infoProvider,
+		collisions:     make(map[collisionKey][]*SHPair),
+		byTx:           make(map[chainhash.Hash][]*SHPair),
+		recovered:      make(map[string]bool),
 	}
 }
 
@@ -27,11 +93,18 @@ var (
 	ErrTxnDecode          = errors.New("failed to decode transaction")
 	WarnEmptySigSkip      = errors.New("skipping due to empty sig")
 	WarnWitnessSkip       = errors.New("skipping due to txWitness")
-	WarnSigOffsetSkip     = errors.New("skipping due to sig offset being out of bounds")
+	WarnTemplateSkip      = errors.New("skipping due to unsupported prevOut script template")
+	WarnScriptParseSkip   = errors.New("skipping due to failure to tokenize scriptSig")
+	WarnScriptExecSkip    = errors.New("skipping due to script failing to execute")
+	WarnWitnessStackSkip  = errors.New("skipping due to unexpected witness stack layout")
+	WarnRedeemScriptSkip  = errors.New("skipping due to malformed P2SH redeem script")
+	WarnWitnessScriptSkip = errors.New("skipping due to witness script not matching its program")
+	WarnNoSigMatchSkip    = errors.New("skipping due to no signature verifying against the script's keys")
+	WarnControlBlockSkip  = errors.New("skipping due to control block not committing to the output key")
+	WarnLeafVersionSkip   = errors.New("skipping due to unknown tapleaf version")
 	WarnSigParseSkip      = errors.New("skipping due to failure to parse signature")
-	WarnKeyLenOffsetSkip  = errors.New("skipping due to key len index being out of bounds")
-	WarnKeyOffsetSkip     = errors.New("skipping due to key end being out of bounds")
 	WarnKeyParseSkip      = errors.New("skipping due to failure to parse key")
+	WarnKeyHashSkip       = errors.New("skipping due to key not matching the prevOut's key hash")
 	WarnCantFindPrevOut   = errors.New("skipping due to failure to get prevOut for input")
 	WarnFailedZValExtract = errors.New("skipping due to failure extract Z value for prevOut")
 	WarnMofNSkip          = errors.New("skipping due to m-of-n")
@@ -48,116 +121,344 @@ func (bucket *SHPairBucket) AddRawTx(rawTxn []byte) (int, map[int]error) {
 }
 
 func (bucket *SHPairBucket) AddTx(msgTx *wire.MsgTx) (int, map[int]error) {
-	extracted := 0
+	return bucket.AddMinedTx(msgTx, nil)
+}
+
+// AddMinedTx is AddTx for a transaction whose location in the chain is known,
+// which the extracted pairs are tagged with. It is safe to call from multiple
+// goroutines, the prevOuts being fetched outside of the bucket's lock.
+func (bucket *SHPairBucket) AddMinedTx(msgTx *wire.MsgTx, location *TxLocation) (int, map[int]error) {
+	extracted := make([]*SHPair, 0)
 	errMap := make(map[int]error, 0)
+	templateCounts := make(map[ScriptTemplate]int)
+	verifyCounts := make(map[VerifyResult]int)
 
+	txid := msgTx.TxHash()
+	tc := newTxContext(msgTx, bucket.infoProvider)
 	for i, input := range msgTx.TxIn {
-		ss := input.SignatureScript
-		if len(ss) == 0 {
+		if len(input.SignatureScript) == 0 && len(input.Witness) == 0 {
 			errMap[i] = WarnEmptySigSkip
 			continue
 		}
-
-		if msgTx.HasWitness() {
-			errMap[i] = WarnWitnessSkip
+		prevOut, err := tc.prevOut(i)
+		if err != nil {
+			errMap[i] = err
 			continue
 		}
 
-		if ss[0] == txscript.OP_0 {
-			errMap[i] = WarnMofNSkip
+		template := ClassifyScript(prevOut.PkScript)
+		templateCounts[template]++
+		var pairs []*SHPair
+		if bucket.Mode.usesEngine(template) {
+			pairs, err = extractWithEngine(tc, i, prevOut.PkScript, prevOut.Value)
+		} else {
+			pairs, err = extractInput(tc, i, template, prevOut)
+		}
+		if err != nil {
+			errMap[i] = err
 			continue
 		}
-
-		sigBegin := 1
-		sigLen := int(ss[0])
-		sigEnd := sigBegin + sigLen
-		if len(ss) < sigEnd {
-			errMap[i] = WarnSigOffsetSkip
+		var rejected VerifyResult
+		kept := pairs[:0]
+		for _, pair := range pairs {
+			pair.Canonicalize()
+			if bucket.Strict {
+				result := pair.verify()
+				verifyCounts[result]++
+				if result != VerifyOK {
+					rejected = result
+					continue
+				}
+			}
+			pair.Template = template
+			pair.TxID = txid
+			pair.InputIndex = i
+			pair.Location = location
+			kept = append(kept, pair)
+		}
+		if len(kept) == 0 && rejected != VerifyOK {
+			errMap[i] = &WarnVerifySkip{Result: rejected}
 			continue
 		}
+		extracted = append(extracted, kept...)
+	}
 
-		sigslice := ss[sigBegin:sigEnd]
-		sig, err := btcec.ParseSignature(sigslice, btcec.S256())
-		if err != nil {
-			errMap[i] = WarnSigParseSkip
-			continue
+	bucket.mu.Lock()
+	for template, count := range templateCounts {
+		bucket.TemplateCounts[template] += count
+	}
+	if bucket.VerifyCounts == nil {
+		bucket.VerifyCounts = make(map[VerifyResult]int)
+	}
+	for result, count := range verifyCounts {
+		bucket.VerifyCounts[result] += count
+	}
+	bucket.mu.Unlock()
+	return bucket.AddPairs(extracted...), errMap
+}
+
+// AddPairs adds pairs obtained elsewhere than from a transaction, such as
+// signatures from Storage sharing an R value with new ones, checking them
+// for reuse like AddTx does. It returns how many were not duplicates.
+func (bucket *SHPairBucket) AddPairs(pairs ...*SHPair) int {
+	bucket.mu.Lock()
+	bucket.Pairs = append(bucket.Pairs, pairs...)
+	duplicates := bucket.Duplicates
+	recoveries := bucket.syncIndex()
+	duplicates = bucket.Duplicates - duplicates
+	bucket.evict()
+	bucket.mu.Unlock()
+
+	if bucket.OnRecovery != nil {
+		for _, rec := range recoveries {
+			bucket.OnRecovery(rec)
 		}
+	}
+	return len(pairs) - duplicates
+}
 
-		offs := sigBegin + sigLen
-		if len(ss) <= offs {
-			errMap[i] = WarnKeyLenOffsetSkip
+// syncIndex indexes the pairs added since it was last called, returning the
+// keys their nonce reuse revealed. New pairs are only tried against those
+// sharing their R value and key, and keys already recovered are not looked
+// for again. Pairs duplicating one already indexed are dropped from Pairs.
+// The caller must hold the lock.
+func (bucket *SHPairBucket) syncIndex() []*Recovery {
+	if bucket.collisions == nil {
+		bucket.collisions = make(map[collisionKey][]*SHPair)
+		bucket.byTx = make(map[chainhash.Hash][]*SHPair)
+		bucket.recovered = make(map[string]bool)
+	}
+	var found []*Recovery
+	now := bucket.Window.now()
+	kept := bucket.Pairs[:bucket.indexed]
+	keep := func(pair *SHPair) {
+		kept = append(kept, pair)
+		bucket.addedAt = append(bucket.addedAt, now)
+		bucket.byTx[pair.TxID] = append(bucket.byTx[pair.TxID], pair)
+	}
+	for _, pair := range bucket.Pairs[bucket.indexed:] {
+		id, err := pair.keyID()
+		if err != nil || pair.R == nil {
+			keep(pair)
 			continue
 		}
-		keyLen := int(ss[offs])
-		keyBegin := offs + 1
-		keyEnd := keyBegin + keyLen
-		if len(ss) < keyEnd {
-			errMap[i] = WarnKeyOffsetSkip
+		ck := collisionKey{r: string(pair.R.Bytes()), key: id}
+		group := bucket.collisions[ck]
+		if duplicate := findDuplicate(pair, group); duplicate != nil {
+			bucket.Duplicates++
+			if duplicate.TxID != pair.TxID || duplicate.InputIndex != pair.InputIndex {
+				bucket.UnexploitableReuse = append(bucket.UnexploitableReuse,
+					&DuplicateSig{Kept: duplicate, Dropped: pair})
+			}
 			continue
 		}
-
-		keyslice := ss[keyBegin:keyEnd]
-		key, err := btcec.ParsePubKey(keyslice, btcec.S256())
-		if err != nil {
-			errMap[i] = WarnKeyParseSkip
+		keep(pair)
+		bucket.collisions[ck] = append(group, pair)
+		if bucket.recovered[id] || len(group) == 0 {
 			continue
 		}
-
-		res := SHPair{
-			PublicKey: key.SerializeUncompressed(),
-			R:         sig.R,
-			S:         sig.S,
+		priv, prev, candidate := recoverFromCollisions(pair, group)
+		if priv == nil {
+			continue
 		}
+		rec := NewRecovery(RecoveryNonceReuse, priv, prev, pair)
+		rec.Candidate = candidate
+		bucket.recovered[id] = true
+		bucket.reuse = append(bucket.reuse, rec)
+		found = append(found, rec)
+	}
+	bucket.Pairs = kept
+	bucket.indexed = len(bucket.Pairs)
+	return found
+}
 
-		prevOutpoint := msgTx.TxIn[i].PreviousOutPoint
-		prevTx, err := bucket.infoProvider.GetTransaction(&prevOutpoint.Hash)
-		if err != nil {
-			errMap[i] = err
-			continue
+// findDuplicate returns the pair of group, which all share the R value and
+// key of pair, that has the same Z as it.
+func findDuplicate(pair *SHPair, group []*SHPair) *SHPair {
+	if pair.Z == nil {
+		return nil
+	}
+	for _, prev := range group {
+		if prev.Type == pair.Type && bytes.Equal(prev.Z, pair.Z) {
+			return prev
 		}
-		if prevTx == nil {
-			errMap[i] = WarnCantFindPrevOut
-			continue
+	}
+	return nil
+}
+
+// snapshot returns the pairs in the bucket, indexing any that were appended
+// to Pairs directly.
+func (bucket *SHPairBucket) snapshot() []*SHPair {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.syncIndex()
+	return bucket.Pairs[:len(bucket.Pairs):len(bucket.Pairs)]
+}
+
+// extractInput routes an input to the extractor for the template of the
+// prevOut script it spends.
+func extractInput(tc *txContext, i int, template ScriptTemplate, prevOut *wire.TxOut) ([]*SHPair, error) {
+	input := tc.msgTx.TxIn[i]
+
+	// Native witness spends carry an empty scriptSig
+	switch template {
+	case TemplateP2WPKH, TemplateP2WSH, TemplateP2TR:
+		if len(input.SignatureScript) != 0 {
+			return nil, WarnWitnessSkip
 		}
+	}
 
-		// TODO: Perhaps it may be not SigHashAll at all times?
-		z, err := txscript.CalcSignatureHash(
-			prevTx.MsgTx().TxOut[prevOutpoint.Index].PkScript,
-			txscript.SigHashAll,
-			msgTx,
-			i,
-		)
-		if err != nil {
-			errMap[i] = WarnFailedZValExtract
-			continue
+	switch template {
+	case TemplateP2WPKH:
+		return extractP2WPKH(tc, i, prevOut.PkScript, prevOut.Value)
+	case TemplateP2WSH:
+		return extractP2WSH(tc, i, prevOut.PkScript, prevOut.Value)
+	case TemplateP2TR:
+		return extractTaproot(tc, i, prevOut.PkScript)
+	}
+
+	pushes, err := scriptPushes(input.SignatureScript)
+	if err != nil {
+		return nil, WarnScriptParseSkip
+	}
+	switch template {
+	case TemplateP2PK:
+		return extractP2PK(tc, i, prevOut.PkScript, pushes)
+	case TemplateP2PKH:
+		return extractP2PKH(tc, i, prevOut.PkScript, pushes)
+	case TemplateMultiSig:
+		return extractMultiSig(tc, i, prevOut.PkScript, pushes)
+	case TemplateP2SH:
+		return extractP2SH(tc, i, prevOut, pushes)
+	default:
+		return nil, WarnTemplateSkip
+	}
+}
+
+// extractP2SH unwraps the redeem script, which is the last push of the
+// scriptSig, and routes the input according to its template.
+func extractP2SH(tc *txContext, i int, prevOut *wire.TxOut, pushes [][]byte) ([]*SHPair, error) {
+	if len(pushes) == 0 {
+		return nil, WarnRedeemScriptSkip
+	}
+	redeemScript, pushes := pushes[len(pushes)-1], pushes[:len(pushes)-1]
+	if !matchesScriptHash(redeemScript, prevOut.PkScript) {
+		return nil, WarnRedeemScriptSkip
+	}
+
+	// Wrapped witness programs have their signatures in the witness
+	template := ClassifyScript(redeemScript)
+	switch template {
+	case TemplateP2WPKH, TemplateP2WSH:
+		if len(pushes) != 0 {
+			return nil, WarnRedeemScriptSkip
 		}
-		res.Z = z
-		bucket.Pairs = append(bucket.Pairs, &res)
-		extracted++
 	}
-	return extracted, errMap
+
+	switch template {
+	case TemplateP2WPKH:
+		return extractP2WPKH(tc, i, redeemScript, prevOut.Value)
+	case TemplateP2WSH:
+		return extractP2WSH(tc, i, redeemScript, prevOut.Value)
+	case TemplateP2PK:
+		return extractP2PK(tc, i, redeemScript, pushes)
+	case TemplateP2PKH:
+		return extractP2PKH(tc, i, redeemScript, pushes)
+	case TemplateMultiSig:
+		return extractMultiSig(tc, i, redeemScript, pushes)
+	default:
+		return nil, WarnTemplateSkip
+	}
+}
+
+// matchesScriptHash checks redeemScript against the hash in a P2SH pkScript.
+func matchesScriptHash(redeemScript, pkScript []byte) bool {
+	return bytes.Equal(btcutil.Hash160(redeemScript), pkScript[2:22])
+}
+
+// extractP2PK handles spends of <pubkey> OP_CHECKSIG, where the scriptSig
+// holds nothing but the signature and the key is taken from the script itself.
+func extractP2PK(tc *txContext, i int, script []byte, pushes [][]byte) ([]*SHPair, error) {
+	if len(pushes) != 1 {
+		return nil, WarnSigParseSkip
+	}
+	sig, err := parseSigPush(pushes[0])
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, WarnKeyParseSkip
+	}
+	key, err := btcec.ParsePubKey(ops[0].data, btcec.S256())
+	if err != nil {
+		return nil, WarnKeyParseSkip
+	}
+
+	z, err := txscript.CalcSignatureHash(script, sig.hashType, tc.msgTx, i)
+	if err != nil {
+		return nil, WarnFailedZValExtract
+	}
+	return []*SHPair{{
+		PublicKey: key.SerializeUncompressed(),
+		R:         sig.R,
+		S:         sig.S,
+		Z:         z,
+		HashType:  sig.hashType,
+	}}, nil
+}
+
+// extractP2PKH expects the signature and the key to be the last two pushes of
+// the scriptSig, making sure the key hashes to the one committed to in script.
+func extractP2PKH(tc *txContext, i int, script []byte, pushes [][]byte) ([]*SHPair, error) {
+	if len(pushes) < 2 {
+		return nil, WarnSigParseSkip
+	}
+	sig, err := parseSigPush(pushes[len(pushes)-2])
+	if err != nil {
+		return nil, err
+	}
+
+	keyPush := pushes[len(pushes)-1]
+	key, err := btcec.ParsePubKey(keyPush, btcec.S256())
+	if err != nil {
+		return nil, WarnKeyParseSkip
+	}
+	if !bytes.Equal(btcutil.Hash160(keyPush), script[3:23]) {
+		return nil, WarnKeyHashSkip
+	}
+
+	z, err := txscript.CalcSignatureHash(script, sig.hashType, tc.msgTx, i)
+	if err != nil {
+		return nil, WarnFailedZValExtract
+	}
+	return []*SHPair{{
+		PublicKey: key.SerializeUncompressed(),
+		R:         sig.R,
+		S:         sig.S,
+		Z:         z,
+		HashType:  sig.hashType,
+	}}, nil
 }
 
-func (bucket *SHPairBucket) Solve() []*btcec.PrivateKey {
+// Solve recovers the keys of pairs sharing R under the same key, and then
+// propagates the recovered keys and nonces across all pairs in the bucket.
+// Nonce reuse is found as pairs are indexed, so only the propagation is left
+// to be done here.
+func (bucket *SHPairBucket) Solve() ([]*Recovery, []*RecoveredNonce) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.syncIndex()
 	if len(bucket.Pairs) < 2 {
 		log.Println("Solve() needs at least two SHPair in SHPairBucket")
-		return nil
+		return nil, nil
 	}
 
-	recovered := make([]*btcec.PrivateKey, 0)
-	for i := 0; i < len(bucket.Pairs)-1; i++ {
-		lhs := bucket.Pairs[i]
-		for _, rhs := range bucket.Pairs[i+1:] {
-			rec, err := lhs.RecoverPrivateKey(rhs)
-			if err != nil {
-				if err != WarnNoRValueReuse && err != WarnPubkeyMismatch {
-					log.Println("Error in Solve():", err.Error())
-				}
-			}
-			if rec != nil {
-				recovered = append(recovered, rec)
-			}
-		}
+	solver := newNonceSolver()
+	for _, rec := range bucket.reuse {
+		solver.addKey(rec)
 	}
-	return recovered
+	solver.propagate(bucket.Pairs)
+	return solver.keyList, solver.nonceList
 }
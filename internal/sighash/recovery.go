@@ -0,0 +1,89 @@
+package sighash
+
+import (
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// RecoveryMethod tells how a key was recovered.
+type RecoveryMethod int
+
+const (
+	// RecoveryNonceReuse keys come from two signatures sharing an R value.
+	RecoveryNonceReuse RecoveryMethod = iota
+
+	// RecoveryPropagation keys come from a signature whose nonce was
+	// recovered from another signature sharing its R value.
+	RecoveryPropagation
+
+	RecoveryRelatedNonce
+	RecoveryNonceRecurrence
+	RecoveryKnownNonce
+	RecoveryLattice
+)
+
+var recoveryMethodNames = map[RecoveryMethod]string{
+	RecoveryNonceReuse:      "nonce-reuse",
+	RecoveryPropagation:     "propagation",
+	RecoveryRelatedNonce:    "related-nonce",
+	RecoveryNonceRecurrence: "nonce-recurrence",
+	RecoveryKnownNonce:      "known-nonce",
+	RecoveryLattice:         "lattice",
+}
+
+func (method RecoveryMethod) String() string {
+	return recoveryMethodNames[method]
+}
+
+// Recovery is a recovered private key along with the signatures it was
+// recovered from.
+type Recovery struct {
+	Method RecoveryMethod
+	Key    *btcec.PrivateKey
+
+	// K is the nonce of the first of the pairs, the one producing its R
+	// value, which may be the negation of the one used for signing
+	K *big.Int
+
+	// Pairs are the signatures the key was recovered from. For nonce reuse
+	// these are the two sharing an R value, for propagation the one the key
+	// was solved for followed by the one its nonce was solved from.
+	Pairs []*SHPair
+
+	// Candidate is the index of the sign candidates (s1, s2) and (s1, -s2)
+	// that matched for nonce reuse, -1 otherwise
+	Candidate int
+
+	// Verified tells whether the first pair is by the recovered key and
+	// every source signature verifies against its own public key
+	Verified bool
+}
+
+// NewRecovery makes a Recovery of a key, solving for the nonce of the first
+// pair and verifying the source signatures.
+func NewRecovery(method RecoveryMethod, key *btcec.PrivateKey, pairs ...*SHPair) *Recovery {
+	rec := &Recovery{
+		Method:    method,
+		Key:       key,
+		Pairs:     pairs,
+		Candidate: -1,
+		Verified:  len(pairs) != 0,
+	}
+	if len(pairs) != 0 {
+		rec.K, _ = pairs[0].NonceFromKey(key)
+	}
+	if len(pairs) == 0 {
+		return rec
+	}
+	pub := key.PubKey()
+	if target, err := pairs[0].keyTarget(); err != nil || !target.matches(pub.X, pub.Y) {
+		rec.Verified = false
+	}
+	for _, pair := range pairs {
+		if !pair.Verify() {
+			rec.Verified = false
+		}
+	}
+	return rec
+}
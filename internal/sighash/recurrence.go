@@ -0,0 +1,178 @@
+package sighash
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/canselcik/nonced/internal/polynomial"
+)
+
+// NonceRecurrenceSearch bounds the recurrences tried by
+// SolveNonceRecurrences.
+type NonceRecurrenceSearch struct {
+	MaxDegree int
+}
+
+// NonceRecurrenceResult is a key recovered from signatures whose nonces
+// follow k_(i+1) = f(k_i) for a polynomial f of the given degree.
+type NonceRecurrenceResult struct {
+	PublicKey []byte
+	Key       *btcec.PrivateKey
+	Degree    int
+
+	// Pairs are the consecutive signatures the recurrence held over
+	Pairs []*SHPair
+}
+
+var ErrRecurrenceTooFewSigs = errors.New("need degree + 3 signatures by the same key for SolveNonceRecurrence")
+
+// recurrencePolynomial eliminates the unknown coefficients of the recurrence
+// from the nonces, leaving a polynomial in the key. The points (k_i, k_(i+1))
+// for i = 0..degree+1 all lie on f, so the (degree+1)-th divided difference
+// of f over them vanishes:
+//
+//	sum(k_(i+1) / prod(k_i - k_j, j != i)) = 0
+//
+// Multiplying it by the Vandermonde product of the k_i leaves
+// sum((-1)^i * k_(i+1) * V_i) = 0, V_i being the Vandermonde product of all
+// but k_i, which has degree degree*(degree+1)/2 + 1 in the key.
+func recurrencePolynomial(field polynomial.Field, nonces []polynomial.Poly) polynomial.Poly {
+	points := len(nonces) - 1
+	diffs := make([][]polynomial.Poly, points)
+	for j := range diffs {
+		diffs[j] = make([]polynomial.Poly, points)
+		for l := j + 1; l < points; l++ {
+			diffs[j][l] = field.Sub(nonces[l], nonces[j])
+		}
+	}
+
+	sum := polynomial.Poly{}
+	for i := 0; i < points; i++ {
+		term := nonces[i+1]
+		for j := 0; j < points; j++ {
+			for l := j + 1; l < points; l++ {
+				if j != i && l != i {
+					term = field.Mul(term, diffs[j][l])
+				}
+			}
+		}
+		if i%2 == 0 {
+			sum = field.Add(sum, term)
+		} else {
+			sum = field.Sub(sum, term)
+		}
+	}
+	return sum
+}
+
+// SolveNonceRecurrence recovers the key behind consecutive signatures whose
+// nonces were each derived from the previous one by a polynomial of the given
+// degree, such as an LCG for degree 1. It needs degree + 3 signatures, any
+// more are ignored. As only the x coordinate of k*G is known every sign
+// combination of the nonces is tried, and roots of the resulting polynomial
+// are only returned once they are found to be the key.
+func SolveNonceRecurrence(pairs []*SHPair, degree int) (*btcec.PrivateKey, error) {
+	if degree < 1 || len(pairs) < degree+3 {
+		return nil, ErrRecurrenceTooFewSigs
+	}
+	pairs = pairs[:degree+3]
+	for _, pair := range pairs[1:] {
+		if err := checkRelatedPairs(pairs[0], pair); err != nil {
+			return nil, err
+		}
+	}
+	target, err := pairs[0].keyTarget()
+	if err != nil {
+		return nil, err
+	}
+
+	field := polynomial.Field{P: btcec.S256().N}
+	forms := make([][][2]*big.Int, len(pairs))
+	for i, pair := range pairs {
+		if forms[i], err = pair.signedLinearNonces(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Negating every nonce negates f, so the sign of the first is fixed
+	nonces := make([]polynomial.Poly, len(pairs))
+	for signs := 0; signs < 1<<uint(len(pairs)-1); signs++ {
+		for i, form := range forms {
+			sign := 0
+			if i > 0 {
+				sign = (signs >> uint(i-1)) & 1
+			}
+			nonces[i] = field.New(form[sign][0], form[sign][1])
+		}
+
+		roots, err := field.Roots(recurrencePolynomial(field, nonces))
+		if err != nil {
+			continue
+		}
+		for _, d := range roots {
+			if d.Sign() == 0 {
+				continue
+			}
+			priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), padTo32(d.Bytes()))
+			if target.matches(pub.X, pub.Y) {
+				return priv, nil
+			}
+		}
+	}
+	return nil, ErrNoResult
+}
+
+// SolveNonceRecurrences looks for keys whose signatures follow a nonce
+// recurrence, trying increasing degrees over every window of consecutive
+// signatures. Signatures are taken in chain order when they all have a
+// location, in the order they were added to the bucket otherwise.
+func (bucket *SHPairBucket) SolveNonceRecurrences(search NonceRecurrenceSearch) []*NonceRecurrenceResult {
+	results := make([]*NonceRecurrenceResult, 0)
+	for _, pairs := range bucket.pairsByKey() {
+		if result, ok := searchNonceRecurrence(chainOrder(pairs), search); ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// chainOrder sorts pairs by block height, position of the transaction in the
+// block and input index, if they all have a location.
+func chainOrder(pairs []*SHPair) []*SHPair {
+	for _, pair := range pairs {
+		if pair.Location == nil || pair.Location.BlockHeight < 0 {
+			return pairs
+		}
+	}
+	sorted := append([]*SHPair(nil), pairs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		lhs, rhs := sorted[i].Location, sorted[j].Location
+		if lhs.BlockHeight != rhs.BlockHeight {
+			return lhs.BlockHeight < rhs.BlockHeight
+		}
+		if lhs.TxIndex != rhs.TxIndex {
+			return lhs.TxIndex < rhs.TxIndex
+		}
+		return sorted[i].InputIndex < sorted[j].InputIndex
+	})
+	return sorted
+}
+
+func searchNonceRecurrence(pairs []*SHPair, search NonceRecurrenceSearch) (*NonceRecurrenceResult, bool) {
+	for degree := 1; degree <= search.MaxDegree && degree+3 <= len(pairs); degree++ {
+		for start := 0; start+degree+3 <= len(pairs); start++ {
+			window := pairs[start : start+degree+3]
+			if priv, err := SolveNonceRecurrence(window, degree); err == nil {
+				return &NonceRecurrenceResult{
+					PublicKey: window[0].PublicKey,
+					Key:       priv,
+					Degree:    degree,
+					Pairs:     window,
+				}, true
+			}
+		}
+	}
+	return nil, false
+}
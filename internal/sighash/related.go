@@ -0,0 +1,353 @@
+package sighash
+
+import (
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// NonceRelation hypothesises that the nonce of a signature was derived from
+// the nonce of an earlier one by the same key as k2 = A*k1 + B.
+type NonceRelation struct {
+	A *big.Int
+	B *big.Int
+}
+
+// RelatedNonceSearch bounds the relations searched for, A ranging over
+// [-MaxA, MaxA] without zero and B over [-MaxB, MaxB].
+type RelatedNonceSearch struct {
+	MaxA int64
+	MaxB int64
+}
+
+// RelatedNonceResult is a key recovered from signatures with related nonces.
+type RelatedNonceResult struct {
+	PublicKey []byte
+	Key       *btcec.PrivateKey
+	Relation  NonceRelation
+
+	// Pairs are the signatures the relation holds between, in order
+	Pairs []*SHPair
+}
+
+// linearNonce expresses the nonce of a signature as k = u + v*d, as a
+// function of the unknown key d. For ECDSA, k = z/s + (r/s)*d, for Schnorr
+// k = s - e*d.
+func (pair *SHPair) linearNonce() (u, v *big.Int, err error) {
+	n := btcec.S256().N
+	if pair.Type == SigTypeSchnorr {
+		if _, err := liftX(pair.PublicKey); err != nil {
+			return nil, nil, err
+		}
+		v = SchnorrChallenge(pair.R, pair.PublicKey, pair.Z)
+		return new(big.Int).Set(pair.S), v.Sub(n, v), nil
+	}
+
+	if _, err := btcec.ParsePubKey(pair.PublicKey, btcec.S256()); err != nil {
+		return nil, nil, ErrCorruptPubkey
+	}
+	sInv := new(big.Int).ModInverse(pair.S, n)
+	if sInv == nil {
+		return nil, nil, ErrNoResult
+	}
+	u = new(big.Int).SetBytes(pair.Z)
+	u.Mul(u, sInv).Mod(u, n)
+	v = new(big.Int).Mul(pair.R, sInv)
+	return u, v.Mod(v, n), nil
+}
+
+// signedLinearNonces returns the linear forms of both the nonce and its
+// negation, as only the x coordinate of k*G is committed to.
+func (pair *SHPair) signedLinearNonces() ([][2]*big.Int, error) {
+	u, v, err := pair.linearNonce()
+	if err != nil {
+		return nil, err
+	}
+	n := btcec.S256().N
+	negU, negV := new(big.Int).Sub(n, u), new(big.Int).Sub(n, v)
+	return [][2]*big.Int{{u, v}, {negU.Mod(negU, n), negV.Mod(negV, n)}}, nil
+}
+
+// keyTarget is the public key candidate keys are compared against.
+type keyTarget struct {
+	x, y *big.Int
+
+	// xOnly targets match either sign of the key, as Schnorr ones do
+	xOnly bool
+}
+
+func (pair *SHPair) keyTarget() (*keyTarget, error) {
+	if pair.Type == SigTypeSchnorr {
+		return &keyTarget{x: new(big.Int).SetBytes(pair.PublicKey), xOnly: true}, nil
+	}
+	pubKey, err := btcec.ParsePubKey(pair.PublicKey, btcec.S256())
+	if err != nil {
+		return nil, ErrCorruptPubkey
+	}
+	return &keyTarget{x: pubKey.X, y: pubKey.Y}, nil
+}
+
+func (target *keyTarget) matches(x, y *big.Int) bool {
+	return x.Cmp(target.x) == 0 && (target.xOnly || y.Cmp(target.y) == 0)
+}
+
+// RecoverWithNonceRelation solves for the key of two signatures by the same
+// key whose nonces satisfy k2 = A*k1 + B, where rhs is the second one.
+func (lhs *SHPair) RecoverWithNonceRelation(rhs *SHPair, rel NonceRelation) (*btcec.PrivateKey, error) {
+	if err := checkRelatedPairs(lhs, rhs); err != nil {
+		return nil, err
+	}
+	forms1, err := lhs.signedLinearNonces()
+	if err != nil {
+		return nil, err
+	}
+	forms2, err := rhs.signedLinearNonces()
+	if err != nil {
+		return nil, err
+	}
+	target, err := lhs.keyTarget()
+	if err != nil {
+		return nil, err
+	}
+
+	curve := btcec.S256()
+	for _, f1 := range forms1 {
+		for _, f2 := range forms2 {
+			d0, delta, ok := relatedKeyLine(f1, f2, rel.A)
+			if !ok {
+				continue
+			}
+			// d = d0 + B*delta
+			d := new(big.Int).Mul(rel.B, delta)
+			d.Add(d, d0).Mod(d, curve.N)
+			if d.Sign() == 0 {
+				continue
+			}
+			priv, pub := btcec.PrivKeyFromBytes(curve, padTo32(d.Bytes()))
+			if target.matches(pub.X, pub.Y) {
+				return priv, nil
+			}
+		}
+	}
+	return nil, ErrNoResult
+}
+
+// relatedKeyLine solves u2 + v2*d = a*(u1 + v1*d) + b for d, which is the
+// line d0 + b*delta in the unknown b.
+func relatedKeyLine(f1, f2 [2]*big.Int, a *big.Int) (d0, delta *big.Int, ok bool) {
+	n := btcec.S256().N
+	u1, v1, u2, v2 := f1[0], f1[1], f2[0], f2[1]
+
+	// delta = 1 / (v2 - a*v1)
+	delta = new(big.Int).Mul(a, v1)
+	delta.Sub(v2, delta).Mod(delta, n)
+	if delta.ModInverse(delta, n) == nil {
+		return nil, nil, false
+	}
+
+	// d0 = (a*u1 - u2) * delta
+	d0 = new(big.Int).Mul(a, u1)
+	d0.Sub(d0, u2).Mul(d0, delta).Mod(d0, n)
+	return d0, delta, true
+}
+
+// searchRelatedPair looks for a relation within the bounds between the
+// nonces of two signatures. For each A, the candidate keys are d0 + B*delta,
+// so rather than multiplying out every candidate, B is walked by adding
+// delta*G to the candidate public key.
+func searchRelatedPair(lhs, rhs *SHPair, search RelatedNonceSearch) (*RelatedNonceResult, bool) {
+	forms1, err := lhs.signedLinearNonces()
+	if err != nil {
+		return nil, false
+	}
+	forms2, err := rhs.signedLinearNonces()
+	if err != nil {
+		return nil, false
+	}
+	target, err := lhs.keyTarget()
+	if err != nil {
+		return nil, false
+	}
+
+	curve := btcec.S256()
+	// The signs of the nonces are the outer loop so that the relation is
+	// reported between the nonces as they appear in the signatures if possible
+	for _, f1 := range forms1 {
+		for _, f2 := range forms2 {
+			for absA := int64(1); absA <= search.MaxA; absA++ {
+				for _, a := range []*big.Int{big.NewInt(absA), big.NewInt(-absA)} {
+					d0, delta, ok := relatedKeyLine(f1, f2, a)
+					if !ok {
+						continue
+					}
+					b, found := walkKeyLine(target, d0, delta, search.MaxB)
+					if !found {
+						continue
+					}
+
+					d := new(big.Int).Mul(big.NewInt(b), delta)
+					d.Add(d, d0).Mod(d, curve.N)
+					priv, _ := btcec.PrivKeyFromBytes(curve, padTo32(d.Bytes()))
+					return &RelatedNonceResult{
+						PublicKey: lhs.PublicKey,
+						Key:       priv,
+						Relation:  NonceRelation{A: a, B: big.NewInt(b)},
+						Pairs:     []*SHPair{lhs, rhs},
+					}, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// walkKeyLine finds the b in [-maxB, maxB] for which d0 + b*delta is the key
+// of the target, using one point addition per step.
+func walkKeyLine(target *keyTarget, d0, delta *big.Int, maxB int64) (int64, bool) {
+	curve := btcec.S256()
+	x0, y0 := curve.ScalarBaseMult(padTo32(d0.Bytes()))
+	if d0.Sign() != 0 && target.matches(x0, y0) {
+		return 0, true
+	}
+	stepX, stepY := curve.ScalarBaseMult(padTo32(delta.Bytes()))
+	negStepY := new(big.Int).Sub(curve.P, stepY)
+
+	fwdX, fwdY := x0, y0
+	bwdX, bwdY := x0, y0
+	if d0.Sign() == 0 {
+		// The point at infinity, which Add treats as (0, 0)
+		fwdX, fwdY = new(big.Int), new(big.Int)
+		bwdX, bwdY = new(big.Int), new(big.Int)
+	}
+	for b := int64(1); b <= maxB; b++ {
+		fwdX, fwdY = curve.Add(fwdX, fwdY, stepX, stepY)
+		if target.matches(fwdX, fwdY) {
+			return b, true
+		}
+		bwdX, bwdY = curve.Add(bwdX, bwdY, stepX, negStepY)
+		if target.matches(bwdX, bwdY) {
+			return -b, true
+		}
+	}
+	return 0, false
+}
+
+// recoverRelatedTriple handles three signatures whose nonces follow
+// k(i+1) = A*k(i) + B for an unknown B. Subtracting consecutive relations
+// eliminates B, k3 - k2 = A*(k2 - k1), leaving a linear equation in d.
+func recoverRelatedTriple(pairs []*SHPair, a *big.Int) (*RelatedNonceResult, bool) {
+	forms := make([][][2]*big.Int, len(pairs))
+	for i, pair := range pairs {
+		var err error
+		if forms[i], err = pair.signedLinearNonces(); err != nil {
+			return nil, false
+		}
+	}
+
+	target, err := pairs[0].keyTarget()
+	if err != nil {
+		return nil, false
+	}
+
+	curve := btcec.S256()
+	n := curve.N
+	for _, f1 := range forms[0] {
+		for _, f2 := range forms[1] {
+			for _, f3 := range forms[2] {
+				// d = (a*(u2 - u1) - (u3 - u2)) / ((v3 - v2) - a*(v2 - v1))
+				num := new(big.Int).Sub(f2[0], f1[0])
+				num.Mul(num, a).Sub(num, f3[0]).Add(num, f2[0])
+				den := new(big.Int).Sub(f2[1], f1[1])
+				den.Mul(den, a).Neg(den).Add(den, f3[1]).Sub(den, f2[1]).Mod(den, n)
+				if den.ModInverse(den, n) == nil {
+					continue
+				}
+				d := num.Mul(num, den).Mod(num, n)
+				if d.Sign() == 0 {
+					continue
+				}
+				priv, pub := btcec.PrivKeyFromBytes(curve, padTo32(d.Bytes()))
+				if !target.matches(pub.X, pub.Y) {
+					continue
+				}
+
+				// B = k2 - A*k1
+				k1 := new(big.Int).Mul(f1[1], d)
+				k1.Add(k1, f1[0])
+				b := new(big.Int).Mul(f2[1], d)
+				b.Add(b, f2[0]).Sub(b, k1.Mul(k1, a)).Mod(b, n)
+				return &RelatedNonceResult{
+					PublicKey: pairs[0].PublicKey,
+					Key:       priv,
+					Relation:  NonceRelation{A: a, B: b},
+					Pairs:     pairs,
+				}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func checkRelatedPairs(lhs, rhs *SHPair) error {
+	if lhs == nil || rhs == nil {
+		return ErrNilInput
+	}
+	if lhs == rhs {
+		return ErrIdenticalInputs
+	}
+	if lhs.Z == nil || rhs.Z == nil {
+		return ErrMissingZValue
+	}
+	if lhs.Type != rhs.Type {
+		return WarnSigTypeMismatch
+	}
+	lhsID, err := lhs.keyID()
+	if err != nil {
+		return err
+	}
+	rhsID, err := rhs.keyID()
+	if err != nil {
+		return err
+	}
+	if lhsID != rhsID {
+		return WarnPubkeyMismatch
+	}
+	return nil
+}
+
+// SolveRelatedNonces searches the signatures of each key in the bucket for
+// nonces related within the given bounds, in the order they were added.
+// Three consecutive signatures are also tried against every A for an
+// unbounded B. At most one result is reported per key.
+func (bucket *SHPairBucket) SolveRelatedNonces(search RelatedNonceSearch) []*RelatedNonceResult {
+	results := make([]*RelatedNonceResult, 0)
+	for _, pairs := range bucket.pairsByKey() {
+		if result, ok := searchRelatedKey(pairs, search); ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func searchRelatedKey(pairs []*SHPair, search RelatedNonceSearch) (*RelatedNonceResult, bool) {
+	for i := 0; i < len(pairs)-1; i++ {
+		for _, rhs := range pairs[i+1:] {
+			if checkRelatedPairs(pairs[i], rhs) != nil {
+				continue
+			}
+			if result, ok := searchRelatedPair(pairs[i], rhs, search); ok {
+				return result, true
+			}
+		}
+	}
+	for i := 0; i+2 < len(pairs); i++ {
+		for absA := int64(1); absA <= search.MaxA; absA++ {
+			for _, a := range []*big.Int{big.NewInt(absA), big.NewInt(-absA)} {
+				if result, ok := recoverRelatedTriple(pairs[i:i+3], a); ok {
+					return result, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,102 @@
+package sighash
+
+import (
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// TaggedHash implements the BIP340 tagged hash, SHA256(SHA256(tag) || SHA256(tag) || msg).
+func TaggedHash(tag string, msgs ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+	return h.Sum(nil)
+}
+
+// liftX returns the point with the given x coordinate and an even y, as the
+// x-only public keys of BIP340 are interpreted.
+func liftX(x []byte) (*btcec.PublicKey, error) {
+	if len(x) != 32 {
+		return nil, ErrCorruptPubkey
+	}
+	key, err := btcec.ParsePubKey(append([]byte{0x02}, x...), btcec.S256())
+	if err != nil {
+		return nil, ErrCorruptPubkey
+	}
+	return key, nil
+}
+
+// SchnorrChallenge computes e = int(hash_BIP0340/challenge(R || P || m)) mod n.
+func SchnorrChallenge(r *big.Int, pubKey, msg []byte) *big.Int {
+	e := new(big.Int).SetBytes(TaggedHash("BIP0340/challenge", padTo32(r.Bytes()), pubKey, msg))
+	return e.Mod(e, btcec.S256().N)
+}
+
+// VerifySchnorr verifies a BIP340 signature (r, s) over msg against the
+// x-only public key.
+func VerifySchnorr(pubKey, msg []byte, r, s *big.Int) bool {
+	curve := btcec.S256()
+	key, err := liftX(pubKey)
+	if err != nil {
+		return false
+	}
+	if r.Cmp(curve.P) >= 0 || s.Cmp(curve.N) >= 0 {
+		return false
+	}
+
+	// R = s*G - e*P
+	e := SchnorrChallenge(r, pubKey, msg)
+	sgX, sgY := curve.ScalarBaseMult(padTo32(s.Bytes()))
+	epX, epY := curve.ScalarMult(key.X, key.Y, padTo32(e.Bytes()))
+	epY.Sub(curve.P, epY)
+	rX, rY := curve.Add(sgX, sgY, epX, epY)
+	if rX.Sign() == 0 && rY.Sign() == 0 {
+		return false
+	}
+	return rY.Bit(0) == 0 && rX.Cmp(r) == 0
+}
+
+// recoverSchnorr solves s1 = k + e1*d and s2 = k + e2*d for d, which is the
+// key that signed for the x-only output key. For Taproot outputs that is the
+// tweaked private key rather than the internal one.
+func (lhs *SHPair) recoverSchnorr(rhs *SHPair) (*btcec.PrivateKey, error) {
+	if _, err := liftX(lhs.PublicKey); err != nil {
+		return nil, err
+	}
+
+	n := btcec.S256().N
+	e1 := SchnorrChallenge(lhs.R, lhs.PublicKey, lhs.Z)
+	e2 := SchnorrChallenge(rhs.R, rhs.PublicKey, rhs.Z)
+
+	// d = (s1 - s2) * (e1 - e2)^-1 mod n
+	denominator := new(big.Int).Sub(e1, e2)
+	denominator.Mod(denominator, n)
+	if denominator.ModInverse(denominator, n) == nil {
+		return nil, ErrNoResult
+	}
+	d := new(big.Int).Sub(lhs.S, rhs.S)
+	d.Mul(d, denominator)
+	d.Mod(d, n)
+
+	// Validating the candidate
+	derivedPriv, derivedPub := btcec.PrivKeyFromBytes(btcec.S256(), padTo32(d.Bytes()))
+	if derivedPub.X.Cmp(new(big.Int).SetBytes(lhs.PublicKey)) != 0 {
+		return nil, ErrNoResult
+	}
+	return derivedPriv, nil
+}
+
+func padTo32(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return padded
+}
@@ -0,0 +1,202 @@
+package sighash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+var (
+	ErrScriptTruncated   = errors.New("script ends in the middle of a push")
+	ErrScriptNotPushOnly = errors.New("script contains opcodes other than pushes")
+)
+
+// scriptOp is a single opcode of a script, along with the data it pushes and
+// its encoding in the script.
+type scriptOp struct {
+	opcode byte
+	data   []byte
+	raw    []byte
+}
+
+// parseScript tokenizes a script, decoding direct pushes as well as
+// OP_PUSHDATA1/2/4 ones.
+func parseScript(script []byte) ([]scriptOp, error) {
+	ops := make([]scriptOp, 0)
+	for offs := 0; offs < len(script); {
+		start := offs
+		opcode := script[offs]
+		offs++
+
+		var dataLen int
+		switch {
+		case opcode >= txscript.OP_DATA_1 && opcode <= txscript.OP_DATA_75:
+			dataLen = int(opcode)
+		case opcode == txscript.OP_PUSHDATA1:
+			if len(script) < offs+1 {
+				return nil, ErrScriptTruncated
+			}
+			dataLen = int(script[offs])
+			offs++
+		case opcode == txscript.OP_PUSHDATA2:
+			if len(script) < offs+2 {
+				return nil, ErrScriptTruncated
+			}
+			dataLen = int(binary.LittleEndian.Uint16(script[offs:]))
+			offs += 2
+		case opcode == txscript.OP_PUSHDATA4:
+			if len(script) < offs+4 {
+				return nil, ErrScriptTruncated
+			}
+			dataLen = int(binary.LittleEndian.Uint32(script[offs:]))
+			offs += 4
+			if dataLen < 0 {
+				return nil, ErrScriptTruncated
+			}
+		default:
+			ops = append(ops, scriptOp{opcode: opcode, raw: script[start:offs]})
+			continue
+		}
+
+		if len(script)-offs < dataLen {
+			return nil, ErrScriptTruncated
+		}
+		ops = append(ops, scriptOp{
+			opcode: opcode,
+			data:   script[offs : offs+dataLen],
+			raw:    script[start : offs+dataLen],
+		})
+		offs += dataLen
+	}
+	return ops, nil
+}
+
+// scriptPushes returns the data pushed by a push-only script such as a
+// scriptSig. OP_0 pushes an empty item, small integers aren't data.
+func scriptPushes(script []byte) ([][]byte, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	pushes := make([][]byte, 0, len(ops))
+	for _, op := range ops {
+		if op.opcode > txscript.OP_PUSHDATA4 {
+			return nil, ErrScriptNotPushOnly
+		}
+		pushes = append(pushes, op.data)
+	}
+	return pushes, nil
+}
+
+// pushedData returns the data pushed by any of the ops.
+func pushedData(ops []scriptOp) [][]byte {
+	data := make([][]byte, 0, len(ops))
+	for _, op := range ops {
+		if op.data != nil {
+			data = append(data, op.data)
+		}
+	}
+	return data
+}
+
+// ScriptTemplate is the standard form a pkScript or redeem script matches.
+type ScriptTemplate int
+
+const (
+	TemplateNonStandard ScriptTemplate = iota
+	TemplateP2PK
+	TemplateP2PKH
+	TemplateP2SH
+	TemplateMultiSig
+	TemplateP2WPKH
+	TemplateP2WSH
+	TemplateP2TR
+)
+
+var templateNames = map[ScriptTemplate]string{
+	TemplateNonStandard: "nonstandard",
+	TemplateP2PK:        "p2pk",
+	TemplateP2PKH:       "p2pkh",
+	TemplateP2SH:        "p2sh",
+	TemplateMultiSig:    "multisig",
+	TemplateP2WPKH:      "p2wpkh",
+	TemplateP2WSH:       "p2wsh",
+	TemplateP2TR:        "p2tr",
+}
+
+func (template ScriptTemplate) String() string {
+	if name, ok := templateNames[template]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(template))
+}
+
+// ClassifyScript matches a pkScript, or a P2SH redeem script, against the
+// templates the bucket knows how to extract signatures from.
+func ClassifyScript(script []byte) ScriptTemplate {
+	ops, err := parseScript(script)
+	if err != nil {
+		return TemplateNonStandard
+	}
+
+	switch {
+	case len(ops) == 2 && isPubKeyPush(ops[0]) && ops[1].opcode == txscript.OP_CHECKSIG:
+		return TemplateP2PK
+	case len(ops) == 5 && ops[0].opcode == txscript.OP_DUP && ops[1].opcode == txscript.OP_HASH160 &&
+		ops[2].opcode == txscript.OP_DATA_20 && ops[3].opcode == txscript.OP_EQUALVERIFY &&
+		ops[4].opcode == txscript.OP_CHECKSIG:
+		return TemplateP2PKH
+	case len(script) == 23 && len(ops) == 3 && ops[0].opcode == txscript.OP_HASH160 &&
+		ops[1].opcode == txscript.OP_DATA_20 && ops[2].opcode == txscript.OP_EQUAL:
+		return TemplateP2SH
+	case len(script) == 22 && ops[0].opcode == txscript.OP_0 && ops[1].opcode == txscript.OP_DATA_20:
+		return TemplateP2WPKH
+	case len(script) == 34 && ops[0].opcode == txscript.OP_0 && ops[1].opcode == txscript.OP_DATA_32:
+		return TemplateP2WSH
+	case len(script) == 34 && ops[0].opcode == txscript.OP_1 && ops[1].opcode == txscript.OP_DATA_32:
+		return TemplateP2TR
+	case isMultiSig(ops):
+		return TemplateMultiSig
+	}
+	return TemplateNonStandard
+}
+
+func isPubKeyPush(op scriptOp) bool {
+	return (op.opcode == txscript.OP_DATA_33 || op.opcode == txscript.OP_DATA_65) &&
+		(len(op.data) == 33 || len(op.data) == 65)
+}
+
+// isSmallInt tells whether the opcode is one of OP_0 or OP_1 - OP_16.
+func isSmallInt(opcode byte) bool {
+	return opcode == txscript.OP_0 || (opcode >= txscript.OP_1 && opcode <= txscript.OP_16)
+}
+
+func smallIntValue(opcode byte) int {
+	if opcode == txscript.OP_0 {
+		return 0
+	}
+	return int(opcode - (txscript.OP_1 - 1))
+}
+
+// isMultiSig matches <m> <pubkey>... <n> OP_CHECKMULTISIG.
+func isMultiSig(ops []scriptOp) bool {
+	l := len(ops)
+	if l < 4 || ops[l-1].opcode != txscript.OP_CHECKMULTISIG {
+		return false
+	}
+	if !isSmallInt(ops[0].opcode) || !isSmallInt(ops[l-2].opcode) {
+		return false
+	}
+	m, n := smallIntValue(ops[0].opcode), smallIntValue(ops[l-2].opcode)
+	if n != l-3 || m > n {
+		return false
+	}
+	for _, op := range ops[1 : l-2] {
+		if !isPubKeyPush(op) {
+			return false
+		}
+	}
+	return true
+}
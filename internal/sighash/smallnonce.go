@@ -0,0 +1,353 @@
+package sighash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrSmallNonceTable = errors.New("corrupt or mismatched small nonce table")
+	ErrSmallNonceBound = errors.New("small nonce bound out of reach of the table")
+)
+
+// maxGiantSteps bounds the giant steps of a search, each being a point
+// addition and a table lookup.
+const maxGiantSteps = 1 << 32
+
+var smallNonceTableMagic = [8]byte{'n', 'o', 'n', 'c', 'e', 'd', 'b', 's'}
+
+// SmallNonceTable holds the baby steps of a baby-step giant-step search for
+// small nonces, the x coordinates of j*G for j in [1, Size], indexed by their
+// first 8 bytes. As -j*G shares the x coordinate of j*G, it covers every
+// nonce within Size of a giant step.
+type SmallNonceTable struct {
+	Size     uint32
+	prefixes []uint64
+	steps    []uint32
+}
+
+func (table *SmallNonceTable) Len() int {
+	return len(table.prefixes)
+}
+
+func (table *SmallNonceTable) Less(i, j int) bool {
+	return table.prefixes[i] < table.prefixes[j]
+}
+
+func (table *SmallNonceTable) Swap(i, j int) {
+	table.prefixes[i], table.prefixes[j] = table.prefixes[j], table.prefixes[i]
+	table.steps[i], table.steps[j] = table.steps[j], table.steps[i]
+}
+
+func xPrefix(x *big.Int) uint64 {
+	return binary.BigEndian.Uint64(padTo32(x.Bytes()))
+}
+
+// NewSmallNonceTable computes a table of the given number of baby steps.
+func NewSmallNonceTable(size uint32) *SmallNonceTable {
+	curve := btcec.S256()
+	table := &SmallNonceTable{
+		Size:     size,
+		prefixes: make([]uint64, size),
+		steps:    make([]uint32, size),
+	}
+	x, y := curve.Gx, curve.Gy
+	for j := uint32(1); j <= size; j++ {
+		table.prefixes[j-1], table.steps[j-1] = xPrefix(x), j
+		x, y = curve.Add(x, y, curve.Gx, curve.Gy)
+	}
+	sort.Sort(table)
+	return table
+}
+
+// lookup returns the baby steps whose x coordinate starts like x.
+func (table *SmallNonceTable) lookup(x *big.Int) []uint32 {
+	prefix := xPrefix(x)
+	steps := make([]uint32, 0)
+	i := sort.Search(len(table.prefixes), func(i int) bool { return table.prefixes[i] >= prefix })
+	for ; i < len(table.prefixes) && table.prefixes[i] == prefix; i++ {
+		steps = append(steps, table.steps[i])
+	}
+	return steps
+}
+
+// WriteTo serializes the table as its magic, its size and its sorted entries.
+func (table *SmallNonceTable) WriteTo(w io.Writer) (int64, error) {
+	buf := bufio.NewWriter(w)
+	written := int64(0)
+	if _, err := buf.Write(smallNonceTableMagic[:]); err != nil {
+		return written, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, table.Size); err != nil {
+		return written, err
+	}
+	written += 12
+	for i := range table.prefixes {
+		if err := binary.Write(buf, binary.BigEndian, table.prefixes[i]); err != nil {
+			return written, err
+		}
+		if err := binary.Write(buf, binary.BigEndian, table.steps[i]); err != nil {
+			return written, err
+		}
+		written += 12
+	}
+	return written, buf.Flush()
+}
+
+// ReadSmallNonceTable deserializes a table written by WriteTo, allocating it
+// at the size it claims to be.
+func ReadSmallNonceTable(r io.Reader) (*SmallNonceTable, error) {
+	buf := bufio.NewReader(r)
+	var magic [8]byte
+	table := &SmallNonceTable{}
+	if _, err := io.ReadFull(buf, magic[:]); err != nil || magic != smallNonceTableMagic {
+		return nil, ErrSmallNonceTable
+	}
+	if err := binary.Read(buf, binary.BigEndian, &table.Size); err != nil {
+		return nil, ErrSmallNonceTable
+	}
+	table.prefixes = make([]uint64, table.Size)
+	table.steps = make([]uint32, table.Size)
+	for i := range table.prefixes {
+		if err := binary.Read(buf, binary.BigEndian, &table.prefixes[i]); err != nil {
+			return nil, ErrSmallNonceTable
+		}
+		if err := binary.Read(buf, binary.BigEndian, &table.steps[i]); err != nil {
+			return nil, ErrSmallNonceTable
+		}
+	}
+	return table, nil
+}
+
+// LoadSmallNonceTable reads the table of the given size from path, computing
+// and saving it there first if it is missing or of a different size.
+func LoadSmallNonceTable(path string, size uint32) (*SmallNonceTable, error) {
+	if table, err := readSmallNonceTableFile(path, size); err == nil {
+		return table, nil
+	}
+
+	log.WithFields(log.Fields{
+		"path": path,
+		"size": size,
+	}).Infoln("Building small nonce table")
+	table := NewSmallNonceTable(size)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := table.WriteTo(f); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// readSmallNonceTableFile reads the table at path, checking its size against
+// the one asked for and the length of the file before allocating it.
+func readSmallNonceTableFile(path string, size uint32) (*SmallNonceTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var header [12]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return nil, ErrSmallNonceTable
+	}
+	if binary.BigEndian.Uint32(header[8:]) != size || info.Size() != 12+12*int64(size) {
+		return nil, ErrSmallNonceTable
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ReadSmallNonceTable(f)
+}
+
+// step is the giant step of a search, 2*Size+1 as the baby steps cover the
+// nonces within Size on either side of it.
+func (table *SmallNonceTable) step() *big.Int {
+	return big.NewInt(2*int64(table.Size) + 1)
+}
+
+// MaxBoundBits returns the largest BoundBits the table can search within
+// maxGiantSteps giant steps.
+func (table *SmallNonceTable) MaxBoundBits() uint {
+	reach := new(big.Int).Mul(table.step(), big.NewInt(maxGiantSteps))
+	return uint(reach.BitLen() - 1)
+}
+
+// Search looks for a nonce k with |k| < bound whose x coordinate is r, with
+// giant steps of 2*Size+1 from -bound to bound away from one of the points
+// having that x coordinate, the other being its negation. As k and -k share
+// their R value, |k| is returned. It gives up on bounds needing more than
+// maxGiantSteps giant steps.
+func (table *SmallNonceTable) Search(r, bound *big.Int) (*big.Int, bool) {
+	curve := btcec.S256()
+	step := table.step()
+	giants := new(big.Int).Quo(bound, step)
+	if giants.Cmp(big.NewInt(maxGiantSteps)) > 0 {
+		return nil, false
+	}
+	key, err := liftX(padTo32(r.Bytes()))
+	if err != nil {
+		return nil, false
+	}
+	sx, sy := curve.ScalarBaseMult(step.Bytes())
+	sy.Sub(curve.P, sy)
+
+	// Q = P - offset*G, from offset = -giants*step up to giants*step
+	offset := new(big.Int).Mul(giants, step)
+	qx, qy := key.X, key.Y
+	if offset.Sign() != 0 {
+		ox, oy := curve.ScalarBaseMult(padTo32(offset.Bytes()))
+		qx, qy = curve.Add(qx, qy, ox, oy)
+	}
+	offset.Neg(offset)
+	count, one := new(big.Int).Lsh(giants, 1), big.NewInt(1)
+	for i := new(big.Int); i.Cmp(count) <= 0; i.Add(i, one) {
+		if qx.Sign() == 0 && qy.Sign() == 0 {
+			if nonceMatches(offset, r) {
+				return new(big.Int).Abs(offset), true
+			}
+		} else {
+			for _, j := range table.lookup(qx) {
+				for _, k := range []*big.Int{
+					new(big.Int).Add(offset, big.NewInt(int64(j))),
+					new(big.Int).Sub(offset, big.NewInt(int64(j))),
+				} {
+					if nonceMatches(k, r) {
+						return k.Abs(k), true
+					}
+				}
+			}
+		}
+		qx, qy = curve.Add(qx, qy, sx, sy)
+		offset.Add(offset, step)
+	}
+	return nil, false
+}
+
+// nonceMatches tells whether k*G has the given R value.
+func nonceMatches(k, r *big.Int) bool {
+	n := btcec.S256().N
+	k = new(big.Int).Mod(k, n)
+	if k.Sign() == 0 {
+		return false
+	}
+	x, _ := btcec.S256().ScalarBaseMult(padTo32(k.Bytes()))
+	return x.Mod(x, n).Cmp(new(big.Int).Mod(r, n)) == 0
+}
+
+var (
+	knownBadOnce   sync.Once
+	knownBadNonces map[string]*big.Int
+)
+
+// KnownBadNonces returns nonces that have been seen used in the wild or that
+// a broken signer would plausibly produce: 1/2 and -1/2, whose R has a famously
+// short x coordinate, and the powers of two along with the ones below them.
+// They are indexed by the R value they produce.
+func KnownBadNonces() map[string]*big.Int {
+	knownBadOnce.Do(func() {
+		n := btcec.S256().N
+		half := new(big.Int).ModInverse(big.NewInt(2), n)
+		nonces := []*big.Int{half, new(big.Int).Sub(n, half)}
+		for i := uint(0); i < 256; i++ {
+			power := new(big.Int).Lsh(big.NewInt(1), i)
+			nonces = append(nonces, power, new(big.Int).Sub(power, big.NewInt(1)))
+		}
+
+		knownBadNonces = make(map[string]*big.Int)
+		for _, k := range nonces {
+			k.Mod(k, n)
+			if k.Sign() == 0 {
+				continue
+			}
+			x, _ := btcec.S256().ScalarBaseMult(padTo32(k.Bytes()))
+			knownBadNonces[string(x.Mod(x, n).Bytes())] = k
+		}
+	})
+	return knownBadNonces
+}
+
+// SmallNonceSearch configures SolveSmallNonces. Without a Table only the
+// KnownBadNonces are checked.
+type SmallNonceSearch struct {
+	Table *SmallNonceTable
+
+	// BoundBits bounds the search with the table to nonces below 2^BoundBits,
+	// at most the MaxBoundBits of the table
+	BoundBits uint
+}
+
+// SmallNonceResult is a key recovered from a single signature whose nonce
+// has been found.
+type SmallNonceResult struct {
+	Pair  *SHPair
+	Nonce *big.Int
+	Key   *btcec.PrivateKey
+}
+
+// SolveSmallNonces checks the R value of every pair in the bucket against the
+// known bad nonces, and against small nonces when given a table. A single
+// signature with a known nonce gives its key away.
+func (bucket *SHPairBucket) SolveSmallNonces(search SmallNonceSearch) []*SmallNonceResult {
+	n := btcec.S256().N
+	known := KnownBadNonces()
+	var bound *big.Int
+	if search.Table != nil && search.BoundBits > 0 {
+		if max := search.Table.MaxBoundBits(); search.BoundBits > max {
+			log.WithFields(log.Fields{
+				"bits":    search.BoundBits,
+				"maxBits": max,
+			}).Warnln(ErrSmallNonceBound)
+		} else {
+			bound = new(big.Int).Lsh(big.NewInt(1), search.BoundBits)
+		}
+	}
+
+	// R values are only searched once, and keys only reported once
+	nonces := make(map[string]*big.Int)
+	keys := make(map[string]bool)
+	results := make([]*SmallNonceResult, 0)
+	for _, pair := range bucket.snapshot() {
+		if pair.Z == nil {
+			continue
+		}
+		id := string(new(big.Int).Mod(pair.R, n).Bytes())
+		k, searched := nonces[id]
+		if !searched {
+			k = known[id]
+			if k == nil && bound != nil {
+				k, _ = search.Table.Search(pair.R, bound)
+			}
+			nonces[id] = k
+		}
+		if k == nil {
+			continue
+		}
+
+		keyID, err := pair.keyID()
+		if err != nil || keys[keyID] {
+			continue
+		}
+		if priv, err := pair.KeyFromNonce(k); err == nil {
+			keys[keyID] = true
+			results = append(results, &SmallNonceResult{Pair: pair, Nonce: k, Key: priv})
+		}
+	}
+	return results
+}
@@ -0,0 +1,208 @@
+package sighash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// SigHashDefault is the implicit BIP341 hashtype of 64-byte signatures. It
+// commits to the same data as SigHashAll.
+const SigHashDefault txscript.SigHashType = 0x00
+
+// annexTag marks the last witness item as the annex, see BIP341.
+const annexTag = 0x50
+
+var ErrTaprootHashType = errors.New("invalid hashtype for a BIP341 signature")
+
+// TaprootSigHashes holds the BIP341 midstate shared by every input of a txn.
+// Unlike BIP143, it commits to the amounts and scripts of all prevOuts.
+type TaprootSigHashes struct {
+	prevOuts []*wire.TxOut
+
+	shaPrevOuts      [32]byte
+	shaAmounts       [32]byte
+	shaScriptPubKeys [32]byte
+	shaSequences     [32]byte
+	shaOutputs       [32]byte
+}
+
+func NewTaprootSigHashes(msgTx *wire.MsgTx, prevOuts []*wire.TxOut) *TaprootSigHashes {
+	var prevOutsBuf, amountsBuf, scriptsBuf, sequencesBuf, outputsBuf bytes.Buffer
+	for i, txIn := range msgTx.TxIn {
+		prevOutsBuf.Write(txIn.PreviousOutPoint.Hash[:])
+		_ = binary.Write(&prevOutsBuf, binary.LittleEndian, txIn.PreviousOutPoint.Index)
+		_ = binary.Write(&amountsBuf, binary.LittleEndian, prevOuts[i].Value)
+		_ = wire.WriteVarBytes(&scriptsBuf, 0, prevOuts[i].PkScript)
+		_ = binary.Write(&sequencesBuf, binary.LittleEndian, txIn.Sequence)
+	}
+	for _, txOut := range msgTx.TxOut {
+		_ = wire.WriteTxOut(&outputsBuf, 0, 0, txOut)
+	}
+
+	return &TaprootSigHashes{
+		prevOuts:         prevOuts,
+		shaPrevOuts:      sha256.Sum256(prevOutsBuf.Bytes()),
+		shaAmounts:       sha256.Sum256(amountsBuf.Bytes()),
+		shaScriptPubKeys: sha256.Sum256(scriptsBuf.Bytes()),
+		shaSequences:     sha256.Sum256(sequencesBuf.Bytes()),
+		shaOutputs:       sha256.Sum256(outputsBuf.Bytes()),
+	}
+}
+
+// CalcTaprootSigHash computes the BIP341 sighash for a key path spend of the
+// input at idx, observing the given hashtype and the optional annex.
+func CalcTaprootSigHash(sigHashes *TaprootSigHashes, hashType txscript.SigHashType,
+	msgTx *wire.MsgTx, idx int, annex []byte) ([]byte, error) {
+
+	return calcTaprootSigHash(sigHashes, hashType, msgTx, idx, annex, nil)
+}
+
+func calcTaprootSigHash(sigHashes *TaprootSigHashes, hashType txscript.SigHashType,
+	msgTx *wire.MsgTx, idx int, annex []byte, extension []byte) ([]byte, error) {
+
+	switch hashType {
+	case SigHashDefault, txscript.SigHashAll, txscript.SigHashNone, txscript.SigHashSingle,
+		txscript.SigHashAll | txscript.SigHashAnyOneCanPay,
+		txscript.SigHashNone | txscript.SigHashAnyOneCanPay,
+		txscript.SigHashSingle | txscript.SigHashAnyOneCanPay:
+	default:
+		return nil, ErrTaprootHashType
+	}
+	anyoneCanPay := hashType&txscript.SigHashAnyOneCanPay != 0
+	outputType := hashType & 0x03
+	if outputType == txscript.SigHashSingle && idx >= len(msgTx.TxOut) {
+		return nil, ErrTaprootHashType
+	}
+
+	// Epoch, then the common signature message of BIP341
+	var msg bytes.Buffer
+	msg.WriteByte(0x00)
+	msg.WriteByte(byte(hashType))
+	_ = binary.Write(&msg, binary.LittleEndian, msgTx.Version)
+	_ = binary.Write(&msg, binary.LittleEndian, msgTx.LockTime)
+	if !anyoneCanPay {
+		msg.Write(sigHashes.shaPrevOuts[:])
+		msg.Write(sigHashes.shaAmounts[:])
+		msg.Write(sigHashes.shaScriptPubKeys[:])
+		msg.Write(sigHashes.shaSequences[:])
+	}
+	if outputType != txscript.SigHashNone && outputType != txscript.SigHashSingle {
+		msg.Write(sigHashes.shaOutputs[:])
+	}
+
+	spendType := byte(0)
+	if extension != nil {
+		spendType |= 0x02
+	}
+	if annex != nil {
+		spendType |= 0x01
+	}
+	msg.WriteByte(spendType)
+
+	txIn := msgTx.TxIn[idx]
+	if anyoneCanPay {
+		prevOut := sigHashes.prevOuts[idx]
+		msg.Write(txIn.PreviousOutPoint.Hash[:])
+		_ = binary.Write(&msg, binary.LittleEndian, txIn.PreviousOutPoint.Index)
+		_ = binary.Write(&msg, binary.LittleEndian, prevOut.Value)
+		_ = wire.WriteVarBytes(&msg, 0, prevOut.PkScript)
+		_ = binary.Write(&msg, binary.LittleEndian, txIn.Sequence)
+	} else {
+		_ = binary.Write(&msg, binary.LittleEndian, uint32(idx))
+	}
+
+	if annex != nil {
+		var annexBuf bytes.Buffer
+		_ = wire.WriteVarBytes(&annexBuf, 0, annex)
+		shaAnnex := sha256.Sum256(annexBuf.Bytes())
+		msg.Write(shaAnnex[:])
+	}
+	if outputType == txscript.SigHashSingle {
+		var outputBuf bytes.Buffer
+		_ = wire.WriteTxOut(&outputBuf, 0, 0, msgTx.TxOut[idx])
+		shaOutput := sha256.Sum256(outputBuf.Bytes())
+		msg.Write(shaOutput[:])
+	}
+	msg.Write(extension)
+
+	return TaggedHash("TapSighash", msg.Bytes()), nil
+}
+
+// splitAnnex separates the optional annex from the rest of a Taproot witness.
+func splitAnnex(witness wire.TxWitness) (wire.TxWitness, []byte) {
+	if len(witness) >= 2 {
+		last := witness[len(witness)-1]
+		if len(last) > 0 && last[0] == annexTag {
+			return witness[:len(witness)-1], last
+		}
+	}
+	return witness, nil
+}
+
+// schnorrSig is a BIP340 signature along with its BIP341 hashtype.
+type schnorrSig struct {
+	R, S     *big.Int
+	hashType txscript.SigHashType
+}
+
+// parseSchnorrSig parses a 64-byte signature, or a 65-byte one which carries
+// an explicit non-default hashtype.
+func parseSchnorrSig(push []byte) (*schnorrSig, error) {
+	hashType := SigHashDefault
+	switch len(push) {
+	case 64:
+	case 65:
+		hashType = txscript.SigHashType(push[64])
+		if hashType == SigHashDefault {
+			return nil, WarnSigParseSkip
+		}
+	default:
+		return nil, WarnSigParseSkip
+	}
+	return &schnorrSig{
+		R:        new(big.Int).SetBytes(push[:32]),
+		S:        new(big.Int).SetBytes(push[32:64]),
+		hashType: hashType,
+	}, nil
+}
+
+// extractTaproot handles spends of witness v1 outputs. Key path spends carry
+// a single signature for the x-only output key, script path spends are left
+// to extractTapscript.
+func extractTaproot(tc *txContext, i int, pkScript []byte) ([]*SHPair, error) {
+	outputKey := pkScript[2:34]
+	stack, annex := splitAnnex(tc.msgTx.TxIn[i].Witness)
+	if len(stack) == 0 {
+		return nil, WarnWitnessStackSkip
+	}
+	if len(stack) >= 2 {
+		return extractTapscript(tc, i, stack, annex, outputKey)
+	}
+	sig, err := parseSchnorrSig(stack[0])
+	if err != nil {
+		return nil, err
+	}
+
+	sigHashes, err := tc.taprootSigHashes()
+	if err != nil {
+		return nil, err
+	}
+	z, err := CalcTaprootSigHash(sigHashes, sig.hashType, tc.msgTx, i, annex)
+	if err != nil {
+		return nil, WarnFailedZValExtract
+	}
+	return []*SHPair{{
+		PublicKey: outputKey,
+		R:         sig.R,
+		S:         sig.S,
+		Z:         z,
+		HashType:  sig.hashType,
+		Type:      SigTypeSchnorr,
+	}}, nil
+}
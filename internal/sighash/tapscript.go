@@ -0,0 +1,165 @@
+package sighash
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// TapscriptLeafVersion is the BIP342 leaf version, the only one with
+	// defined semantics
+	TapscriptLeafVersion = 0xc0
+
+	// opCheckSigAdd is the BIP342 opcode, OP_UNKNOWN186 to txscript
+	opCheckSigAdd = 0xba
+
+	// blankCodeSepPos is committed to when no OP_CODESEPARATOR was executed
+	blankCodeSepPos = 0xffffffff
+
+	controlBlockBaseSize = 33
+	controlBlockNodeSize = 32
+	controlBlockMaxNodes = 128
+)
+
+// TapLeafHash computes the BIP341 tagged hash of a leaf script.
+func TapLeafHash(leafVersion byte, script []byte) []byte {
+	var leaf bytes.Buffer
+	leaf.WriteByte(leafVersion)
+	_ = wire.WriteVarBytes(&leaf, 0, script)
+	return TaggedHash("TapLeaf", leaf.Bytes())
+}
+
+// CalcTapscriptSigHash computes the BIP342 sighash for a signature checked by
+// a script path spend of the input at idx. It extends the BIP341 message with
+// the leaf hash and the position of the last executed OP_CODESEPARATOR.
+func CalcTapscriptSigHash(sigHashes *TaprootSigHashes, hashType txscript.SigHashType,
+	msgTx *wire.MsgTx, idx int, annex []byte, leafHash []byte, codeSepPos uint32) ([]byte, error) {
+
+	extension := make([]byte, 0, 37)
+	extension = append(extension, leafHash...)
+	extension = append(extension, 0x00) // key_version
+	extension = append(extension, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(extension[33:], codeSepPos)
+	return calcTaprootSigHash(sigHashes, hashType, msgTx, idx, annex, extension)
+}
+
+// verifyControlBlock checks that the control block proves leafHash to be
+// committed to by the output key, i.e. Q = P + int(hash_TapTweak(P || root))*G.
+func verifyControlBlock(controlBlock, leafHash, outputKey []byte) bool {
+	internalKey, err := liftX(controlBlock[1:controlBlockBaseSize])
+	if err != nil {
+		return false
+	}
+
+	node := leafHash
+	for offs := controlBlockBaseSize; offs < len(controlBlock); offs += controlBlockNodeSize {
+		sibling := controlBlock[offs : offs+controlBlockNodeSize]
+		if bytes.Compare(node, sibling) < 0 {
+			node = TaggedHash("TapBranch", node, sibling)
+		} else {
+			node = TaggedHash("TapBranch", sibling, node)
+		}
+	}
+
+	curve := btcec.S256()
+	tweak := TaggedHash("TapTweak", controlBlock[1:controlBlockBaseSize], node)
+	tweakX, tweakY := curve.ScalarBaseMult(tweak)
+	qX, qY := curve.Add(internalKey.X, internalKey.Y, tweakX, tweakY)
+	return bytes.Equal(padTo32(qX.Bytes()), outputKey) && qY.Bit(0) == uint(controlBlock[0]&0x01)
+}
+
+// tapSigOp is a signature check in a leaf script against a pushed key.
+type tapSigOp struct {
+	key        []byte
+	codeSepPos uint32
+}
+
+// extractTapscript handles script path spends, where the stack ends with the
+// leaf script and the control block. Each signature on the stack is paired
+// with the key of the CHECKSIG, CHECKSIGVERIFY or CHECKSIGADD it verifies for.
+func extractTapscript(tc *txContext, i int, stack wire.TxWitness, annex, outputKey []byte) ([]*SHPair, error) {
+	controlBlock, leafScript := stack[len(stack)-1], stack[len(stack)-2]
+	if len(controlBlock) < controlBlockBaseSize ||
+		(len(controlBlock)-controlBlockBaseSize)%controlBlockNodeSize != 0 ||
+		(len(controlBlock)-controlBlockBaseSize)/controlBlockNodeSize > controlBlockMaxNodes {
+		return nil, WarnControlBlockSkip
+	}
+	leafVersion := controlBlock[0] & 0xfe
+	if leafVersion != TapscriptLeafVersion {
+		return nil, WarnLeafVersionSkip
+	}
+	leafHash := TapLeafHash(leafVersion, leafScript)
+	if !verifyControlBlock(controlBlock, leafHash, outputKey) {
+		return nil, WarnControlBlockSkip
+	}
+
+	ops, err := parseScript(leafScript)
+	if err != nil {
+		return nil, WarnWitnessScriptSkip
+	}
+	sigOps := make([]tapSigOp, 0)
+	codeSepPos := uint32(blankCodeSepPos)
+	for pos, op := range ops {
+		switch op.opcode {
+		case txscript.OP_CODESEPARATOR:
+			codeSepPos = uint32(pos)
+		case txscript.OP_CHECKSIG, txscript.OP_CHECKSIGVERIFY, opCheckSigAdd:
+			if pos > 0 && len(ops[pos-1].data) == 32 {
+				sigOps = append(sigOps, tapSigOp{ops[pos-1].data, codeSepPos})
+			}
+		}
+	}
+	if len(sigOps) == 0 {
+		return nil, WarnKeyParseSkip
+	}
+
+	sigHashes, err := tc.taprootSigHashes()
+	if err != nil {
+		return nil, err
+	}
+	type zKey struct {
+		hashType   txscript.SigHashType
+		codeSepPos uint32
+	}
+	zCache := make(map[zKey][]byte)
+
+	pairs := make([]*SHPair, 0)
+	for _, item := range stack[:len(stack)-2] {
+		sig, err := parseSchnorrSig(item)
+		if err != nil {
+			continue
+		}
+		for _, sigOp := range sigOps {
+			cacheKey := zKey{sig.hashType, sigOp.codeSepPos}
+			z, ok := zCache[cacheKey]
+			if !ok {
+				z, err = CalcTapscriptSigHash(sigHashes, sig.hashType, tc.msgTx, i,
+					annex, leafHash, sigOp.codeSepPos)
+				if err != nil {
+					break
+				}
+				zCache[cacheKey] = z
+			}
+			if !VerifySchnorr(sigOp.key, z, sig.R, sig.S) {
+				continue
+			}
+			pairs = append(pairs, &SHPair{
+				PublicKey: sigOp.key,
+				R:         sig.R,
+				S:         sig.S,
+				Z:         z,
+				HashType:  sig.hashType,
+				Type:      SigTypeSchnorr,
+			})
+			break
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, WarnNoSigMatchSkip
+	}
+	return pairs, nil
+}
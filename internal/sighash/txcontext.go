@@ -0,0 +1,76 @@
+package sighash
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/canselcik/nonced/internal/provider"
+)
+
+// txContext caches what the inputs of a txn share while it's being added to
+// the bucket, so that prevOuts are fetched and sighash midstates are computed
+// at most once per txn.
+type txContext struct {
+	msgTx        *wire.MsgTx
+	infoProvider provider.DataProvider
+
+	prevOuts     []*wire.TxOut
+	sigHashes    *txscript.TxSigHashes
+	tapSigHashes *TaprootSigHashes
+}
+
+func newTxContext(msgTx *wire.MsgTx, infoProvider provider.DataProvider) *txContext {
+	return &txContext{
+		msgTx:        msgTx,
+		infoProvider: infoProvider,
+		prevOuts:     make([]*wire.TxOut, len(msgTx.TxIn)),
+	}
+}
+
+func (tc *txContext) prevOut(i int) (*wire.TxOut, error) {
+	if tc.prevOuts[i] != nil {
+		return tc.prevOuts[i], nil
+	}
+
+	outpoint := tc.msgTx.TxIn[i].PreviousOutPoint
+	prevTx, err := tc.infoProvider.GetTransaction(&outpoint.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if prevTx == nil || int(outpoint.Index) >= len(prevTx.MsgTx().TxOut) {
+		return nil, WarnCantFindPrevOut
+	}
+	tc.prevOuts[i] = prevTx.MsgTx().TxOut[outpoint.Index]
+	return tc.prevOuts[i], nil
+}
+
+// allPrevOuts fetches the prevOut of every input, which BIP341 commits to.
+func (tc *txContext) allPrevOuts() ([]*wire.TxOut, error) {
+	for i := range tc.msgTx.TxIn {
+		if _, err := tc.prevOut(i); err != nil {
+			return nil, err
+		}
+	}
+	return tc.prevOuts, nil
+}
+
+// witnessSigHashes returns the BIP143 midstate shared by every witness v0
+// input of the txn.
+func (tc *txContext) witnessSigHashes() *txscript.TxSigHashes {
+	if tc.sigHashes == nil {
+		tc.sigHashes = txscript.NewTxSigHashes(tc.msgTx)
+	}
+	return tc.sigHashes
+}
+
+// taprootSigHashes returns the BIP341 midstate shared by every Taproot input
+// of the txn.
+func (tc *txContext) taprootSigHashes() (*TaprootSigHashes, error) {
+	if tc.tapSigHashes == nil {
+		prevOuts, err := tc.allPrevOuts()
+		if err != nil {
+			return nil, err
+		}
+		tc.tapSigHashes = NewTaprootSigHashes(tc.msgTx, prevOuts)
+	}
+	return tc.tapSigHashes, nil
+}
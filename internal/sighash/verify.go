@@ -0,0 +1,91 @@
+package sighash
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// VerifyResult is the outcome of verifying the signature of a pair.
+type VerifyResult int
+
+const (
+	VerifyOK VerifyResult = iota
+
+	// VerifyMissingZ pairs have no Z value to verify against
+	VerifyMissingZ
+
+	// VerifyOutOfRange pairs have an R or S value outside of the range a
+	// valid signature can have
+	VerifyOutOfRange
+
+	// VerifyBadKey pairs have a public key that does not parse
+	VerifyBadKey
+
+	// VerifyMismatch pairs have a signature that does not verify against
+	// their public key and Z, which hints at a wrong sighash
+	VerifyMismatch
+)
+
+var verifyResultNames = map[VerifyResult]string{
+	VerifyOK:         "ok",
+	VerifyMissingZ:   "missing-z",
+	VerifyOutOfRange: "out-of-range",
+	VerifyBadKey:     "bad-key",
+	VerifyMismatch:   "mismatch",
+}
+
+func (result VerifyResult) String() string {
+	if name, ok := verifyResultNames[result]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(result))
+}
+
+// WarnVerifySkip is the warning for inputs whose every signature was
+// rejected by a strict bucket, Result telling why the last one was.
+type WarnVerifySkip struct {
+	Result VerifyResult
+}
+
+func (warn *WarnVerifySkip) Error() string {
+	return "skipping due to signature failing verification: " + warn.Result.String()
+}
+
+// verify checks the signature of the pair against its public key and Z,
+// telling why it failed if it did.
+func (pair *SHPair) verify() VerifyResult {
+	curve := btcec.S256()
+	if pair.Z == nil {
+		return VerifyMissingZ
+	}
+	if pair.R == nil || pair.S == nil || pair.R.Sign() <= 0 || pair.S.Sign() < 0 || pair.S.Cmp(curve.N) >= 0 {
+		return VerifyOutOfRange
+	}
+
+	if pair.Type == SigTypeSchnorr {
+		if pair.R.Cmp(curve.P) >= 0 {
+			return VerifyOutOfRange
+		}
+		if _, err := liftX(pair.PublicKey); err != nil {
+			return VerifyBadKey
+		}
+		if !VerifySchnorr(pair.PublicKey, pair.Z, pair.R, pair.S) {
+			return VerifyMismatch
+		}
+		return VerifyOK
+	}
+
+	if pair.R.Cmp(curve.N) >= 0 || pair.S.Sign() == 0 {
+		return VerifyOutOfRange
+	}
+	pubKey, err := btcec.ParsePubKey(pair.PublicKey, curve)
+	if err != nil {
+		return VerifyBadKey
+	}
+	if !ecdsa.Verify(pubKey.ToECDSA(), pair.Z, pair.R, pair.S) {
+		return VerifyMismatch
+	}
+	return VerifyOK
+}
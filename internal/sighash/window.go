@@ -0,0 +1,165 @@
+package sighash
+
+import (
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Window bounds the pairs a long-lived bucket keeps, such as the one a stream
+// checks every new signature against. Zero values leave it unbounded.
+type Window struct {
+	// MaxPairs is the number of pairs kept, new ones being checked against
+	// all of them before the oldest are evicted
+	MaxPairs int
+
+	// MaxAge is how long pairs are kept after being added
+	MaxAge time.Duration
+
+	// Now is the clock pairs are aged by, time.Now unless set otherwise
+	Now func() time.Time
+}
+
+func (window Window) now() time.Time {
+	if window.Now != nil {
+		return window.Now()
+	}
+	return time.Now()
+}
+
+// Evict drops the pairs falling out of the window of the bucket, returning
+// how many were dropped. AddTx evicts on its own, which leaves this to evict
+// by age while nothing is being added.
+func (bucket *SHPairBucket) Evict() int {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.syncIndex()
+	return bucket.evict()
+}
+
+// evict drops the oldest pairs until the bucket fits its window, along
+// with the duplicates and recoveries referencing them. Keys whose recoveries
+// were dropped are looked for again. The caller must hold the lock.
+func (bucket *SHPairBucket) evict() int {
+	drop := 0
+	if max := bucket.Window.MaxPairs; max > 0 && bucket.indexed > max {
+		drop = bucket.indexed - max
+	}
+	if bucket.Window.MaxAge > 0 {
+		cutoff := bucket.Window.now().Add(-bucket.Window.MaxAge)
+		for drop < len(bucket.addedAt) && bucket.addedAt[drop].Before(cutoff) {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return 0
+	}
+
+	dropped := make(map[*SHPair]bool, drop)
+	for _, pair := range bucket.Pairs[:drop] {
+		bucket.unindex(pair)
+		dropped[pair] = true
+	}
+	bucket.Pairs = bucket.Pairs[drop:]
+	bucket.addedAt = bucket.addedAt[drop:]
+	bucket.indexed -= drop
+	bucket.Evicted += drop
+	bucket.prune(dropped)
+	return drop
+}
+
+// prune drops the duplicates of evicted pairs, and the recoveries none of
+// whose pairs are left, so that a long-lived bucket does not hold on to them.
+// A key recovered by a pair evicting the one it reused the nonce of is kept.
+func (bucket *SHPairBucket) prune(dropped map[*SHPair]bool) {
+	var reuse []*DuplicateSig
+	for _, dup := range bucket.UnexploitableReuse {
+		if !dropped[dup.Kept] {
+			reuse = append(reuse, dup)
+		}
+	}
+	bucket.UnexploitableReuse = reuse
+
+	var kept []*Recovery
+	for _, rec := range bucket.reuse {
+		evicted := true
+		for _, pair := range rec.Pairs {
+			evicted = evicted && !bucket.holds(pair)
+		}
+		if !evicted {
+			kept = append(kept, rec)
+			continue
+		}
+		if id, err := rec.Pairs[0].keyID(); err == nil {
+			delete(bucket.recovered, id)
+		}
+	}
+	bucket.reuse = kept
+	for _, rec := range bucket.reuse {
+		if id, err := rec.Pairs[0].keyID(); err == nil {
+			bucket.recovered[id] = true
+		}
+	}
+}
+
+// unindex removes an evicted pair from the indexes of the bucket.
+func (bucket *SHPairBucket) unindex(pair *SHPair) {
+	bucket.byTx[pair.TxID] = removePair(bucket.byTx[pair.TxID], pair)
+	if len(bucket.byTx[pair.TxID]) == 0 {
+		delete(bucket.byTx, pair.TxID)
+	}
+
+	id, err := pair.keyID()
+	if err != nil || pair.R == nil {
+		return
+	}
+	ck := collisionKey{r: string(pair.R.Bytes()), key: id}
+	bucket.collisions[ck] = removePair(bucket.collisions[ck], pair)
+	if len(bucket.collisions[ck]) == 0 {
+		delete(bucket.collisions, ck)
+	}
+}
+
+// holds tells whether the pair is in the bucket, the caller holding the lock.
+func (bucket *SHPairBucket) holds(pair *SHPair) bool {
+	for _, p := range bucket.byTx[pair.TxID] {
+		if p == pair {
+			return true
+		}
+	}
+	return false
+}
+
+func removePair(pairs []*SHPair, pair *SHPair) []*SHPair {
+	for i, p := range pairs {
+		if p == pair {
+			return append(pairs[:i:i], pairs[i+1:]...)
+		}
+	}
+	return pairs
+}
+
+// HasTx tells whether pairs extracted from the transaction are in the bucket,
+// to skip transactions seen in the mempool once they are mined.
+func (bucket *SHPairBucket) HasTx(txid chainhash.Hash) bool {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.syncIndex()
+	return len(bucket.byTx[txid]) != 0
+}
+
+// PairsForTx returns the pairs in the bucket extracted from the transaction.
+func (bucket *SHPairBucket) PairsForTx(txid chainhash.Hash) []*SHPair {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.syncIndex()
+	return append([]*SHPair(nil), bucket.byTx[txid]...)
+}
+
+// Len returns the number of pairs in the bucket.
+func (bucket *SHPairBucket) Len() int {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.syncIndex()
+	return len(bucket.Pairs)
+}
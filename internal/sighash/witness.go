@@ -0,0 +1,169 @@
+package sighash
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+)
+
+// extractP2WPKH handles native and wrapped P2WPKH spends, whose witness holds
+// the signature and the compressed key. Z is computed with BIP143, which
+// commits to the amount of the prevOut.
+func extractP2WPKH(tc *txContext, i int, program []byte, amount int64) ([]*SHPair, error) {
+	witness := tc.msgTx.TxIn[i].Witness
+	if len(witness) != 2 {
+		return nil, WarnWitnessStackSkip
+	}
+
+	sig, err := parseSigPush(witness[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := btcec.ParsePubKey(witness[1], btcec.S256())
+	if err != nil {
+		return nil, WarnKeyParseSkip
+	}
+	if !bytes.Equal(btcutil.Hash160(witness[1]), program[2:]) {
+		return nil, WarnKeyHashSkip
+	}
+
+	z, err := txscript.CalcWitnessSigHash(program, tc.witnessSigHashes(),
+		sig.hashType, tc.msgTx, i, amount)
+	if err != nil {
+		return nil, WarnFailedZValExtract
+	}
+	return []*SHPair{{
+		PublicKey: key.SerializeUncompressed(),
+		R:         sig.R,
+		S:         sig.S,
+		Z:         z,
+		HashType:  sig.hashType,
+	}}, nil
+}
+
+// extractP2WSH handles spends where the last witness item is the witness
+// script. The keys can either be embedded in the script (P2PK, m-of-n) or be
+// pushed onto the stack alongside the signatures (P2PKH style), so every
+// signature on the stack is matched against every candidate key.
+func extractP2WSH(tc *txContext, i int, program []byte, amount int64) ([]*SHPair, error) {
+	witness := tc.msgTx.TxIn[i].Witness
+	if len(witness) < 2 {
+		return nil, WarnWitnessStackSkip
+	}
+	witnessScript := witness[len(witness)-1]
+	scriptHash := sha256.Sum256(witnessScript)
+	if !bytes.Equal(scriptHash[:], program[2:]) {
+		return nil, WarnWitnessScriptSkip
+	}
+
+	ops, err := parseScript(witnessScript)
+	if err != nil {
+		return nil, WarnWitnessScriptSkip
+	}
+	stack := witness[:len(witness)-1]
+	keys := parsePubKeys(append(pushedData(ops), stack...))
+	if len(keys) == 0 {
+		return nil, WarnKeyParseSkip
+	}
+
+	calcZ := func(hashType txscript.SigHashType) ([]byte, error) {
+		return txscript.CalcWitnessSigHash(witnessScript, tc.witnessSigHashes(),
+			hashType, tc.msgTx, i, amount)
+	}
+	pairs, err := matchSignatures(parseSignatures(stack), keys, calcZ)
+	if err != nil {
+		return nil, WarnFailedZValExtract
+	}
+	if len(pairs) == 0 {
+		return nil, WarnNoSigMatchSkip
+	}
+	return pairs, nil
+}
+
+// parsePubKeys returns every push that parses as a public key.
+func parsePubKeys(pushes [][]byte) []*btcec.PublicKey {
+	keys := make([]*btcec.PublicKey, 0)
+	for _, push := range pushes {
+		if len(push) != 33 && len(push) != 65 {
+			continue
+		}
+		key, err := btcec.ParsePubKey(push, btcec.S256())
+		if err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sigPush is a signature along with the hashtype byte appended to it.
+type sigPush struct {
+	*btcec.Signature
+	hashType txscript.SigHashType
+}
+
+// parseSigPush splits the trailing hashtype byte off a pushed signature and
+// parses the remaining DER-ish encoding.
+func parseSigPush(push []byte) (*sigPush, error) {
+	if len(push) < 2 {
+		return nil, WarnSigParseSkip
+	}
+	sig, err := btcec.ParseSignature(push[:len(push)-1], btcec.S256())
+	if err != nil {
+		return nil, WarnSigParseSkip
+	}
+	return &sigPush{sig, txscript.SigHashType(push[len(push)-1])}, nil
+}
+
+// parseSignatures returns every push that parses as a DER-ish signature.
+func parseSignatures(pushes [][]byte) []*sigPush {
+	sigs := make([]*sigPush, 0)
+	for _, push := range pushes {
+		if len(push) < 9 || push[0] != 0x30 {
+			continue
+		}
+		sig, err := parseSigPush(push)
+		if err == nil {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// matchSignatures pairs each signature with the key it verifies against,
+// dropping the ones that don't verify against any of them. Z is computed by
+// calcZ once per distinct hashtype among the signatures.
+func matchSignatures(sigs []*sigPush, keys []*btcec.PublicKey,
+	calcZ func(txscript.SigHashType) ([]byte, error)) ([]*SHPair, error) {
+
+	zByHashType := make(map[txscript.SigHashType][]byte)
+	pairs := make([]*SHPair, 0, len(sigs))
+	for _, sig := range sigs {
+		z, ok := zByHashType[sig.hashType]
+		if !ok {
+			var err error
+			z, err = calcZ(sig.hashType)
+			if err != nil {
+				return nil, err
+			}
+			zByHashType[sig.hashType] = z
+		}
+
+		for _, key := range keys {
+			if !sig.Verify(z, key) {
+				continue
+			}
+			pairs = append(pairs, &SHPair{
+				PublicKey: key.SerializeUncompressed(),
+				R:         sig.R,
+				S:         sig.S,
+				Z:         z,
+				HashType:  sig.hashType,
+			})
+			break
+		}
+	}
+	return pairs, nil
+}
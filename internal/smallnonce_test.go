@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallNonces(t *testing.T) {
+	n := btcec.S256().N
+	halfKey := testPrivKey()
+	oneKey, _ := btcec.NewPrivateKey(btcec.S256())
+	smallKey, _ := btcec.NewPrivateKey(btcec.S256())
+	schnorrKey, _ := btcec.NewPrivateKey(btcec.S256())
+	safeKey, _ := btcec.NewPrivateKey(btcec.S256())
+
+	// -1/2, whose R is the well known 3b78ce56...
+	minusHalf := new(big.Int).Sub(n, new(big.Int).ModInverse(big.NewInt(2), n))
+	halfPair := ecdsaPair(halfKey, "half", minusHalf)
+	assert.Equal(t, "3b78ce563f89a0ed9414f5aa28ad0d96d6795f9c63",
+		hex.EncodeToString(halfPair.R.Bytes()), "unexpected R for -1/2")
+
+	msg := sha256.Sum256([]byte("schnorr"))
+	schnorrSig := signSchnorrWithNonce(schnorrKey, msg[:], big.NewInt(0x5a5a5a), sighash.SigHashDefault)
+
+	bucket := sighash.NewSHPairBucket(nil)
+	bucket.Pairs = append(bucket.Pairs,
+		halfPair,
+		ecdsaPair(oneKey, "one", big.NewInt(1)),
+		ecdsaPair(smallKey, "small", big.NewInt(0xabcdef)),
+		ecdsaPair(smallKey, "small again", big.NewInt(0xabcdef)),
+		&sighash.SHPair{
+			R:         new(big.Int).SetBytes(schnorrSig[:32]),
+			S:         new(big.Int).SetBytes(schnorrSig[32:]),
+			Z:         msg[:],
+			PublicKey: xOnly(schnorrKey.PubKey()),
+			Type:      sighash.SigTypeSchnorr,
+		},
+		ecdsaPair(safeKey, "safe", testNonce),
+	)
+
+	// Only the known bad nonces without a table
+	results := bucket.SolveSmallNonces(sighash.SmallNonceSearch{})
+	if assert.Equal(t, 2, len(results), "wrong number of known nonce results") {
+		assert.Equal(t, testPrivHex, hex.EncodeToString(results[0].Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, hex.EncodeToString(oneKey.Serialize()),
+			hex.EncodeToString(results[1].Key.Serialize()), "derived incorrect privateKey")
+	}
+
+	// The table is computed once, and then read back from disk
+	dir, err := ioutil.TempDir("", "nonced")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bsgs.bin")
+	_, err = sighash.LoadSmallNonceTable(path, 1<<10)
+	assert.NoError(t, err)
+	table, err := sighash.LoadSmallNonceTable(path, 1<<10)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	results = bucket.SolveSmallNonces(sighash.SmallNonceSearch{Table: table, BoundBits: 24})
+	if assert.Equal(t, 4, len(results), "wrong number of small nonce results") {
+		assert.Equal(t, hex.EncodeToString(smallKey.Serialize()),
+			hex.EncodeToString(results[2].Key.Serialize()), "derived incorrect privateKey")
+		assert.Equal(t, int64(0xabcdef), results[2].Nonce.Int64(), "derived incorrect nonce")
+		assert.Equal(t, hex.EncodeToString(xOnly(schnorrKey.PubKey())),
+			hex.EncodeToString(xOnly(results[3].Key.PubKey())), "derived incorrect privateKey")
+	}
+
+	_, found := table.Search(bucket.Pairs[len(bucket.Pairs)-1].R, new(big.Int).Lsh(big.NewInt(1), 24))
+	assert.False(t, found, "found a nonce out of bounds")
+
+	// Either sign of nonces on both sides of a giant step, and on one
+	bound := new(big.Int).Lsh(big.NewInt(1), 24)
+	for _, k := range []*big.Int{
+		big.NewInt(2), big.NewInt(2049 * 3), big.NewInt(2049*3 + 7), big.NewInt(0xfff000),
+		new(big.Int).Sub(n, big.NewInt(0xabcdef)), new(big.Int).Sub(n, big.NewInt(2049*5)),
+	} {
+		x, _ := btcec.S256().ScalarBaseMult(k.Bytes())
+		found, ok := table.Search(x, bound)
+		if assert.True(t, ok, "missed nonce %x", k) {
+			assert.True(t, found.Cmp(bound) < 0, "found a nonce out of bounds for %x", k)
+			fx, _ := btcec.S256().ScalarBaseMult(found.Bytes())
+			assert.Equal(t, x, fx, "found the wrong nonce for %x", k)
+		}
+	}
+
+	// Bounds the table cannot reach are not searched
+	assert.Equal(t, uint(43), table.MaxBoundBits(), "wrong reach of the table")
+	_, found = table.Search(halfPair.R, new(big.Int).Lsh(big.NewInt(1), 60))
+	assert.False(t, found, "searched a bound out of reach")
+	results = bucket.SolveSmallNonces(sighash.SmallNonceSearch{Table: table, BoundBits: 60})
+	assert.Equal(t, 2, len(results), "searched a bound out of reach")
+
+	// A table claiming another size is rebuilt rather than read
+	header := append([]byte("noncedbs"), 0xff, 0xff, 0xff, 0xff)
+	assert.NoError(t, ioutil.WriteFile(path, header, 0644))
+	table, err = sighash.LoadSmallNonceTable(path, 1<<10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint32(1<<10), table.Size, "wrong table size")
+	}
+}
@@ -1,7 +1,126 @@
 package storage
 
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// Entry is a stored signature. Signatures stored with PutEntry leave the
+// input they came from unknown, with InputIndex, BlockHeight and TxIndex at
+// -1. TxIndex is the position of the transaction in the block.
+type Entry struct {
+	SrcTxn string `db:"srctxn"`
+	PubKey []byte `db:"pubkey"`
+	Z      []byte `db:"z"`
+	R      []byte `db:"r"`
+	S      []byte `db:"s"`
+
+	InputIndex  int    `db:"input_index"`
+	HashType    uint32 `db:"sighash_type"`
+	ScriptType  string `db:"script_type"`
+	BlockHash   string `db:"block_hash"`
+	BlockHeight int32  `db:"block_height"`
+	TxIndex     int    `db:"tx_index"`
+}
+
+// Collision is an R value stored with more than one Z, along with the
+// signatures using it.
+type Collision struct {
+	R       []byte
+	Entries []*Entry
+}
+
+// RecoveredKey is a private key recovered from stored signatures, with the
+// way it was recovered and the transactions of the signatures it came from.
+type RecoveredKey struct {
+	PubKey   []byte    `db:"pubkey" json:"pubkey"`
+	PrivKey  []byte    `db:"privkey" json:"privkey"`
+	Method   string    `db:"method" json:"method"`
+	R        []byte    `db:"r" json:"r"`
+	Nonce    []byte    `db:"nonce" json:"nonce"`
+	SrcTxns  []string  `db:"srctxns" json:"srctxns"`
+	Verified bool      `db:"verified" json:"verified"`
+	FoundAt  time.Time `db:"found_at" json:"foundAt"`
+}
+
 type Storage interface {
+	// PutEntry stores a signature, with its S value in low form unless it
+	// is a Schnorr signature with an x-only pubkey. Signatures with the same
+	// pubkey, R and Z as a stored one are dropped.
 	PutEntry(srctxn string, pubkey, z, r, s []byte) error
+
+	// PutSignature stores a signature like PutEntry, along with the input
+	// and block it came from where the store keeps them.
+	PutSignature(entry *Entry) error
+
+	FindByR(r []byte) ([]*Entry, error)
+	FindByPubKey(pubkey []byte) ([]*Entry, error)
+
+	// FindCollisions returns every R value stored with more than one Z,
+	// under any pubkey.
+	FindCollisions() ([]*Collision, error)
+
+	// ForEachEntry calls fn with every signature stored for the pubkey
+	// without loading them all at once, stopping at the first error.
+	ForEachEntry(pubkey []byte, fn func(entry *Entry) error) error
+
+	// ForEachPubKey calls fn with every pubkey having stored signatures,
+	// stopping at the first error.
+	ForEachPubKey(fn func(pubkey []byte) error) error
+
+	// PutRecovery records a recovered key. Recording the same key with the
+	// same method again does nothing.
+	PutRecovery(rec *RecoveredKey) error
+	Recoveries() ([]*RecoveredKey, error)
+}
+
+// CanonicalS returns the low form of the S value of an ECDSA signature, n - S
+// when S is above n/2, and S untouched for Schnorr signatures which are told
+// apart by their 32 byte pubkey.
+func CanonicalS(pubkey, s []byte) []byte {
+	if len(pubkey) == 32 {
+		return s
+	}
+	n := btcec.S256().N
+	value := new(big.Int).SetBytes(s)
+	if value.Cmp(new(big.Int).Rsh(n, 1)) <= 0 {
+		return s
+	}
+	return value.Sub(n, value).Bytes()
+}
+
+// groupCollisions groups entries into the R values having more than one
+// distinct Z. R values are compared padded, so that stores keeping them with
+// and without leading zeros agree.
+func groupCollisions(entries []*Entry) []*Collision {
+	sorted := append([]*Entry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(pad32(sorted[i].R), pad32(sorted[j].R)) < 0
+	})
+	collisions := make([]*Collision, 0)
+	for start := 0; start < len(sorted); {
+		r := pad32(sorted[start].R)
+		end := start + 1
+		for end < len(sorted) && bytes.Equal(pad32(sorted[end].R), r) {
+			end++
+		}
+		zs := make(map[string]bool)
+		for _, entry := range sorted[start:end] {
+			zs[string(pad32(entry.Z))] = true
+		}
+		if len(zs) > 1 {
+			collisions = append(collisions, &Collision{
+				R:       r,
+				Entries: sorted[start:end],
+			})
+		}
+		start = end
+	}
+	return collisions
 }
 
 type NullStorage struct{}
@@ -13,3 +132,35 @@ func NewNullStorage() Storage {
 func (storage *NullStorage) PutEntry(srctxn string, pubkey, z, r, s []byte) error {
 	return nil
 }
+
+func (storage *NullStorage) PutSignature(entry *Entry) error {
+	return nil
+}
+
+func (storage *NullStorage) FindByR(r []byte) ([]*Entry, error) {
+	return nil, nil
+}
+
+func (storage *NullStorage) FindByPubKey(pubkey []byte) ([]*Entry, error) {
+	return nil, nil
+}
+
+func (storage *NullStorage) FindCollisions() ([]*Collision, error) {
+	return nil, nil
+}
+
+func (storage *NullStorage) ForEachEntry(pubkey []byte, fn func(entry *Entry) error) error {
+	return nil
+}
+
+func (storage *NullStorage) ForEachPubKey(fn func(pubkey []byte) error) error {
+	return nil
+}
+
+func (storage *NullStorage) PutRecovery(rec *RecoveredKey) error {
+	return nil
+}
+
+func (storage *NullStorage) Recoveries() ([]*RecoveredKey, error) {
+	return nil, nil
+}
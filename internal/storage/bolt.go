@@ -0,0 +1,458 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// CollisionStorage is a Storage that can tell which stored signatures share
+// an R value with a new one as it stores it.
+type CollisionStorage interface {
+	Storage
+
+	// PutAndCollide stores a signature and returns the stored ones sharing
+	// its R value, under any pubkey, as a single atomic operation. A
+	// signature that was already stored is not returned.
+	PutAndCollide(srctxn string, pubkey, z, r, s []byte) ([]*Entry, error)
+
+	// PutAndCollideBatch stores signatures like PutAndCollide, all in one
+	// transaction, returning the collisions of each in order. Signatures of
+	// the batch sharing an R value collide with each other.
+	PutAndCollideBatch(entries []*Entry) ([][]*Entry, error)
+
+	// PutWithoutLookup stores signatures in one transaction without looking
+	// for those sharing their R values, for callers that know there are
+	// none.
+	PutWithoutLookup(entries ...*Entry) error
+
+	// Generation counts the signatures ever stored, telling whether
+	// something derived from the store, like a filter, is still current.
+	Generation() (uint64, error)
+
+	// ForEachR calls fn with every distinct stored R value, which fn must
+	// not keep as it is reused
+	ForEachR(fn func(r []byte) error) error
+	Close() error
+}
+
+var ErrCorruptEntry = errors.New("failed to decode stored signature")
+
+var (
+	sigsBucket       = []byte("sigs")
+	pubkeysBucket    = []byte("pubkeys")
+	recoveriesBucket = []byte("recoveries")
+)
+
+// BoltStorage keeps signatures in an embedded bbolt file, surviving restarts
+// without a database server. Signatures are keyed by R, Z and pubkey so that
+// those sharing an R value are next to each other, and indexed by pubkey.
+// Recovered keys are kept next to them.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(path string) (CollisionStorage, error) {
+	db, err := bolt.Open(path, os.FileMode(0600), &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sigsBucket, pubkeysBucket, recoveriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (storage *BoltStorage) Close() error {
+	return storage.db.Close()
+}
+
+func pad32(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return padded
+}
+
+func sigKey(pubkey, z, r []byte) []byte {
+	return append(append(append([]byte{}, pad32(r)...), pad32(z)...), pubkey...)
+}
+
+// pubkeyKey prefixes the pubkey with its length, so that keys of different
+// encodings never share a prefix.
+func pubkeyKey(pubkey, z, r []byte) []byte {
+	key := append([]byte{byte(len(pubkey))}, pubkey...)
+	return append(key, sigKey(nil, z, r)...)
+}
+
+// encodeValue encodes what the key of a signature leaves out, the S value,
+// the transaction and input it came from and the block it was mined in, and
+// where in the block.
+// Variable length fields are prefixed with their uint16 length.
+func encodeValue(entry *Entry, s []byte) []byte {
+	var fixed [12]byte
+	binary.BigEndian.PutUint32(fixed[0:], uint32(int32(entry.InputIndex)))
+	binary.BigEndian.PutUint32(fixed[4:], entry.HashType)
+	binary.BigEndian.PutUint32(fixed[8:], uint32(entry.BlockHeight))
+
+	value := appendField(nil, []byte(entry.SrcTxn))
+	value = appendField(value, s)
+	value = append(value, fixed[:]...)
+	value = appendField(value, []byte(entry.ScriptType))
+	value = appendField(value, []byte(entry.BlockHash))
+
+	// The position in the block came after the rest, and is -1 for values
+	// written before it
+	var txIndex [4]byte
+	binary.BigEndian.PutUint32(txIndex[:], uint32(int32(entry.TxIndex)))
+	return append(value, txIndex[:]...)
+}
+
+func appendField(value, field []byte) []byte {
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(field)))
+	return append(append(value, n[:]...), field...)
+}
+
+// readField splits the length prefixed field off the front of value.
+func readField(value []byte) ([]byte, []byte, error) {
+	if len(value) < 2 {
+		return nil, nil, ErrCorruptEntry
+	}
+	n := 2 + int(binary.BigEndian.Uint16(value))
+	if len(value) < n {
+		return nil, nil, ErrCorruptEntry
+	}
+	return append([]byte{}, value[2:n]...), value[n:], nil
+}
+
+func decodeEntry(key, value []byte) (*Entry, error) {
+	if len(key) < 64 {
+		return nil, ErrCorruptEntry
+	}
+	srctxn, value, err := readField(value)
+	if err != nil {
+		return nil, err
+	}
+	s, value, err := readField(value)
+	if err != nil || len(value) < 12 {
+		return nil, ErrCorruptEntry
+	}
+	entry := &Entry{
+		SrcTxn:      string(srctxn),
+		R:           append([]byte{}, key[:32]...),
+		Z:           append([]byte{}, key[32:64]...),
+		PubKey:      append([]byte{}, key[64:]...),
+		S:           s,
+		InputIndex:  int(int32(binary.BigEndian.Uint32(value[0:]))),
+		HashType:    binary.BigEndian.Uint32(value[4:]),
+		BlockHeight: int32(binary.BigEndian.Uint32(value[8:])),
+	}
+	scriptType, value, err := readField(value[12:])
+	if err != nil {
+		return nil, err
+	}
+	blockHash, value, err := readField(value)
+	if err != nil {
+		return nil, err
+	}
+	entry.ScriptType = string(scriptType)
+	entry.BlockHash = string(blockHash)
+	entry.TxIndex = -1
+	if len(value) >= 4 {
+		entry.TxIndex = int(int32(binary.BigEndian.Uint32(value)))
+	}
+	return entry, nil
+}
+
+// scanR returns the entries of sigs sharing the R value.
+func scanR(sigs *bolt.Bucket, r []byte) ([]*Entry, error) {
+	prefix := pad32(r)
+	entries := make([]*Entry, 0)
+	c := sigs.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		entry, err := decodeEntry(k, v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (storage *BoltStorage) PutEntry(srctxn string, pubkey, z, r, s []byte) error {
+	_, err := storage.PutAndCollide(srctxn, pubkey, z, r, s)
+	return err
+}
+
+func (storage *BoltStorage) PutSignature(entry *Entry) error {
+	_, err := storage.PutAndCollideBatch([]*Entry{entry})
+	return err
+}
+
+func (storage *BoltStorage) PutAndCollide(srctxn string, pubkey, z, r, s []byte) ([]*Entry, error) {
+	collisions, err := storage.PutAndCollideBatch([]*Entry{{
+		SrcTxn:      srctxn,
+		PubKey:      pubkey,
+		Z:           z,
+		R:           r,
+		S:           s,
+		InputIndex:  -1,
+		BlockHeight: -1,
+		TxIndex:     -1,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return collisions[0], nil
+}
+
+func (storage *BoltStorage) PutAndCollideBatch(entries []*Entry) ([][]*Entry, error) {
+	collisions := make([][]*Entry, len(entries))
+	err := storage.db.Update(func(tx *bolt.Tx) error {
+		for i, entry := range entries {
+			var err error
+			if collisions[i], err = putAndCollide(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collisions, nil
+}
+
+// putAndCollide stores a signature within tx, returning the stored ones
+// sharing its R value.
+func putAndCollide(tx *bolt.Tx, entry *Entry) ([]*Entry, error) {
+	sigs := tx.Bucket(sigsBucket)
+	stored, err := scanR(sigs, entry.R)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sigKey(entry.PubKey, entry.Z, entry.R)
+	collisions := make([]*Entry, 0, len(stored))
+	for _, other := range stored {
+		if !bytes.Equal(sigKey(other.PubKey, other.Z, other.R), key) {
+			collisions = append(collisions, other)
+		}
+	}
+	if sigs.Get(key) != nil {
+		return collisions, nil
+	}
+	if err := putEntry(tx, key, entry); err != nil {
+		return nil, err
+	}
+	return collisions, nil
+}
+
+func (storage *BoltStorage) PutWithoutLookup(entries ...*Entry) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		sigs := tx.Bucket(sigsBucket)
+		for _, entry := range entries {
+			key := sigKey(entry.PubKey, entry.Z, entry.R)
+			if sigs.Get(key) != nil {
+				continue
+			}
+			if err := putEntry(tx, key, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Generation is the sequence of the sigs bucket, bumped by every new
+// signature.
+func (storage *BoltStorage) Generation() (uint64, error) {
+	var generation uint64
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		generation = tx.Bucket(sigsBucket).Sequence()
+		return nil
+	})
+	return generation, err
+}
+
+// putEntry writes a signature under its key and indexes it by pubkey.
+func putEntry(tx *bolt.Tx, key []byte, entry *Entry) error {
+	sigs := tx.Bucket(sigsBucket)
+	value := encodeValue(entry, CanonicalS(entry.PubKey, entry.S))
+	if err := sigs.Put(key, value); err != nil {
+		return err
+	}
+	if _, err := sigs.NextSequence(); err != nil {
+		return err
+	}
+	return tx.Bucket(pubkeysBucket).Put(pubkeyKey(entry.PubKey, entry.Z, entry.R), []byte{})
+}
+
+func (storage *BoltStorage) FindByR(r []byte) ([]*Entry, error) {
+	var entries []*Entry
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entries, err = scanR(tx.Bucket(sigsBucket), r)
+		return err
+	})
+	return entries, err
+}
+
+func (storage *BoltStorage) FindByPubKey(pubkey []byte) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := storage.ForEachEntry(pubkey, func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (storage *BoltStorage) ForEachEntry(pubkey []byte, fn func(entry *Entry) error) error {
+	return storage.db.View(func(tx *bolt.Tx) error {
+		sigs := tx.Bucket(sigsBucket)
+		prefix := append([]byte{byte(len(pubkey))}, pubkey...)
+		c := tx.Bucket(pubkeysBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			rz := k[len(prefix):]
+			if len(rz) != 64 {
+				return ErrCorruptEntry
+			}
+			key := sigKey(pubkey, rz[32:], rz[:32])
+			entry, err := decodeEntry(key, sigs.Get(key))
+			if err != nil {
+				return err
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEachPubKey calls fn within a read transaction, so fn may read from the
+// store but not write to it.
+func (storage *BoltStorage) ForEachPubKey(fn func(pubkey []byte) error) error {
+	return storage.db.View(func(tx *bolt.Tx) error {
+		var last []byte
+		c := tx.Bucket(pubkeysBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(k) < 1+int(k[0]) {
+				return ErrCorruptEntry
+			}
+			pubkey := k[1 : 1+int(k[0])]
+			if last != nil && bytes.Equal(last, pubkey) {
+				continue
+			}
+			last = append([]byte{}, pubkey...)
+			if err := fn(last); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FindCollisions walks the signatures in R order, one R value at a time.
+func (storage *BoltStorage) FindCollisions() ([]*Collision, error) {
+	collisions := make([]*Collision, 0)
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		var group []*Entry
+		c := tx.Bucket(sigsBucket).Cursor()
+		for k, v := c.First(); ; k, v = c.Next() {
+			if k == nil || (len(group) != 0 && !bytes.HasPrefix(k, group[0].R)) {
+				collisions = append(collisions, groupCollisions(group)...)
+				group = nil
+			}
+			if k == nil {
+				return nil
+			}
+			entry, err := decodeEntry(k, v)
+			if err != nil {
+				return err
+			}
+			group = append(group, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collisions, nil
+}
+
+func (storage *BoltStorage) PutRecovery(rec *RecoveredKey) error {
+	stored := *rec
+	if stored.FoundAt.IsZero() {
+		stored.FoundAt = time.Now()
+	}
+	value, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+	key := append(append([]byte{}, rec.PrivKey...), rec.Method...)
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		recoveries := tx.Bucket(recoveriesBucket)
+		if recoveries.Get(key) != nil {
+			return nil
+		}
+		return recoveries.Put(key, value)
+	})
+}
+
+func (storage *BoltStorage) Recoveries() ([]*RecoveredKey, error) {
+	recs := make([]*RecoveredKey, 0)
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recoveriesBucket).ForEach(func(k, v []byte) error {
+			rec := new(RecoveredKey)
+			if err := json.Unmarshal(v, rec); err != nil {
+				return ErrCorruptEntry
+			}
+			recs = append(recs, rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func (storage *BoltStorage) ForEachR(fn func(r []byte) error) error {
+	return storage.db.View(func(tx *bolt.Tx) error {
+		var last []byte
+		c := tx.Bucket(sigsBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(k) < 32 {
+				return ErrCorruptEntry
+			}
+			if last != nil && bytes.Equal(last, k[:32]) {
+				continue
+			}
+			last = append(last[:0], k[:32]...)
+			if err := fn(last); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
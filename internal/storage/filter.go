@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+var ErrBloomFilter = errors.New("failed to read bloom filter")
+
+// bloomFilterHeader is the size of what WriteTo writes before the bits.
+const bloomFilterHeader = 36
+
+var bloomFilterMagic = [8]byte{'n', 'o', 'n', 'c', 'e', 'b', 'f', '2'}
+
+// BloomFilter tells whether an R value has probably been seen before, in
+// constant memory. R values are x coordinates of random points, uniform
+// enough to be their own hashes, which are taken from their first 16 bytes
+// by double hashing.
+type BloomFilter struct {
+	mu    sync.RWMutex
+	bits  []uint64
+	m     uint64
+	k     uint32
+	count uint64
+
+	// generation is that of the store the filter was last in sync with
+	generation uint64
+}
+
+// NewBloomFilter sizes a filter for capacity R values at the given false
+// positive rate, with m = -n ln(p) / ln(2)^2 bits and k = m/n ln(2) hashes.
+func NewBloomFilter(capacity uint64, fpRate float64) *BloomFilter {
+	if capacity == 0 {
+		capacity = 1
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &BloomFilter{bits: make([]uint64, m/64), m: m, k: k}
+}
+
+func (filter *BloomFilter) hashes(r []byte) (uint64, uint64) {
+	padded := pad32(r)
+	return binary.BigEndian.Uint64(padded[:8]), binary.BigEndian.Uint64(padded[8:16]) | 1
+}
+
+// Add records the R value.
+func (filter *BloomFilter) Add(r []byte) {
+	h1, h2 := filter.hashes(r)
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+	for i := uint64(0); i < uint64(filter.k); i++ {
+		bit := (h1 + i*h2) % filter.m
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+	filter.count++
+}
+
+// MayContain tells whether the R value was probably added, never missing
+// one that was.
+func (filter *BloomFilter) MayContain(r []byte) bool {
+	h1, h2 := filter.hashes(r)
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+	for i := uint64(0); i < uint64(filter.k); i++ {
+		bit := (h1 + i*h2) % filter.m
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Bits returns the size of the filter in bits.
+func (filter *BloomFilter) Bits() uint64 {
+	return filter.m
+}
+
+// Hashes returns the number of bits set for every R value.
+func (filter *BloomFilter) Hashes() uint32 {
+	return filter.k
+}
+
+// Count returns the number of R values added.
+func (filter *BloomFilter) Count() uint64 {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+	return filter.count
+}
+
+// Generation returns the generation of the store the filter was built from
+// or saved along with. A filter whose store has moved on since may miss R
+// values and has to be rebuilt.
+func (filter *BloomFilter) Generation() uint64 {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+	return filter.generation
+}
+
+// FalsePositiveRate estimates the current false positive rate of the filter
+// as (1 - e^(-kn/m))^k.
+func (filter *BloomFilter) FalsePositiveRate() float64 {
+	k, m := float64(filter.k), float64(filter.m)
+	return math.Pow(1-math.Exp(-k*float64(filter.Count())/m), k)
+}
+
+func (filter *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+	buf := bufio.NewWriter(w)
+	if _, err := buf.Write(bloomFilterMagic[:]); err != nil {
+		return 0, err
+	}
+	for _, v := range []interface{}{filter.m, filter.k, filter.count, filter.generation, filter.bits} {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return 0, err
+		}
+	}
+	return int64(bloomFilterHeader + 8*len(filter.bits)), buf.Flush()
+}
+
+// ReadBloomFilter deserializes a filter written by WriteTo.
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	buf := bufio.NewReader(r)
+	var magic [8]byte
+	if _, err := io.ReadFull(buf, magic[:]); err != nil || magic != bloomFilterMagic {
+		return nil, ErrBloomFilter
+	}
+	filter := &BloomFilter{}
+	for _, v := range []interface{}{&filter.m, &filter.k, &filter.count, &filter.generation} {
+		if err := binary.Read(buf, binary.BigEndian, v); err != nil {
+			return nil, ErrBloomFilter
+		}
+	}
+	if filter.m == 0 || filter.m%64 != 0 || filter.k == 0 {
+		return nil, ErrBloomFilter
+	}
+	filter.bits = make([]uint64, filter.m/64)
+	if err := binary.Read(buf, binary.BigEndian, filter.bits); err != nil {
+		return nil, ErrBloomFilter
+	}
+	return filter, nil
+}
+
+// Save writes the filter to path, replacing what is there only once it has
+// been fully written.
+func (filter *BloomFilter) Save(path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := filter.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadBloomFilter reads the filter saved at path, checking its size against
+// that of the file before allocating it.
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var header [20]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return nil, ErrBloomFilter
+	}
+	if m := binary.BigEndian.Uint64(header[8:]); m/8 != uint64(info.Size()-bloomFilterHeader) {
+		return nil, ErrBloomFilter
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ReadBloomFilter(f)
+}
+
+// RebuildBloomFilter builds a filter sized for capacity R values at the
+// given false positive rate from every R value in the store.
+func RebuildBloomFilter(store CollisionStorage, capacity uint64, fpRate float64) (*BloomFilter, error) {
+	filter := NewBloomFilter(capacity, fpRate)
+	generation, err := store.Generation()
+	if err != nil {
+		return nil, err
+	}
+	filter.generation = generation
+	err = store.ForEachR(func(r []byte) error {
+		filter.Add(r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// FilterStats counts how the lookups of a FilteredStorage went. Misses are
+// answered by the filter alone, hits go to the store, and false positives are
+// the hits for which the store had nothing sharing R.
+type FilterStats struct {
+	Hits           uint64
+	Misses         uint64
+	FalsePositives uint64
+}
+
+// FilteredStorage puts a BloomFilter of R values in front of a store, only
+// looking up collisions in it when the filter has probably seen R before.
+// Signatures are still all written to the store.
+type FilteredStorage struct {
+	CollisionStorage
+	Filter *BloomFilter
+
+	// mu makes checking the filter and storing a signature atomic, so that
+	// concurrent signatures sharing R still see each other
+	mu    sync.Mutex
+	stats FilterStats
+}
+
+func NewFilteredStorage(store CollisionStorage, filter *BloomFilter) *FilteredStorage {
+	return &FilteredStorage{CollisionStorage: store, Filter: filter}
+}
+
+// Save saves the filter to path along with the current generation of the
+// store, so that it is only loaded back while the two are in sync.
+func (storage *FilteredStorage) Save(path string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	generation, err := storage.CollisionStorage.Generation()
+	if err != nil {
+		return err
+	}
+	storage.Filter.mu.Lock()
+	storage.Filter.generation = generation
+	storage.Filter.mu.Unlock()
+	return storage.Filter.Save(path)
+}
+
+func (storage *FilteredStorage) Stats() FilterStats {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.stats
+}
+
+// count records a lookup, the caller holding the lock.
+func (storage *FilteredStorage) count(hit, found bool) {
+	switch {
+	case !hit:
+		storage.stats.Misses++
+	case found:
+		storage.stats.Hits++
+	default:
+		storage.stats.Hits++
+		storage.stats.FalsePositives++
+	}
+}
+
+func (storage *FilteredStorage) PutEntry(srctxn string, pubkey, z, r, s []byte) error {
+	_, err := storage.PutAndCollide(srctxn, pubkey, z, r, s)
+	return err
+}
+
+func (storage *FilteredStorage) PutSignature(entry *Entry) error {
+	_, err := storage.PutAndCollideBatch([]*Entry{entry})
+	return err
+}
+
+func (storage *FilteredStorage) PutAndCollide(srctxn string, pubkey, z, r, s []byte) ([]*Entry, error) {
+	collisions, err := storage.PutAndCollideBatch([]*Entry{{
+		SrcTxn:      srctxn,
+		PubKey:      pubkey,
+		Z:           z,
+		R:           r,
+		S:           s,
+		InputIndex:  -1,
+		BlockHeight: -1,
+		TxIndex:     -1,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return collisions[0], nil
+}
+
+// PutAndCollideBatch only looks up the signatures whose R value the filter
+// has probably seen. The others are stored first, and added to the filter as
+// they go, so that signatures of the batch sharing an R value still collide.
+func (storage *FilteredStorage) PutAndCollideBatch(entries []*Entry) ([][]*Entry, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	var hits, misses []*Entry
+	var hitIndexes []int
+	for i, entry := range entries {
+		if storage.Filter.MayContain(entry.R) {
+			hits = append(hits, entry)
+			hitIndexes = append(hitIndexes, i)
+			continue
+		}
+		misses = append(misses, entry)
+		storage.Filter.Add(entry.R)
+	}
+
+	collisions := make([][]*Entry, len(entries))
+	if len(misses) != 0 {
+		if err := storage.CollisionStorage.PutWithoutLookup(misses...); err != nil {
+			return nil, err
+		}
+		for range misses {
+			storage.count(false, false)
+		}
+	}
+	if len(hits) != 0 {
+		found, err := storage.CollisionStorage.PutAndCollideBatch(hits)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range hitIndexes {
+			collisions[i] = found[j]
+			storage.count(true, len(found[j]) != 0)
+		}
+	}
+	return collisions, nil
+}
+
+func (storage *FilteredStorage) FindByR(r []byte) ([]*Entry, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if !storage.Filter.MayContain(r) {
+		storage.count(false, false)
+		return nil, nil
+	}
+	entries, err := storage.CollisionStorage.FindByR(r)
+	if err != nil {
+		return nil, err
+	}
+	storage.count(true, len(entries) != 0)
+	return entries, nil
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps signatures and recovered keys in memory, for analysis
+// of data loaded for a single run and for tests.
+type MemoryStorage struct {
+	mu         sync.RWMutex
+	entries    map[string]*Entry
+	byR        map[string][]*Entry
+	byPubKey   map[string][]*Entry
+	recoveries []*RecoveredKey
+	recovered  map[string]bool
+	generation uint64
+}
+
+func NewMemoryStorage() CollisionStorage {
+	return &MemoryStorage{
+		entries:   make(map[string]*Entry),
+		byR:       make(map[string][]*Entry),
+		byPubKey:  make(map[string][]*Entry),
+		recovered: make(map[string]bool),
+	}
+}
+
+func (storage *MemoryStorage) Close() error {
+	return nil
+}
+
+func (storage *MemoryStorage) PutEntry(srctxn string, pubkey, z, r, s []byte) error {
+	_, err := storage.PutAndCollide(srctxn, pubkey, z, r, s)
+	return err
+}
+
+func (storage *MemoryStorage) PutSignature(entry *Entry) error {
+	_, err := storage.put(entry)
+	return err
+}
+
+func (storage *MemoryStorage) PutAndCollide(srctxn string, pubkey, z, r, s []byte) ([]*Entry, error) {
+	return storage.put(&Entry{
+		SrcTxn:      srctxn,
+		PubKey:      pubkey,
+		Z:           z,
+		R:           r,
+		S:           s,
+		InputIndex:  -1,
+		BlockHeight: -1,
+		TxIndex:     -1,
+	})
+}
+
+func (storage *MemoryStorage) PutAndCollideBatch(entries []*Entry) ([][]*Entry, error) {
+	collisions := make([][]*Entry, len(entries))
+	for i, entry := range entries {
+		var err error
+		if collisions[i], err = storage.put(entry); err != nil {
+			return nil, err
+		}
+	}
+	return collisions, nil
+}
+
+func (storage *MemoryStorage) PutWithoutLookup(entries ...*Entry) error {
+	for _, entry := range entries {
+		if _, err := storage.put(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *MemoryStorage) Generation() (uint64, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return storage.generation, nil
+}
+
+// put stores a copy of the entry, returning those sharing its R value.
+func (storage *MemoryStorage) put(entry *Entry) ([]*Entry, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	key := string(sigKey(entry.PubKey, entry.Z, entry.R))
+	rKey := string(pad32(entry.R))
+	collisions := make([]*Entry, 0)
+	for _, stored := range storage.byR[rKey] {
+		if string(sigKey(stored.PubKey, stored.Z, stored.R)) != key {
+			collisions = append(collisions, stored)
+		}
+	}
+	if _, ok := storage.entries[key]; ok {
+		return collisions, nil
+	}
+
+	stored := *entry
+	stored.PubKey = append([]byte{}, entry.PubKey...)
+	stored.Z = append([]byte{}, entry.Z...)
+	stored.R = append([]byte{}, entry.R...)
+	stored.S = append([]byte{}, CanonicalS(entry.PubKey, entry.S)...)
+	storage.entries[key] = &stored
+	storage.generation++
+	storage.byR[rKey] = append(storage.byR[rKey], &stored)
+	storage.byPubKey[string(entry.PubKey)] = append(storage.byPubKey[string(entry.PubKey)], &stored)
+	return collisions, nil
+}
+
+func (storage *MemoryStorage) FindByR(r []byte) ([]*Entry, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return append([]*Entry{}, storage.byR[string(pad32(r))]...), nil
+}
+
+func (storage *MemoryStorage) FindByPubKey(pubkey []byte) ([]*Entry, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return append([]*Entry{}, storage.byPubKey[string(pubkey)]...), nil
+}
+
+func (storage *MemoryStorage) ForEachEntry(pubkey []byte, fn func(entry *Entry) error) error {
+	entries, _ := storage.FindByPubKey(pubkey)
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *MemoryStorage) ForEachPubKey(fn func(pubkey []byte) error) error {
+	storage.mu.RLock()
+	pubkeys := make([][]byte, 0, len(storage.byPubKey))
+	for pubkey := range storage.byPubKey {
+		pubkeys = append(pubkeys, []byte(pubkey))
+	}
+	storage.mu.RUnlock()
+	for _, pubkey := range pubkeys {
+		if err := fn(pubkey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *MemoryStorage) FindCollisions() ([]*Collision, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	collisions := make([]*Collision, 0)
+	for _, entries := range storage.byR {
+		collisions = append(collisions, groupCollisions(entries)...)
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return bytes.Compare(collisions[i].R, collisions[j].R) < 0
+	})
+	return collisions, nil
+}
+
+func (storage *MemoryStorage) ForEachR(fn func(r []byte) error) error {
+	storage.mu.RLock()
+	values := make([][]byte, 0, len(storage.byR))
+	for r := range storage.byR {
+		values = append(values, []byte(r))
+	}
+	storage.mu.RUnlock()
+	for _, r := range values {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *MemoryStorage) PutRecovery(rec *RecoveredKey) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	key := string(rec.PrivKey) + rec.Method
+	if storage.recovered[key] {
+		return nil
+	}
+	storage.recovered[key] = true
+	stored := *rec
+	if stored.FoundAt.IsZero() {
+		stored.FoundAt = time.Now()
+	}
+	storage.recoveries = append(storage.recoveries, &stored)
+	return nil
+}
+
+func (storage *MemoryStorage) Recoveries() ([]*RecoveredKey, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return append([]*RecoveredKey{}, storage.recoveries...), nil
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Migration is a versioned change to the Postgres schema. Migrations are
+// applied in order, each one once, and are never edited after being
+// released; changes go into a new one.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+}
+
+var ErrSchemaOutdated = errors.New("the database schema is outdated, run `nonced db migrate`")
+
+// migrationLock is the advisory lock key taken while migrating, so that
+// concurrent runs apply every migration once.
+const migrationLock = 0x6e6f6e636564
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create signatures schema",
+		Up: `
+CREATE TABLE transactions (
+	id           BIGSERIAL PRIMARY KEY,
+	txid         TEXT NOT NULL UNIQUE,
+	block_hash   TEXT,
+	block_height INTEGER
+);
+
+CREATE TABLE inputs (
+	transaction_id BIGINT NOT NULL REFERENCES transactions (id),
+	input_index    INTEGER NOT NULL,
+	script_type    TEXT NOT NULL,
+	PRIMARY KEY (transaction_id, input_index)
+);
+
+CREATE TABLE pubkeys (
+	id     BIGSERIAL PRIMARY KEY,
+	pubkey BYTEA NOT NULL UNIQUE
+);
+
+-- input_index is NULL for signatures stored without the input they came
+-- from, which leaves the reference to inputs unchecked
+CREATE TABLE signatures (
+	id             BIGSERIAL PRIMARY KEY,
+	transaction_id BIGINT NOT NULL REFERENCES transactions (id),
+	input_index    INTEGER,
+	pubkey_id      BIGINT NOT NULL REFERENCES pubkeys (id),
+	r              BYTEA NOT NULL,
+	s              BYTEA NOT NULL,
+	z              BYTEA NOT NULL,
+	sighash_type   INTEGER,
+	UNIQUE (pubkey_id, r, z),
+	FOREIGN KEY (transaction_id, input_index) REFERENCES inputs (transaction_id, input_index)
+);
+CREATE INDEX signatures_r_idx ON signatures (r);
+CREATE INDEX signatures_pubkey_id_idx ON signatures (pubkey_id);
+
+CREATE TABLE recoveries (
+	id        BIGSERIAL PRIMARY KEY,
+	pubkey_id BIGINT NOT NULL REFERENCES pubkeys (id),
+	privkey   BYTEA NOT NULL,
+	method    TEXT NOT NULL,
+	r         BYTEA,
+	nonce     BYTEA,
+	verified  BOOLEAN NOT NULL DEFAULT FALSE,
+	found_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UNIQUE (privkey, method)
+);
+CREATE INDEX recoveries_pubkey_id_idx ON recoveries (pubkey_id);
+
+CREATE TABLE recovery_sources (
+	recovery_id    BIGINT NOT NULL REFERENCES recoveries (id),
+	position       INTEGER NOT NULL,
+	transaction_id BIGINT NOT NULL REFERENCES transactions (id),
+	PRIMARY KEY (recovery_id, position)
+);
+
+CREATE VIEW entries AS
+	SELECT t.txid AS srctxn, p.pubkey, s.z, s.r, s.s,
+		COALESCE(s.input_index, -1) AS input_index,
+		COALESCE(s.sighash_type, 0) AS sighash_type,
+		COALESCE(i.script_type, '') AS script_type,
+		COALESCE(t.block_hash, '') AS block_hash,
+		COALESCE(t.block_height, -1) AS block_height
+	FROM signatures s
+	JOIN transactions t ON t.id = s.transaction_id
+	JOIN pubkeys p ON p.id = s.pubkey_id
+	LEFT JOIN inputs i ON i.transaction_id = s.transaction_id AND i.input_index = s.input_index;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "import the legacy sighash table",
+		Up: `
+-- Legacy rows predate low S, which ECDSA signatures are brought to on import
+-- like extracted ones, s becoming n - s above n/2
+CREATE FUNCTION pg_temp.bytea_to_numeric(b BYTEA) RETURNS NUMERIC AS $fn$
+DECLARE
+	result NUMERIC := 0;
+BEGIN
+	FOR i IN 0 .. length(b) - 1 LOOP
+		result := result * 256 + get_byte(b, i);
+	END LOOP;
+	RETURN result;
+END
+$fn$ LANGUAGE plpgsql IMMUTABLE;
+
+CREATE FUNCTION pg_temp.numeric_to_bytea(v NUMERIC) RETURNS BYTEA AS $fn$
+DECLARE
+	result BYTEA := '';
+BEGIN
+	WHILE v > 0 LOOP
+		result := set_byte('\x00'::BYTEA, 0, mod(v, 256)::INTEGER) || result;
+		v := div(v, 256);
+	END LOOP;
+	RETURN result;
+END
+$fn$ LANGUAGE plpgsql IMMUTABLE;
+
+CREATE FUNCTION pg_temp.low_s(s BYTEA) RETURNS BYTEA AS $fn$
+DECLARE
+	curve_n CONSTANT NUMERIC := 115792089237316195423570985008687907852837564279074904382605163141518161494337;
+	v NUMERIC := pg_temp.bytea_to_numeric(s);
+BEGIN
+	IF v > div(curve_n, 2) THEN
+		RETURN pg_temp.numeric_to_bytea(curve_n - v);
+	END IF;
+	RETURN s;
+END
+$fn$ LANGUAGE plpgsql IMMUTABLE;
+
+DO $$
+BEGIN
+	IF to_regclass('sighash') IS NOT NULL THEN
+		INSERT INTO transactions (txid)
+			SELECT DISTINCT srctxn FROM sighash
+			ON CONFLICT (txid) DO NOTHING;
+		INSERT INTO pubkeys (pubkey)
+			SELECT DISTINCT pubkey FROM sighash
+			ON CONFLICT (pubkey) DO NOTHING;
+		INSERT INTO signatures (transaction_id, pubkey_id, r, s, z)
+			SELECT t.id, p.id, h.r,
+				CASE WHEN length(h.pubkey) = 32 THEN h.s ELSE pg_temp.low_s(h.s) END,
+				h.z
+			FROM sighash h
+			JOIN transactions t ON t.txid = h.srctxn
+			JOIN pubkeys p ON p.pubkey = h.pubkey
+			ON CONFLICT (pubkey_id, r, z) DO NOTHING;
+		ALTER TABLE sighash RENAME TO sighash_legacy;
+	END IF;
+END
+$$;
+
+DROP FUNCTION pg_temp.low_s(BYTEA);
+DROP FUNCTION pg_temp.numeric_to_bytea(NUMERIC);
+DROP FUNCTION pg_temp.bytea_to_numeric(BYTEA);
+`,
+	},
+	{
+		Version: 3,
+		Name:    "record the position of transactions in their block",
+		Up: `
+ALTER TABLE transactions ADD COLUMN tx_index INTEGER;
+
+CREATE OR REPLACE VIEW entries AS
+	SELECT t.txid AS srctxn, p.pubkey, s.z, s.r, s.s,
+		COALESCE(s.input_index, -1) AS input_index,
+		COALESCE(s.sighash_type, 0) AS sighash_type,
+		COALESCE(i.script_type, '') AS script_type,
+		COALESCE(t.block_hash, '') AS block_hash,
+		COALESCE(t.block_height, -1) AS block_height,
+		COALESCE(t.tx_index, -1) AS tx_index
+	FROM signatures s
+	JOIN transactions t ON t.id = s.transaction_id
+	JOIN pubkeys p ON p.id = s.pubkey_id
+	LEFT JOIN inputs i ON i.transaction_id = s.transaction_id AND i.input_index = s.input_index;
+`,
+	},
+}
+
+// SchemaVersion returns the version of the last migration applied, 0 if
+// there is none.
+func (storage *PostgresStorage) SchemaVersion() (int, error) {
+	if _, err := storage.Exec(createMigrationsTable); err != nil {
+		return 0, err
+	}
+	var version int
+	err := storage.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	return version, err
+}
+
+// Migrate applies the migrations the database is missing, returning them.
+// Each one is applied in its own transaction, so a failure leaves the schema
+// at the version before it.
+func (storage *PostgresStorage) Migrate() ([]Migration, error) {
+	if _, err := storage.Exec(createMigrationsTable); err != nil {
+		return nil, err
+	}
+	applied := make([]Migration, 0)
+	for _, migration := range migrations {
+		ok, err := storage.migrate(migration)
+		if err != nil {
+			return applied, fmt.Errorf("failed to apply migration %d (%s): %s",
+				migration.Version, migration.Name, err.Error())
+		}
+		if ok {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// migrate applies a migration unless it already was.
+func (storage *PostgresStorage) migrate(migration Migration) (bool, error) {
+	tx, err := storage.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLock); err != nil {
+		return false, err
+	}
+	var done bool
+	err = tx.Get(&done, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", migration.Version)
+	if err != nil || done {
+		return false, err
+	}
+	if _, err := tx.Exec(migration.Up); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+		migration.Version, migration.Name)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// LatestSchemaVersion is the version the migrations bring the schema to.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
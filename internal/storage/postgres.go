@@ -3,14 +3,19 @@ package storage
 import (
 	"fmt"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// PostgresStorage keeps signatures in the schema created by Migrate, with
+// transactions, inputs and pubkeys in their own tables. Entries are read
+// back through the entries view joining them.
 type PostgresStorage struct {
 	*sqlx.DB
 }
 
-func NewPostgresStorage(host string, port int, user, password, dbname string) (Storage, error) {
+// OpenPostgresStorage connects to Postgres without checking the schema, for
+// migrating it.
+func OpenPostgresStorage(host string, port int, user, password, dbname string) (*PostgresStorage, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
 		"password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
@@ -21,11 +26,218 @@ func NewPostgresStorage(host string, port int, user, password, dbname string) (S
 	return &PostgresStorage{db}, nil
 }
 
+// NewPostgresStorage connects to Postgres, failing with ErrSchemaOutdated
+// unless every migration has been applied.
+func NewPostgresStorage(host string, port int, user, password, dbname string) (Storage, error) {
+	storage, err := OpenPostgresStorage(host, port, user, password, dbname)
+	if err != nil {
+		return nil, err
+	}
+	version, err := storage.SchemaVersion()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if version < LatestSchemaVersion() {
+		storage.Close()
+		return nil, ErrSchemaOutdated
+	}
+	return storage, nil
+}
+
+const selectEntries = "SELECT srctxn, pubkey, z, r, s, input_index, sighash_type, script_type, " +
+	"block_hash, block_height, tx_index FROM entries "
+
 func (storage *PostgresStorage) PutEntry(srctxn string, pubkey, z, r, s []byte) error {
-	_, err := storage.Exec("INSERT into sighash(srctxn, pubkey, z, r, s) VALUES($1, $2, $3, $4, $5)",
-		srctxn, pubkey, z, r, s)
+	return storage.PutSignature(&Entry{
+		SrcTxn:      srctxn,
+		PubKey:      pubkey,
+		Z:           z,
+		R:           r,
+		S:           s,
+		InputIndex:  -1,
+		BlockHeight: -1,
+		TxIndex:     -1,
+	})
+}
+
+func (storage *PostgresStorage) PutSignature(entry *Entry) error {
+	tx, err := storage.Beginx()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	// Unknown inputs and blocks are left NULL, and known ones are filled in
+	// for transactions first seen without them
+	var blockHash, blockHeight, txIndex, inputIndex, hashType interface{}
+	if len(entry.BlockHash) != 0 {
+		blockHash = entry.BlockHash
+		if entry.BlockHeight >= 0 {
+			blockHeight = entry.BlockHeight
+		}
+		if entry.TxIndex >= 0 {
+			txIndex = entry.TxIndex
+		}
+	}
+	if entry.InputIndex >= 0 {
+		inputIndex = entry.InputIndex
+		hashType = int64(entry.HashType)
+	}
+
+	var txID, pubkeyID int64
+	err = tx.Get(&txID, "INSERT INTO transactions (txid, block_hash, block_height, tx_index) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (txid) DO UPDATE SET "+
+		"block_hash = COALESCE(EXCLUDED.block_hash, transactions.block_hash), "+
+		"block_height = COALESCE(EXCLUDED.block_height, transactions.block_height), "+
+		"tx_index = COALESCE(EXCLUDED.tx_index, transactions.tx_index) RETURNING id",
+		entry.SrcTxn, blockHash, blockHeight, txIndex)
+	if err != nil {
+		return err
+	}
+	err = tx.Get(&pubkeyID, "INSERT INTO pubkeys (pubkey) VALUES ($1) "+
+		"ON CONFLICT (pubkey) DO UPDATE SET pubkey = EXCLUDED.pubkey RETURNING id", entry.PubKey)
+	if err != nil {
+		return err
+	}
+	if inputIndex != nil {
+		_, err = tx.Exec("INSERT INTO inputs (transaction_id, input_index, script_type) VALUES ($1, $2, $3) "+
+			"ON CONFLICT (transaction_id, input_index) DO NOTHING", txID, inputIndex, entry.ScriptType)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO signatures (transaction_id, input_index, pubkey_id, r, s, z, sighash_type) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (pubkey_id, r, z) DO NOTHING",
+		txID, inputIndex, pubkeyID, entry.R, CanonicalS(entry.PubKey, entry.S), entry.Z, hashType)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (storage *PostgresStorage) FindByR(r []byte) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := storage.Select(&entries, selectEntries+"WHERE r = $1", r)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (storage *PostgresStorage) FindByPubKey(pubkey []byte) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := storage.Select(&entries, selectEntries+"WHERE pubkey = $1", pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (storage *PostgresStorage) FindCollisions() ([]*Collision, error) {
+	entries := make([]*Entry, 0)
+	err := storage.Select(&entries, selectEntries+"WHERE r IN "+
+		"(SELECT r FROM signatures GROUP BY r HAVING COUNT(DISTINCT z) > 1) ORDER BY r")
+	if err != nil {
+		return nil, err
+	}
+	return groupCollisions(entries), nil
+}
+
+func (storage *PostgresStorage) ForEachEntry(pubkey []byte, fn func(entry *Entry) error) error {
+	rows, err := storage.Queryx(selectEntries+"WHERE pubkey = $1", pubkey)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := new(Entry)
+		if err := rows.StructScan(entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (storage *PostgresStorage) ForEachPubKey(fn func(pubkey []byte) error) error {
+	rows, err := storage.Query("SELECT pubkey FROM pubkeys WHERE id IN (SELECT pubkey_id FROM signatures)")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pubkey []byte
+		if err := rows.Scan(&pubkey); err != nil {
+			return err
+		}
+		if err := fn(pubkey); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (storage *PostgresStorage) PutRecovery(rec *RecoveredKey) error {
+	tx, err := storage.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pubkeyID int64
+	err = tx.Get(&pubkeyID, "INSERT INTO pubkeys (pubkey) VALUES ($1) "+
+		"ON CONFLICT (pubkey) DO UPDATE SET pubkey = EXCLUDED.pubkey RETURNING id", rec.PubKey)
+	if err != nil {
+		return err
+	}
+	var recoveryIDs []int64
+	err = tx.Select(&recoveryIDs, "INSERT INTO recoveries (pubkey_id, privkey, method, r, nonce, verified) "+
+		"VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (privkey, method) DO NOTHING RETURNING id",
+		pubkeyID, rec.PrivKey, rec.Method, rec.R, rec.Nonce, rec.Verified)
+	if err != nil {
+		return err
+	}
+	if len(recoveryIDs) == 0 {
+		return nil
+	}
+	for i, srctxn := range rec.SrcTxns {
+		_, err := tx.Exec("WITH t AS (INSERT INTO transactions (txid) VALUES ($3) "+
+			"ON CONFLICT (txid) DO UPDATE SET txid = EXCLUDED.txid RETURNING id) "+
+			"INSERT INTO recovery_sources (recovery_id, position, transaction_id) SELECT $1, $2, id FROM t",
+			recoveryIDs[0], i, srctxn)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (storage *PostgresStorage) Recoveries() ([]*RecoveredKey, error) {
+	rows, err := storage.Query("SELECT p.pubkey, rc.privkey, rc.method, rc.r, rc.nonce, " +
+		"array_remove(array_agg(t.txid ORDER BY rs.position), NULL), rc.verified, rc.found_at " +
+		"FROM recoveries rc JOIN pubkeys p ON p.id = rc.pubkey_id " +
+		"LEFT JOIN recovery_sources rs ON rs.recovery_id = rc.id " +
+		"LEFT JOIN transactions t ON t.id = rs.transaction_id " +
+		"GROUP BY rc.id, p.pubkey ORDER BY rc.found_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recs := make([]*RecoveredKey, 0)
+	for rows.Next() {
+		rec := new(RecoveredKey)
+		err := rows.Scan(&rec.PubKey, &rec.PrivKey, &rec.Method, &rec.R, &rec.Nonce,
+			pq.Array(&rec.SrcTxns), &rec.Verified, &rec.FoundAt)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return recs, nil
 }
@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/canselcik/nonced/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nonced")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.db")
+
+	priv := testPrivKey()
+	other, _ := btcec.NewPrivateKey(btcec.S256())
+	first := ecdsaPair(priv, "first", testNonce)
+	shared := ecdsaPair(other, "shared", testNonce)
+	second := ecdsaPair(priv, "second", testNonce)
+	put := func(index storage.CollisionStorage, txn string, pair *sighash.SHPair) []*storage.Entry {
+		entries, err := index.PutAndCollide(txn, pair.PublicKey, pair.Z, pair.R.Bytes(), pair.S.Bytes())
+		assert.NoError(t, err)
+		return entries
+	}
+
+	index, err := storage.NewBoltStorage(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, put(index, "first", first), "collided with an empty index")
+	assert.Equal(t, 1, len(put(index, "shared", shared)), "missed a collision with another key")
+
+	// Storing the same signature again, malleated, changes nothing
+	malleated := *first
+	malleated.S = new(big.Int).Sub(btcec.S256().N, first.S)
+	assert.Equal(t, 1, len(put(index, "first", &malleated)), "collided with itself")
+	entries, err := index.FindByR(first.R.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries), "duplicate signature was stored")
+	assert.NoError(t, index.Close())
+
+	// The index survives a restart
+	index, err = storage.NewBoltStorage(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer index.Close()
+	collisions := put(index, "second", second)
+	if !assert.Equal(t, 2, len(collisions), "wrong number of collisions") {
+		return
+	}
+	byKey, err := index.FindByPubKey(priv.PubKey().SerializeUncompressed())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(byKey), "wrong number of signatures by pubkey")
+	lowS := new(big.Int).Rsh(btcec.S256().N, 1)
+	for _, entry := range byKey {
+		assert.True(t, new(big.Int).SetBytes(entry.S).Cmp(lowS) <= 0, "S was not canonicalized")
+	}
+
+	// The past signature reveals the key once back in a bucket
+	var recovered []*sighash.Recovery
+	bucket := sighash.NewSHPairBucket(nil)
+	bucket.OnRecovery = func(rec *sighash.Recovery) {
+		recovered = append(recovered, rec)
+	}
+	bucket.AddPairs(second)
+	for _, entry := range collisions {
+		bucket.AddPairs(&sighash.SHPair{
+			PublicKey: entry.PubKey,
+			R:         new(big.Int).SetBytes(entry.R),
+			S:         new(big.Int).SetBytes(entry.S),
+			Z:         entry.Z,
+		})
+	}
+	if assert.Equal(t, 1, len(recovered), "wrong number of recoveries") {
+		assert.Equal(t, priv.D, recovered[0].Key.D, "derived incorrect privateKey")
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nonced")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	filter := storage.NewBloomFilter(1000, 0.01)
+	var added [][]byte
+	for i := int64(1); i <= 1000; i++ {
+		r := big.NewInt(i * 7919).Bytes()
+		filter.Add(r)
+		added = append(added, r)
+	}
+	for _, r := range added {
+		assert.True(t, filter.MayContain(r), "false negative")
+	}
+	assert.Equal(t, uint64(1000), filter.Count(), "wrong number of R values")
+	assert.True(t, filter.FalsePositiveRate() < 0.02, "estimated false positive rate too high")
+
+	// The filter survives a restart
+	path := filepath.Join(dir, "r.filter")
+	if !assert.NoError(t, filter.Save(path)) {
+		return
+	}
+	loaded, err := storage.LoadBloomFilter(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, filter.Bits(), loaded.Bits(), "wrong number of bits")
+	assert.Equal(t, filter.Hashes(), loaded.Hashes(), "wrong number of hashes")
+	for _, r := range added {
+		assert.True(t, loaded.MayContain(r), "false negative after loading")
+	}
+}
+
+func TestFilteredStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nonced")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	priv := testPrivKey()
+	first := ecdsaPair(priv, "first", testNonce)
+	second := ecdsaPair(priv, "second", testNonce)
+	index, err := storage.NewBoltStorage(filepath.Join(dir, "index.db"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer index.Close()
+	assert.NoError(t, index.PutEntry("first", first.PublicKey, first.Z, first.R.Bytes(), first.S.Bytes()))
+
+	// A filter rebuilt from the index knows about the signatures already in it
+	filter, err := storage.RebuildBloomFilter(index, 1000, 0.001)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(1), filter.Count(), "wrong number of R values")
+	filtered := storage.NewFilteredStorage(index, filter)
+
+	other := ecdsaPair(priv, "other", big.NewInt(0x6f74686572))
+	entries, err := filtered.PutAndCollide("other", other.PublicKey, other.Z, other.R.Bytes(), other.S.Bytes())
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "collided on a new R value")
+	entries, err = filtered.PutAndCollide("second", second.PublicKey, second.Z, second.R.Bytes(), second.S.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries), "missed a collision behind the filter")
+
+	stats := filtered.Stats()
+	assert.Equal(t, uint64(1), stats.Misses, "wrong number of misses")
+	assert.Equal(t, uint64(1), stats.Hits, "wrong number of hits")
+	assert.Equal(t, uint64(0), stats.FalsePositives, "wrong number of false positives")
+
+	// Signatures behind a miss are still stored
+	entries, err = index.FindByR(other.R.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries), "signature was not stored on a miss")
+
+	// A saved filter is in sync with the index until the index is written
+	// to behind its back
+	path := filepath.Join(dir, "r.filter")
+	if !assert.NoError(t, filtered.Save(path)) {
+		return
+	}
+	generation, err := index.Generation()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), generation, "wrong index generation")
+	loaded, err := storage.LoadBloomFilter(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, generation, loaded.Generation(), "filter saved out of sync")
+	}
+	late := ecdsaPair(priv, "late", big.NewInt(0x6c617465))
+	assert.NoError(t, index.PutEntry("late", late.PublicKey, late.Z, late.R.Bytes(), late.S.Bytes()))
+	generation, err = index.Generation()
+	assert.NoError(t, err)
+	assert.NotEqual(t, loaded.Generation(), generation, "stale filter looks in sync")
+}
+
+func TestStorageQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nonced")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	index, err := storage.NewBoltStorage(filepath.Join(dir, "index.db"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer index.Close()
+
+	priv := testPrivKey()
+	other, _ := btcec.NewPrivateKey(btcec.S256())
+	first := ecdsaPair(priv, "first", testNonce)
+	second := ecdsaPair(priv, "second", testNonce)
+	shared := ecdsaPair(other, "shared", testNonce)
+	single := ecdsaPair(other, "single", big.NewInt(0x73696e676c65))
+	pubkey := priv.PubKey().SerializeUncompressed()
+
+	for name, store := range map[string]storage.CollisionStorage{
+		"memory": storage.NewMemoryStorage(),
+		"bolt":   index,
+	} {
+		for _, pair := range []*sighash.SHPair{first, second, shared, first} {
+			assert.NoError(t, store.PutEntry(name, pair.PublicKey, pair.Z, pair.R.Bytes(), pair.S.Bytes()))
+		}
+		assert.NoError(t, store.PutSignature(&storage.Entry{
+			SrcTxn:      name,
+			PubKey:      single.PublicKey,
+			Z:           single.Z,
+			R:           single.R.Bytes(),
+			S:           single.S.Bytes(),
+			InputIndex:  3,
+			HashType:    0x81,
+			ScriptType:  "p2pkh",
+			BlockHash:   "000000000000000000000000000000000000000000000000000000000000beef",
+			BlockHeight: 200000,
+			TxIndex:     7,
+		}))
+
+		byR, err := store.FindByR(first.R.Bytes())
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(byR), "%s: wrong number of signatures by R", name)
+		byKey, err := store.FindByPubKey(pubkey)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(byKey), "%s: wrong number of signatures by pubkey", name)
+		streamed := 0
+		assert.NoError(t, store.ForEachEntry(pubkey, func(entry *storage.Entry) error {
+			streamed++
+			return nil
+		}))
+		assert.Equal(t, 2, streamed, "%s: wrong number of streamed signatures", name)
+
+		bySingle, err := store.FindByR(single.R.Bytes())
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, len(bySingle), "%s: signature was not stored", name) {
+			assert.Equal(t, 3, bySingle[0].InputIndex, "%s: wrong input", name)
+			assert.Equal(t, uint32(0x81), bySingle[0].HashType, "%s: wrong sighash type", name)
+			assert.Equal(t, "p2pkh", bySingle[0].ScriptType, "%s: wrong script type", name)
+			assert.Equal(t, int32(200000), bySingle[0].BlockHeight, "%s: wrong height", name)
+			assert.Equal(t, 7, bySingle[0].TxIndex, "%s: wrong position in the block", name)
+		}
+		for _, entry := range byKey {
+			assert.Equal(t, -1, entry.InputIndex, "%s: input should be unknown", name)
+			assert.Equal(t, -1, entry.TxIndex, "%s: position should be unknown", name)
+		}
+
+		collisions, err := store.FindCollisions()
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, len(collisions), "%s: wrong number of collisions", name) {
+			assert.Equal(t, 0, new(big.Int).SetBytes(collisions[0].R).Cmp(first.R), "%s: wrong R", name)
+			assert.Equal(t, 3, len(collisions[0].Entries), "%s: wrong number of colliding signatures", name)
+		}
+
+		rec := &storage.RecoveredKey{
+			PubKey:   pubkey,
+			PrivKey:  priv.Serialize(),
+			Method:   "nonce-reuse",
+			R:        first.R.Bytes(),
+			Nonce:    testNonce.Bytes(),
+			SrcTxns:  []string{"first", "second"},
+			Verified: true,
+		}
+		assert.NoError(t, store.PutRecovery(rec))
+		assert.NoError(t, store.PutRecovery(rec))
+		recs, err := store.Recoveries()
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, len(recs), "%s: wrong number of recoveries", name) {
+			assert.Equal(t, rec.PrivKey, recs[0].PrivKey, "%s: wrong key", name)
+			assert.Equal(t, rec.SrcTxns, recs[0].SrcTxns, "%s: wrong provenance", name)
+			assert.False(t, recs[0].FoundAt.IsZero(), "%s: missing time of recovery", name)
+		}
+
+		pubkeys := 0
+		assert.NoError(t, store.ForEachPubKey(func(pubkey []byte) error {
+			pubkeys++
+			return nil
+		}))
+		assert.Equal(t, 2, pubkeys, "%s: wrong number of pubkeys", name)
+
+		// R values with and without their leading zeros are the same
+		shortR := bytes.Repeat([]byte{0x11}, 31)
+		paddedR := append([]byte{0}, shortR...)
+		assert.NoError(t, store.PutEntry(name, pubkey, []byte{1}, shortR, []byte{1}))
+		assert.NoError(t, store.PutEntry(name, pubkey, []byte{2}, paddedR, []byte{1}))
+		collisions, err = store.FindCollisions()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(collisions), "%s: padded R values were not grouped", name)
+
+		// Signatures of a batch collide with each other as well
+		nonce := big.NewInt(0x6261746368)
+		batch := []*storage.Entry{}
+		for _, pair := range []*sighash.SHPair{ecdsaPair(priv, "batch", nonce), ecdsaPair(other, "batch", nonce)} {
+			batch = append(batch, &storage.Entry{
+				SrcTxn: name, PubKey: pair.PublicKey, Z: pair.Z, R: pair.R.Bytes(), S: pair.S.Bytes(),
+				InputIndex: -1, BlockHeight: -1,
+			})
+		}
+		found, err := store.PutAndCollideBatch(batch)
+		if assert.NoError(t, err) && assert.Equal(t, 2, len(found)) {
+			assert.Empty(t, found[0], "%s: collided with a new R value", name)
+			assert.Equal(t, 1, len(found[1]), "%s: missed a collision within the batch", name)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/canselcik/nonced/internal/sighash"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	assert.NoError(t, err)
+	return b
+}
+
+func xOnly(pub *btcec.PublicKey) []byte {
+	return pub.SerializeCompressed()[1:]
+}
+
+func p2trScript(outputKey []byte) []byte {
+	return append([]byte{txscript.OP_1, txscript.OP_DATA_32}, outputKey...)
+}
+
+// signSchnorrWithNonce produces a BIP340 signature over msg using the given
+// nonce, observing the even-Y conventions for both the key and the nonce.
+func signSchnorrWithNonce(priv *btcec.PrivateKey, msg []byte, k *big.Int, hashType txscript.SigHashType) []byte {
+	curve := btcec.S256()
+	d := new(big.Int).Set(priv.D)
+	if priv.PubKey().Y.Bit(0) == 1 {
+		d.Sub(curve.N, d)
+	}
+	k = new(big.Int).Set(k)
+	rx, ry := curve.ScalarBaseMult(k.Bytes())
+	if ry.Bit(0) == 1 {
+		k.Sub(curve.N, k)
+	}
+
+	e := sighash.SchnorrChallenge(rx, xOnly(priv.PubKey()), msg)
+	s := new(big.Int).Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+
+	sig := make([]byte, 64)
+	rx.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	if hashType != sighash.SigHashDefault {
+		sig = append(sig, byte(hashType))
+	}
+	return sig
+}
+
+// taprootVectorTx builds the txn the reference sighashes were computed for.
+func taprootVectorTx() (*wire.MsgTx, []*wire.TxOut) {
+	msgTx := wire.NewMsgTx(2)
+	msgTx.LockTime = 500
+	prevOuts := make([]*wire.TxOut, 0)
+	for i, program := range [][]byte{
+		append([]byte{0x51, 0x20, 0x11}, make([]byte, 31)...),
+		append([]byte{0x00, 0x14, 0x22}, make([]byte, 19)...),
+		append([]byte{0x51, 0x20, 0x33}, make([]byte, 31)...),
+	} {
+		hash := chainhash.Hash(sha256.Sum256([]byte{byte(i)}))
+		txIn := wire.NewTxIn(wire.NewOutPoint(&hash, uint32(i)), nil, nil)
+		txIn.Sequence = 0xfffffffd
+		msgTx.AddTxIn(txIn)
+		prevOuts = append(prevOuts, wire.NewTxOut(int64(100000*(i+1)), program))
+	}
+	msgTx.AddTxOut(wire.NewTxOut(50000, []byte{txscript.OP_TRUE}))
+	msgTx.AddTxOut(wire.NewTxOut(1234, []byte{txscript.OP_RETURN}))
+	return msgTx, prevOuts
+}
+
+func TestTaprootSigHash(t *testing.T) {
+	msgTx, prevOuts := taprootVectorTx()
+	sigHashes := sighash.NewTaprootSigHashes(msgTx, prevOuts)
+
+	expected := map[int]map[txscript.SigHashType]string{
+		0: {
+			0x00: "a0bacff874773b1c62b4c76db0b45495cf1235454613305e4ef0a26a84c581d0",
+			0x01: "630fed23109113ed1e8dbda8910a8b989cbceb2fa6e89b79e77114abae44fe9e",
+			0x02: "b00519c991f93d5fb17ded9b35b1f5bfdf820cc431a93e97876dfc4a28cb741c",
+			0x03: "7cd6235666a914a99b4e484abd7fad21ef745b47a20c32819dd34e9807a20f61",
+			0x81: "abd94ff269f7427e96f61b537b7ae31adcb61d140cc7020c503af625099e8f99",
+			0x82: "cf3461dd9c87c704200a695a642ddab01935e382b622271d17747c135a1f2114",
+			0x83: "084daac0d07d42c32db5d809aaed5de574b93a4fd535963aed6c5b040dbc649b",
+		},
+		2: {
+			0x00: "f313419eee43cc8cbb13500186a85b2c3349d4b7cb2945385625ba2c95d8623a",
+			0x01: "d22100578e57adb1915e7b1299a38ea1845ffddaa04d1e62f4ca845f9804be46",
+			0x02: "13349cdea42f2019afc9f7238329a8319b7c000869c958e59af1b44de0241b39",
+			0x81: "55e56cb19c2e8b17053b3eaf8bd10dfab7eab9cf8228c89ac0937dd66bd845b9",
+			0x82: "bbc2aa107de20c5783dc401148aeb0f106eb1488d3ab362f8056f385ea34f474",
+		},
+	}
+	for idx, vectors := range expected {
+		for hashType, want := range vectors {
+			z, err := sighash.CalcTaprootSigHash(sigHashes, hashType, msgTx, idx, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, want, hex.EncodeToString(z), "wrong sighash for input %d hashtype %02x", idx, hashType)
+		}
+	}
+
+	// SIGHASH_SINGLE without a matching output is invalid under BIP341
+	_, err := sighash.CalcTaprootSigHash(sigHashes, txscript.SigHashSingle, msgTx, 2, nil)
+	assert.Equal(t, sighash.ErrTaprootHashType, err)
+}
+
+func TestVerifySchnorr(t *testing.T) {
+	msg := make([]byte, 32)
+	msg[0] = 0x42
+	pubKey := mustDecodeHex(t, "dbd0c61532279cf72981c3584fc32216e0127699635c2789f549e0730c059b81")
+	sig := mustDecodeHex(t, "88cd4bc892749040a093ac2f45e4eaa90205c273f0eb99f6fce7097e66e1cc9c"+
+		"1ffeb9507f75099ba2d96f090169887fcf31a6c0f6e87425b43ded5a3211ce04")
+
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	assert.True(t, sighash.VerifySchnorr(pubKey, msg, r, s), "valid signature rejected")
+	msg[1] = 0x01
+	assert.False(t, sighash.VerifySchnorr(pubKey, msg, r, s), "invalid signature accepted")
+}
+
+func TestTaprootNonceReuse(t *testing.T) {
+	ds := new(MockedDataSource)
+	priv := testPrivKey()
+	outputKey := xOnly(priv.PubKey())
+	segwitScript := p2wpkhScript(t, priv.PubKey())
+
+	// The same nonce is reused across schemes, which is only exploitable
+	// within each of them
+	fundingTx := newFundingTx(ds, p2trScript(outputKey), p2trScript(outputKey), segwitScript, segwitScript)
+	spendTx := newSpendingTx(fundingTx)
+	sigHashes := sighash.NewTaprootSigHashes(spendTx, fundingTx.TxOut)
+	for i, hashType := range []txscript.SigHashType{sighash.SigHashDefault, txscript.SigHashNone | txscript.SigHashAnyOneCanPay} {
+		z, err := sighash.CalcTaprootSigHash(sigHashes, hashType, spendTx, i, nil)
+		assert.NoError(t, err)
+		spendTx.TxIn[i].Witness = wire.TxWitness{signSchnorrWithNonce(priv, z, testNonce, hashType)}
+	}
+	witnessSigHashes := txscript.NewTxSigHashes(spendTx)
+	for i := 2; i < 4; i++ {
+		z, err := txscript.CalcWitnessSigHash(segwitScript, witnessSigHashes, txscript.SigHashAll, spendTx, i, 100000)
+		assert.NoError(t, err)
+		spendTx.TxIn[i].Witness = wire.TxWitness{
+			encodeSig(signWithNonce(priv, z, testNonce), txscript.SigHashAll),
+			priv.PubKey().SerializeCompressed(),
+		}
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 4, extracted, "wrong number of SHPair extractions")
+	assert.Equal(t, sighash.SigTypeSchnorr, bucket.Pairs[0].Type)
+	assert.Equal(t, txscript.SigHashNone|txscript.SigHashAnyOneCanPay, bucket.Pairs[1].HashType)
+
+	solutions, _ := bucket.Solve()
+	if assert.Equal(t, 2, len(solutions), "wrong number of PrivateKey solutions") {
+		for _, solution := range solutions {
+			assert.Equal(t, hex.EncodeToString(outputKey),
+				hex.EncodeToString(xOnly(solution.Key.PubKey())), "derived incorrect privateKey")
+		}
+	}
+	ds.AssertExpectations(t)
+}
+
+func TestTapscriptSigHash(t *testing.T) {
+	msgTx, prevOuts := taprootVectorTx()
+	sigHashes := sighash.NewTaprootSigHashes(msgTx, prevOuts)
+
+	leafScript := []byte{txscript.OP_DATA_32}
+	for i := byte(1); i <= 32; i++ {
+		leafScript = append(leafScript, i)
+	}
+	leafScript = append(leafScript, txscript.OP_CHECKSIG)
+	leafHash := sighash.TapLeafHash(sighash.TapscriptLeafVersion, leafScript)
+	assert.Equal(t, "e52b79f83ba9c697d8bd985e635c92b48e1beec6ac061c8f5350156642cb6c84",
+		hex.EncodeToString(leafHash), "wrong tapleaf hash")
+
+	z, err := sighash.CalcTapscriptSigHash(sigHashes, sighash.SigHashDefault, msgTx, 2, nil, leafHash, 0xffffffff)
+	assert.NoError(t, err)
+	assert.Equal(t, "05c05e858dba69467ac421f644d99897704a6076ab27e6054d25095d65512045",
+		hex.EncodeToString(z), "wrong sighash without codesep")
+
+	z, err = sighash.CalcTapscriptSigHash(sigHashes, sighash.SigHashDefault, msgTx, 2,
+		[]byte{0x50, 0xaa}, leafHash, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "dce427f15d267b177fadfddf734dd917d88c982fd8e677d60ea0b0a03baeb83a",
+		hex.EncodeToString(z), "wrong sighash with codesep and annex")
+}
+
+// tapscriptOutput commits to leafScript as the only leaf under internalKey,
+// returning the output key and the control block spending the leaf.
+func tapscriptOutput(internalKey *btcec.PrivateKey, leafScript []byte) ([]byte, []byte, []byte) {
+	curve := btcec.S256()
+	leafHash := sighash.TapLeafHash(sighash.TapscriptLeafVersion, leafScript)
+	internalX := xOnly(internalKey.PubKey())
+	internalPub, _ := btcec.ParsePubKey(append([]byte{0x02}, internalX...), curve)
+	tweakX, tweakY := curve.ScalarBaseMult(sighash.TaggedHash("TapTweak", internalX, leafHash))
+	outputX, outputY := curve.Add(internalPub.X, internalPub.Y, tweakX, tweakY)
+	outputKey := make([]byte, 32)
+	outputX.FillBytes(outputKey)
+	controlBlock := append([]byte{sighash.TapscriptLeafVersion | byte(outputY.Bit(0))}, internalX...)
+	return outputKey, controlBlock, leafHash
+}
+
+func TestTapscriptNonceReuse(t *testing.T) {
+	ds := new(MockedDataSource)
+	curve := btcec.S256()
+	priv := testPrivKey()
+	cosigner, _ := btcec.NewPrivateKey(curve)
+	internalKey, _ := btcec.NewPrivateKey(curve)
+
+	// <priv> CHECKSIGVERIFY <cosigner> CHECKSIG as the only leaf
+	leafScript, err := txscript.NewScriptBuilder().
+		AddData(xOnly(priv.PubKey())).AddOp(txscript.OP_CHECKSIGVERIFY).
+		AddData(xOnly(cosigner.PubKey())).AddOp(txscript.OP_CHECKSIG).Script()
+	assert.NoError(t, err)
+	outputKey, controlBlock, leafHash := tapscriptOutput(internalKey, leafScript)
+
+	fundingTx := newFundingTx(ds, p2trScript(outputKey), p2trScript(outputKey))
+	spendTx := newSpendingTx(fundingTx)
+	sigHashes := sighash.NewTaprootSigHashes(spendTx, fundingTx.TxOut)
+	for i := 0; i < 2; i++ {
+		z, err := sighash.CalcTapscriptSigHash(sigHashes, sighash.SigHashDefault, spendTx, i, nil, leafHash, 0xffffffff)
+		assert.NoError(t, err)
+		spendTx.TxIn[i].Witness = wire.TxWitness{
+			signSchnorrWithNonce(cosigner, z, big.NewInt(int64(1000+i)), sighash.SigHashDefault),
+			signSchnorrWithNonce(priv, z, testNonce, sighash.SigHashDefault),
+			leafScript,
+			controlBlock,
+		}
+	}
+
+	bucket := sighash.NewSHPairBucket(ds)
+	extracted, errMap := bucket.AddTx(spendTx)
+	assert.Empty(t, errMap, "unexpected extraction errors")
+	assert.Equal(t, 4, extracted, "wrong number of SHPair extractions")
+	assert.Equal(t, hex.EncodeToString(xOnly(cosigner.PubKey())),
+		hex.EncodeToString(bucket.Pairs[0].PublicKey), "signature matched to the wrong key")
+
+	solutions, _ := bucket.Solve()
+	if assert.Equal(t, 1, len(solutions), "wrong number of PrivateKey solutions") {
+		assert.Equal(t, hex.EncodeToString(xOnly(priv.PubKey())),
+			hex.EncodeToString(xOnly(solutions[0].Key.PubKey())), "derived incorrect privateKey")
+	}
+
+	// A control block that doesn't commit to the output key is rejected
+	controlBlock[0] ^= 0x01
+	_, errMap = sighash.NewSHPairBucket(ds).AddTx(spendTx)
+	assert.Equal(t, sighash.WarnControlBlockSkip, errMap[0])
+	ds.AssertExpectations(t)
+}